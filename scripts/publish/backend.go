@@ -0,0 +1,280 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// reviewBackend is a code review system the proposal commit is submitted
+// to. The rest of the workflow (discussion links, review message, trybots,
+// finalize) works the same for every backend. Whatever the backend calls a
+// review, its number and URL are kept in the publisher's clNumber and clURL.
+type reviewBackend interface {
+	// kind names a review in prose, such as "Gerrit CL".
+	kind() string
+
+	// ref returns a short reference to the review with the given number,
+	// such as "CL 1234".
+	ref(number string) string
+
+	// reviewURL returns the web URL of the review with the given number.
+	reviewURL(number string) string
+
+	// fileURL returns the web URL of file as of the given revision of the
+	// review with the given number. A revision of 0 is the latest one.
+	fileURL(number string, revision int, file string) string
+
+	// preflight checks that the commit can be submitted. It runs before
+	// anything is created on GitHub.
+	preflight() error
+
+	// submit sends the commit for review, creating the review or updating
+	// it, and records its number and URL.
+	submit() error
+
+	// lookup returns the current state of the review of the commit and
+	// records its number and URL.
+	lookup() (*reviewState, error)
+
+	// postMessage posts message on the review, superseding the message
+	// previously posted by the tool if there is one. It reports false if
+	// that message already says the same.
+	postMessage(message string) (bool, error)
+
+	// startTrybots starts the trybots on the submitted commit if they do not
+	// start by themselves, and returns where to follow them. It returns nil
+	// if the trybots cannot be run.
+	startTrybots() (trybotSource, error)
+
+	// pushedRef returns the remote-tracking ref of the branch the commit is
+	// pushed to for review, which is rewritten on every update, or "" if
+	// there is none.
+	pushedRef() string
+
+	// mergedAs describes the review commit was merged through, such as
+	// "merged on Gerrit as CL 1234", or returns "" if it was not merged.
+	mergedAs(commit string) (string, error)
+}
+
+// Review statuses, named as in Gerrit.
+const (
+	reviewOpen      = "NEW"
+	reviewMerged    = "MERGED"
+	reviewAbandoned = "ABANDONED"
+)
+
+// reviewState is the state of a review.
+type reviewState struct {
+	number       string
+	url          string
+	status       string // reviewOpen, reviewMerged or reviewAbandoned
+	revision     int    // patchset number, if the backend has them
+	mergedCommit string // commit the review was merged as
+}
+
+// Names of the review backends, as used by --review and publish.cfg.
+const (
+	backendGerrit = "gerrit"
+	backendGitHub = "github"
+)
+
+// setReviewBackend selects the review backend by name.
+func (p *Publisher) setReviewBackend(name string) error {
+	switch name {
+	case "", backendGerrit:
+		p.backend = &gerritBackend{p: p}
+	case backendGitHub:
+		p.backend = &pullRequestBackend{p: p}
+	default:
+		return fmt.Errorf("unknown review backend %q (want %s or %s)", name, backendGerrit, backendGitHub)
+	}
+	return nil
+}
+
+// reviewBackend returns the review backend, Gerrit unless another one was
+// selected.
+func (p *Publisher) reviewBackend() reviewBackend {
+	if p.backend == nil {
+		p.backend = &gerritBackend{p: p}
+	}
+	return p.backend
+}
+
+// preflight runs the review backend's checks of the commit to be submitted.
+func (p *Publisher) preflight() error {
+	p.logger.Info("Step 0: Checking commits can be submitted for review...")
+	return p.reviewBackend().preflight()
+}
+
+// reviewRevision returns the revision of the review the commit was
+// submitted as, looking it up if it is not known yet, or 0 if it cannot be
+// found.
+func (p *Publisher) reviewRevision() int {
+	if p.clRevision == 0 && !p.dryRun {
+		state, err := p.reviewBackend().lookup()
+		if err != nil {
+			p.logger.Warn("Could not find the revision under review: %v", err)
+			return 0
+		}
+		p.clRevision = state.revision
+	}
+	return p.clRevision
+}
+
+// capitalize returns s with its first letter in upper case, for using a
+// backend's kind at the start of a sentence.
+func capitalize(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToUpper(s[:1]) + s[1:]
+}
+
+// gerritBackend submits proposals to Gerrit with git codereview.
+type gerritBackend struct {
+	p *Publisher
+}
+
+func (b *gerritBackend) kind() string {
+	return "Gerrit CL"
+}
+
+func (b *gerritBackend) ref(number string) string {
+	return "CL " + number
+}
+
+func (b *gerritBackend) reviewURL(number string) string {
+	return b.p.changeURL(number, b.p.clURL)
+}
+
+func (b *gerritBackend) fileURL(number string, revision int, file string) string {
+	if revision == 0 {
+		// Without a patchset Gerrit would take the first segment of the
+		// path for one.
+		return b.reviewURL(number)
+	}
+	return fmt.Sprintf("%s/%d/%s", strings.TrimSuffix(b.reviewURL(number), "/"), revision, escapePath(file))
+}
+
+func (b *gerritBackend) preflight() error {
+	return b.p.checkChangeIDs()
+}
+
+func (b *gerritBackend) submit() error {
+	return b.p.submitCL()
+}
+
+func (b *gerritBackend) lookup() (*reviewState, error) {
+	change, err := b.p.lookupCL()
+	if err != nil {
+		return nil, err
+	}
+	state := &reviewState{
+		number:   b.p.clNumber,
+		url:      b.p.clURL,
+		status:   change.Status,
+		revision: change.CurrentPatchset(),
+	}
+	if change.Status == reviewMerged {
+		state.mergedCommit = change.CurrentRevision
+	}
+	return state, nil
+}
+
+func (b *gerritBackend) postMessage(message string) (bool, error) {
+	p := b.p
+	change, err := p.lookupCL()
+	if err != nil {
+		return false, err
+	}
+	client, err := p.gerritClient()
+	if err != nil {
+		return false, err
+	}
+
+	messages, err := client.changeMessages(change)
+	if err != nil {
+		return false, fmt.Errorf("failed to get messages of CL %s: %v", p.clNumber, err)
+	}
+	if lastReviewMessage(messages) == message {
+		return false, nil
+	}
+
+	review := &gerritReview{
+		Message: message,
+		Tag:     reviewMessageTag,
+		Notify:  "OWNER",
+	}
+	if err := client.setReview(change, review); err != nil {
+		return false, fmt.Errorf("failed to post review message on CL %s: %v", p.clNumber, err)
+	}
+	return true, nil
+}
+
+// startTrybots asks cueckoo to dispatch the trybots for the current
+// patchset of the CL.
+func (b *gerritBackend) startTrybots() (trybotSource, error) {
+	p := b.p
+
+	// Use the full commit hash for cueckoo (not the abbreviated one)
+	fullCommitHash, _, err := p.runCommand("git", "rev-parse", p.commitRef)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get full commit hash: %v", err)
+	}
+	fullCommitHash = strings.TrimSpace(fullCommitHash)
+
+	stdout, stderr, err := p.runCommand("cueckoo", "runtrybot", fullCommitHash)
+	if err != nil {
+		// Check if cueckoo is not installed
+		if strings.Contains(stderr, "command not found") || strings.Contains(stderr, "not found") {
+			p.logger.Warn("cueckoo not installed, skipping trybot run")
+			p.logger.Info("To install cueckoo: go install github.com/cue-lang/cueckoo/cmd/cueckoo@latest")
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to run trybots: %v (stderr: %s)", err, stderr)
+	}
+
+	p.logger.Success("Started trybots for commit %s", fullCommitHash[:8])
+	if stdout != "" {
+		p.logger.Info("Trybot output: %s", strings.TrimSpace(stdout))
+	}
+
+	// cueckoo dispatches the current patchset of the CL.
+	state, err := b.lookup()
+	if err != nil {
+		return nil, fmt.Errorf("failed to find patchset to track trybots for: %v", err)
+	}
+	cl, _ := strconv.Atoi(state.number)
+	return &dispatchedTrybots{p: p, cl: cl, patchset: state.revision}, nil
+}
+
+func (b *gerritBackend) pushedRef() string {
+	// git codereview mail pushes to refs/for/, which is not tracked.
+	return ""
+}
+
+func (b *gerritBackend) mergedAs(commit string) (string, error) {
+	p := b.p
+	message, _, err := p.runCommand("git", "log", "-1", "--format=%B", commit)
+	if err != nil {
+		return "", fmt.Errorf("failed to get commit message of %s: %v", shortHash(commit), err)
+	}
+	matches := changeIDPattern.FindStringSubmatch(message)
+	if matches == nil {
+		return "", nil
+	}
+
+	client, err := p.gerritClient()
+	if err != nil {
+		return "", err
+	}
+	change, err := client.changeByID(matches[1])
+	if err != nil {
+		return "", fmt.Errorf("failed to query Gerrit for %s: %v", matches[1], err)
+	}
+	if change == nil || change.Status != reviewMerged {
+		return "", nil
+	}
+	return fmt.Sprintf("merged on Gerrit as CL %d", change.Number), nil
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// backupRefPrefix is where the branch tip is saved before each history
+// rewrite, under a timestamp, for "publish undo".
+const backupRefPrefix = "refs/proposal-publish/backup/"
+
+// backupTimeFormat is the timestamp format of backup ref names. It sorts
+// in time order.
+const backupTimeFormat = "20060102T150405Z"
+
+// defaultBackupsKept is the number of backups "publish backups --prune"
+// keeps by default.
+const defaultBackupsKept = 10
+
+// backup is a saved branch tip.
+type backup struct {
+	ref    string
+	commit string
+	time   time.Time
+	branch string // branch that was rewritten, or "" for a detached HEAD
+	reason string // reflog message of the rewrite
+}
+
+// name returns the name of the backup as shown to the user.
+func (b *backup) name() string {
+	return strings.TrimPrefix(b.ref, backupRefPrefix)
+}
+
+// backupHead saves head, the tip of the branch about to be rewritten for
+// reason, under a new backup ref and returns the ref. The branch and reason
+// are kept in the ref's reflog.
+func (p *Publisher) backupHead(head, reason string) (string, error) {
+	branch, _, _ := p.runCommand("git", "symbolic-ref", "-q", "HEAD")
+	branch = strings.TrimSpace(branch)
+	message := reason
+	if branch != "" {
+		message += " on " + branch
+	}
+
+	stamp := time.Now().UTC().Format(backupTimeFormat)
+	for i := 1; ; i++ {
+		ref := backupRefPrefix + stamp
+		if i > 1 {
+			ref += fmt.Sprintf("-%02d", i)
+		}
+		// An empty old value creates the ref only if it does not exist yet,
+		// so that backups taken within the same second are all kept.
+		_, stderr, err := p.runCommand("git", "update-ref", "--create-reflog", "-m", message, ref, head, "")
+		if err == nil {
+			return ref, nil
+		}
+		// Only a backup taken in the same second is worth trying another
+		// name for; anything else fails the same way every time.
+		if _, _, existsErr := p.runCommand("git", "rev-parse", "--verify", "--quiet", ref); existsErr != nil || i >= 100 {
+			return "", fmt.Errorf("failed to save backup of %s: %v (stderr: %s)", shortHash(head), err, strings.TrimSpace(stderr))
+		}
+	}
+}
+
+// listBackups returns the backups, newest first.
+func (p *Publisher) listBackups() ([]*backup, error) {
+	out, _, err := p.runCommand("git", "for-each-ref", "--sort=-refname", "--format=%(refname) %(objectname)", backupRefPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list backups: %v", err)
+	}
+
+	var backups []*backup
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		ref, commit, ok := strings.Cut(line, " ")
+		if !ok {
+			continue
+		}
+		b := &backup{ref: ref, commit: commit}
+		stamp, _, _ := strings.Cut(b.name(), "-")
+		b.time, _ = time.Parse(backupTimeFormat, stamp)
+
+		message, _, _ := p.runCommand("git", "reflog", "show", "-n", "1", "--format=%gs", ref)
+		message = strings.TrimSpace(message)
+		if i := strings.LastIndex(message, " on refs/"); i >= 0 {
+			b.reason, b.branch = message[:i], message[i+len(" on "):]
+		} else {
+			b.reason = message
+		}
+		backups = append(backups, b)
+	}
+	return backups, nil
+}
+
+// findBackup returns the backup with the given name, or the latest one if
+// name is empty.
+func (p *Publisher) findBackup(name string) (*backup, error) {
+	backups, err := p.listBackups()
+	if err != nil {
+		return nil, err
+	}
+	if len(backups) == 0 {
+		return nil, fmt.Errorf("no backups to restore; publish saves one before rewriting history")
+	}
+	if name == "" {
+		return backups[0], nil
+	}
+	for _, b := range backups {
+		if b.name() == name || b.ref == name {
+			return b, nil
+		}
+	}
+	return nil, fmt.Errorf("no backup named %s; see publish backups", name)
+}
+
+// undo moves the current branch back to a backup and deletes the backup, so
+// that undoing again restores the one before. The files of the checkout
+// that differ are updated, as for a rewrite.
+func (p *Publisher) undo(name string) error {
+	b, err := p.findBackup(name)
+	if err != nil {
+		return err
+	}
+
+	branch, _, _ := p.runCommand("git", "symbolic-ref", "-q", "HEAD")
+	branch = strings.TrimSpace(branch)
+	if b.branch != "" && b.branch != branch {
+		return fmt.Errorf("backup %s is of %s, not the current branch; check it out first", b.name(), strings.TrimPrefix(b.branch, "refs/heads/"))
+	}
+
+	head, _, err := p.runCommand("git", "rev-parse", "HEAD")
+	if err != nil {
+		return fmt.Errorf("failed to resolve HEAD: %v", err)
+	}
+	head = strings.TrimSpace(head)
+
+	if p.dryRun {
+		p.logger.Info("[DRY RUN] Would move HEAD from %s back to %s (backup %s, before %s)",
+			shortHash(head), shortHash(b.commit), b.name(), b.reason)
+		return nil
+	}
+
+	if err := p.moveHead(head, b.commit, "publish: undo "+b.reason); err != nil {
+		return err
+	}
+	if _, stderr, err := p.runCommand("git", "update-ref", "-d", b.ref, b.commit); err != nil {
+		p.logger.Warn("Restored %s but could not delete backup %s: %s", shortHash(b.commit), b.name(), strings.TrimSpace(stderr))
+		return nil
+	}
+	p.logger.Success("Restored HEAD to %s from before %s (backup %s)", shortHash(b.commit), b.reason, b.name())
+	p.logger.Info("The rewritten history is still at %s", shortHash(head))
+	return nil
+}
+
+// pruneBackups deletes the backups beyond the keep newest ones that are
+// older than olderThan, if that is not zero. It returns the number of
+// backups deleted.
+func (p *Publisher) pruneBackups(keep int, olderThan time.Duration) (int, error) {
+	backups, err := p.listBackups()
+	if err != nil {
+		return 0, err
+	}
+	if keep < 0 {
+		keep = 0
+	}
+	if len(backups) <= keep {
+		return 0, nil
+	}
+
+	deleted := 0
+	for _, b := range backups[keep:] {
+		if olderThan > 0 && time.Since(b.time) < olderThan {
+			continue
+		}
+		if p.dryRun {
+			p.logger.Info("[DRY RUN] Would delete backup %s", b.name())
+			deleted++
+			continue
+		}
+		if _, stderr, err := p.runCommand("git", "update-ref", "-d", b.ref, b.commit); err != nil {
+			return deleted, fmt.Errorf("failed to delete backup %s: %v (stderr: %s)", b.name(), err, stderr)
+		}
+		deleted++
+	}
+	return deleted, nil
+}
+
+// runUndo implements "publish undo": it restores the branch as it was before
+// the last history rewrite, or before the one of the named backup.
+func runUndo(args []string) error {
+	fs := flag.NewFlagSet("undo", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "Show what would be restored without changing anything")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s undo [--dry-run] [backup]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Move the current branch back to where it was before publish last\n")
+		fmt.Fprintf(os.Stderr, "rewrote it, or to the given backup (see %s backups).\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() > 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	p := NewPublisher("HEAD", *dryRun, false)
+	return p.undo(fs.Arg(0))
+}
+
+// runBackups implements "publish backups": it lists the backups taken
+// before history rewrites, and prunes old ones.
+func runBackups(args []string) error {
+	fs := flag.NewFlagSet("backups", flag.ExitOnError)
+	prune := fs.Bool("prune", false, "Delete old backups")
+	keep := fs.Int("keep", defaultBackupsKept, "Number of most recent backups --prune keeps")
+	olderThan := fs.Duration("older-than", 0, "With --prune, only delete backups older than this")
+	dryRun := fs.Bool("dry-run", false, "With --prune, show what would be deleted")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s backups [--prune [--keep n] [--older-than d]]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "List the branch tips saved under %s before\n", backupRefPrefix)
+		fmt.Fprintf(os.Stderr, "each history rewrite, newest first.\n\n")
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	p := NewPublisher("HEAD", *dryRun, false)
+	if *prune {
+		deleted, err := p.pruneBackups(*keep, *olderThan)
+		if err != nil {
+			return err
+		}
+		p.logger.Success("Deleted %d backup(s)", deleted)
+		return nil
+	}
+
+	backups, err := p.listBackups()
+	if err != nil {
+		return err
+	}
+	if len(backups) == 0 {
+		p.logger.Info("No backups")
+		return nil
+	}
+	for _, b := range backups {
+		subject, _, _ := p.runCommand("git", "log", "-1", "--format=%s", b.commit)
+		branch := strings.TrimPrefix(b.branch, "refs/heads/")
+		if branch == "" {
+			branch = "detached HEAD"
+		}
+		fmt.Printf("%s  %s  %s  before %s: %s\n", b.name(), shortHash(b.commit), branch, b.reason, strings.TrimSpace(subject))
+	}
+	return nil
+}
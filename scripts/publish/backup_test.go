@@ -0,0 +1,178 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestUndoRename tests that a rename is backed up and can be undone
+func TestUndoRename(t *testing.T) {
+	repo := NewTestRepo(t)
+	defer repo.Cleanup()
+
+	repo.createDraftProposal("aliases", "# Aliases\n\n*   **Discussion Channel**: TBD\n")
+	oldHead := repo.getCommitHash()
+
+	oldDir, _ := os.Getwd()
+	os.Chdir(repo.dir)
+	defer os.Chdir(oldDir)
+
+	publisher := &Publisher{
+		logger:           NewLogger(),
+		commitRef:        "HEAD",
+		proposalFile:     "designs/language/xxxx-aliases.md",
+		basename:         "xxxx-aliases.md",
+		isDraft:          true,
+		discussionNumber: "4014",
+		discussionURL:    "https://github.com/cue-lang/cue/discussions/4014",
+	}
+	if err := publisher.renameProposal(); err != nil {
+		t.Fatalf("renameProposal failed: %v", err)
+	}
+	if err := publisher.commitDocumentEdits(); err != nil {
+		t.Fatalf("commitDocumentEdits failed: %v", err)
+	}
+	renamed := repo.getCommitHash()
+
+	backups, err := publisher.listBackups()
+	if err != nil {
+		t.Fatalf("listBackups failed: %v", err)
+	}
+	if len(backups) != 1 {
+		t.Fatalf("Expected 1 backup, got %d", len(backups))
+	}
+	b := backups[0]
+	if b.commit != oldHead {
+		t.Errorf("Backup is of %s, want %s", b.commit, oldHead)
+	}
+	if branch := strings.TrimSpace(repo.run("git", "symbolic-ref", "HEAD")); b.branch != branch {
+		t.Errorf("Wrong branch %q", b.branch)
+	}
+	if b.reason != "publish: rename proposal" {
+		t.Errorf("Wrong reason %q", b.reason)
+	}
+	if time.Since(b.time) > time.Hour {
+		t.Errorf("Wrong time %v", b.time)
+	}
+
+	// A dry run changes nothing.
+	publisher.dryRun = true
+	if err := publisher.undo(""); err != nil {
+		t.Fatalf("undo failed: %v", err)
+	}
+	if repo.getCommitHash() != renamed {
+		t.Error("Dry run moved the branch")
+	}
+
+	publisher.dryRun = false
+	if err := publisher.undo(b.name()); err != nil {
+		t.Fatalf("undo failed: %v", err)
+	}
+	if repo.getCommitHash() != oldHead {
+		t.Error("Branch not restored")
+	}
+	if !repo.fileExists("designs/language/xxxx-aliases.md") || repo.fileExists("designs/language/4014-aliases.md") {
+		t.Error("Checkout not restored")
+	}
+	if status := repo.run("git", "status", "--porcelain"); status != "" {
+		t.Errorf("Unexpected status:\n%s", status)
+	}
+	if backups, _ := publisher.listBackups(); len(backups) != 0 {
+		t.Errorf("Backup not deleted after undo: %d left", len(backups))
+	}
+	if _, err := publisher.findBackup(""); err == nil {
+		t.Error("Expected error with no backups left")
+	}
+}
+
+// TestUndoOtherBranch tests that a backup is only restored onto the branch
+// it was taken of
+func TestUndoOtherBranch(t *testing.T) {
+	repo := NewTestRepo(t)
+	defer repo.Cleanup()
+
+	repo.createDraftProposal("aliases", "# Aliases\n")
+
+	oldDir, _ := os.Getwd()
+	os.Chdir(repo.dir)
+	defer os.Chdir(oldDir)
+
+	p := &Publisher{logger: NewLogger()}
+	if _, err := p.backupHead(repo.getCommitHash(), "publish: test"); err != nil {
+		t.Fatalf("backupHead failed: %v", err)
+	}
+	branch := strings.TrimSpace(repo.run("git", "branch", "--show-current"))
+	repo.run("git", "checkout", "-q", "-b", "other")
+
+	if err := p.undo(""); err == nil || !strings.Contains(err.Error(), "is of "+branch) {
+		t.Errorf("Expected branch mismatch error, got: %v", err)
+	}
+}
+
+// TestBackupFailure tests that a backup that cannot be saved fails at once
+// rather than being retried under other names
+func TestBackupFailure(t *testing.T) {
+	repo := NewTestRepo(t)
+	defer repo.Cleanup()
+
+	oldDir, _ := os.Getwd()
+	os.Chdir(repo.dir)
+	defer os.Chdir(oldDir)
+
+	runner := newFakeRunner(t, "git")
+	runner.on("git", "update-ref", "...").fails(128, "fatal: cannot lock ref: Permission denied")
+	p := &Publisher{logger: NewLogger(), commands: runner}
+	_, err := p.backupHead(repo.getCommitHash(), "publish: test")
+	if err == nil || !strings.Contains(err.Error(), "Permission denied") {
+		t.Errorf("Expected the update-ref error, got: %v", err)
+	}
+	if calls := runner.ran("git", "update-ref", "..."); len(calls) != 1 {
+		t.Errorf("Expected one attempt, got %d:\n%s", len(calls), runner.transcript())
+	}
+}
+
+// TestPruneBackups tests that pruning keeps the newest backups
+func TestPruneBackups(t *testing.T) {
+	repo := NewTestRepo(t)
+	defer repo.Cleanup()
+
+	head := repo.getCommitHash()
+
+	oldDir, _ := os.Getwd()
+	os.Chdir(repo.dir)
+	defer os.Chdir(oldDir)
+
+	p := &Publisher{logger: NewLogger()}
+	var refs []string
+	for range 4 {
+		ref, err := p.backupHead(head, "publish: test")
+		if err != nil {
+			t.Fatalf("backupHead failed: %v", err)
+		}
+		refs = append(refs, ref)
+	}
+
+	// Backups taken within the same second get distinct names.
+	if refs[0] == refs[1] {
+		t.Fatalf("Backup ref reused: %s", refs[0])
+	}
+
+	// Recent backups are kept when only older ones are to go.
+	if deleted, err := p.pruneBackups(1, time.Hour); err != nil || deleted != 0 {
+		t.Errorf("pruneBackups deleted %d, err %v; want 0", deleted, err)
+	}
+
+	deleted, err := p.pruneBackups(2, 0)
+	if err != nil {
+		t.Fatalf("pruneBackups failed: %v", err)
+	}
+	if deleted != 2 {
+		t.Errorf("Deleted %d backups, want 2", deleted)
+	}
+	backups, _ := p.listBackups()
+	if len(backups) != 2 || backups[0].ref != refs[3] || backups[1].ref != refs[2] {
+		t.Errorf("Wrong backups kept: %v", backups)
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// publishedRevisionPattern finds the commit a discussion body was generated
+// from, in the permalink or review link documentLinks adds to it.
+var publishedRevisionPattern = regexp.MustCompile(`· \[(?:permalink|revision under review)\]\([^)]*\) \(([0-9a-f]{7,40})\)`)
+
+// publishedRevision returns the commit the managed region of the
+// discussion body was generated from, or "" if it does not say.
+func publishedRevision(body string) string {
+	m := publishedRevisionPattern.FindStringSubmatch(managedRegion(body))
+	if m == nil {
+		return ""
+	}
+	return m[1]
+}
+
+// metadataField is a metadata line of a proposal.
+type metadataField struct {
+	name, value string
+}
+
+// metadataFields returns the metadata of a proposal, from the lines before
+// its first section, in order. The document heading is included as the
+// field "Title".
+func metadataFields(content string) []metadataField {
+	var fields []metadataField
+	if title := extractTitle(content); title != "" {
+		fields = append(fields, metadataField{"Title", title})
+	}
+	for _, s := range splitSections(content) {
+		if s.title != "" {
+			break
+		}
+		for _, line := range strings.Split(s.text, "\n") {
+			if m := metadataFieldPattern.FindStringSubmatch(strings.TrimSpace(line)); m != nil {
+				fields = append(fields, metadataField{strings.TrimSpace(m[1]), m[2]})
+			}
+		}
+	}
+	return fields
+}
+
+// revisionDiff is the difference between two revisions of a proposal, by
+// section and metadata field.
+type revisionDiff struct {
+	added, removed, changed []string // section titles
+	introChanged            bool     // the text before the first section changed
+	metadata                []string // descriptions of the changed fields
+}
+
+func (d *revisionDiff) empty() bool {
+	return len(d.added) == 0 && len(d.removed) == 0 && len(d.changed) == 0 &&
+		!d.introChanged && len(d.metadata) == 0
+}
+
+// diffRevisions compares two revisions of a proposal. Sections are matched
+// by their heading, so a renamed section shows as removed and added.
+func diffRevisions(old, updated string) *revisionDiff {
+	old, updated = withoutApprovedSummary(old), withoutApprovedSummary(updated)
+	d := &revisionDiff{}
+
+	oldSections := map[string]string{}
+	for _, s := range splitSections(old) {
+		oldSections[s.title] = strings.TrimSpace(s.text)
+	}
+	seen := map[string]bool{}
+	for _, s := range splitSections(updated) {
+		seen[s.title] = true
+		text, ok := oldSections[s.title]
+		switch {
+		case s.title == "":
+			d.introChanged = !ok || introText(text) != introText(s.text)
+		case !ok:
+			d.added = append(d.added, s.title)
+		case text != strings.TrimSpace(s.text):
+			d.changed = append(d.changed, s.title)
+		}
+	}
+	for _, s := range splitSections(old) {
+		if !seen[s.title] {
+			d.removed = append(d.removed, s.title)
+		}
+	}
+
+	oldFields := map[string]string{}
+	for _, f := range metadataFields(old) {
+		oldFields[f.name] = f.value
+	}
+	newFields := map[string]bool{}
+	for _, f := range metadataFields(updated) {
+		newFields[f.name] = true
+		switch value, ok := oldFields[f.name]; {
+		case !ok:
+			d.metadata = append(d.metadata, fmt.Sprintf("**%s**: %s (new)", f.name, f.value))
+		case value != f.value:
+			d.metadata = append(d.metadata, fmt.Sprintf("**%s**: %s → %s", f.name, value, f.value))
+		}
+	}
+	for _, f := range metadataFields(old) {
+		if !newFields[f.name] {
+			d.metadata = append(d.metadata, fmt.Sprintf("**%s**: removed", f.name))
+		}
+	}
+	return d
+}
+
+// introText returns the text before the first section without the heading
+// and metadata, which are compared separately.
+func introText(text string) string {
+	var lines []string
+	for _, line := range strings.Split(text, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "# ") || metadataFieldPattern.MatchString(trimmed) {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
+
+// markdown lists the changes as Markdown bullets.
+func (d *revisionDiff) markdown() string {
+	var b strings.Builder
+	for _, m := range d.metadata {
+		fmt.Fprintf(&b, "- %s\n", m)
+	}
+	if d.introChanged {
+		b.WriteString("- Changed the introduction\n")
+	}
+	list := func(what string, titles []string) {
+		if len(titles) > 0 {
+			fmt.Fprintf(&b, "- %s: %s\n", what, strings.Join(titles, ", "))
+		}
+	}
+	list("Added sections", d.added)
+	list("Removed sections", d.removed)
+	list("Changed sections", d.changed)
+	return b.String()
+}
+
+// defaultChangePrompt is the prompt the summary-command describes the
+// changes to a proposal with.
+const defaultChangePrompt = `{proposal}
+The above is a unified diff between two revisions of the CUE language proposal "{title}". Summarize for the readers of its GitHub discussion what changed in the proposal and why it matters, in one or two short paragraphs of markdown. Describe changes to the design, not to wording or formatting.`
+
+// changeSummarizer returns the summarizer to describe the changes to a
+// proposal with, or nil if summaries are only extracted.
+func (p *Publisher) changeSummarizer() (Summarizer, error) {
+	s := p.summarizer
+	if s == nil {
+		var err error
+		if s, err = p.newSummarizer(); err != nil {
+			return nil, err
+		}
+	}
+	switch s := s.(type) {
+	case sectionSummarizer:
+		return nil, nil
+	case *commandSummarizer:
+		changes := *s
+		changes.prompt = defaultChangePrompt
+		return &changes, nil
+	}
+	return s, nil
+}
+
+// describeChanges returns a Markdown description of the changes to the
+// proposal from the published revision from to the one in commit to, or ""
+// if the proposal did not change. With a summarizer, the list of changed
+// sections and fields is preceded by its summary of the diff.
+func (p *Publisher) describeChanges(from, to string) (string, error) {
+	resolve := func(rev string) (string, error) {
+		out, _, err := p.runCommand("git", "rev-parse", "--verify", "--quiet", rev+"^{commit}")
+		if err != nil {
+			return "", fmt.Errorf("commit %s not found; fetch it to compare against it", rev)
+		}
+		return strings.TrimSpace(out), nil
+	}
+	fromCommit, err := resolve(from)
+	if err != nil {
+		return "", err
+	}
+	toCommit, err := resolve(to)
+	if err != nil {
+		return "", err
+	}
+	if fromCommit == toCommit {
+		return "", nil
+	}
+
+	// The proposal may have had another name then.
+	oldFile := p.newProposalFile
+	old, _, err := p.runCommand("git", "show", fromCommit+":"+oldFile)
+	if err != nil {
+		oldFile = p.proposalFile
+		if old, _, err = p.runCommand("git", "show", fromCommit+":"+oldFile); err != nil {
+			return "", fmt.Errorf("proposal not found in %s", shortHash(fromCommit))
+		}
+	}
+	updated, _, err := p.runCommand("git", "show", toCommit+":"+p.newProposalFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read proposal file from commit: %v", err)
+	}
+
+	d := diffRevisions(old, updated)
+	if d.empty() {
+		return "", nil
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "**Changes since %s:**\n\n", shortHash(fromCommit))
+	s, err := p.changeSummarizer()
+	if err != nil {
+		p.logger.Warning("Not summarizing the changes: %v", err)
+	}
+	if s != nil {
+		diff := unifiedDiff("a/"+oldFile, "b/"+p.newProposalFile, withoutApprovedSummary(old), withoutApprovedSummary(updated))
+		// The title heads the diff, as the summarizer's prompt may use it.
+		summary, err := p.summarizeWith(s, "# "+extractTitle(updated)+"\n\n"+diff, false)
+		if err != nil {
+			p.logger.Warning("Summary of the changes with %s failed: %v", s.Name(), err)
+		} else {
+			b.WriteString(strings.TrimSpace(summary) + "\n\n")
+		}
+	}
+	b.WriteString(d.markdown())
+	return b.String(), nil
+}
+
+// postChanges posts a description of the changes since the revision of the
+// proposal the discussion was last updated with, from the discussion body
+// it had before, as a comment on the discussion.
+func (p *Publisher) postChanges(discussion *liveDiscussion) error {
+	if p.dryRun {
+		p.logger.Info("[DRY RUN] Would post the changes since the last published revision to discussion #%s", p.discussionNumber)
+		return nil
+	}
+	from := publishedRevision(discussion.Body)
+	if from == "" {
+		p.logger.Info("No published revision found in discussion #%s; not posting changes", p.discussionNumber)
+		return nil
+	}
+	changes, err := p.describeChanges(from, p.commitRef)
+	if err != nil {
+		return err
+	}
+	if changes == "" {
+		p.logger.Info("The proposal has not changed since %s", from)
+		return nil
+	}
+	url, err := p.addDiscussionComment(discussion.ID, changes)
+	if err != nil {
+		return err
+	}
+	p.logger.Success("Posted the changes since %s: %s", from, url)
+	return nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+const changesOld = `# Aliases
+
+*   **Status**: Draft
+*   **Author(s)**: someone@
+
+Aliases for everything.
+
+## Objective
+
+Make it short.
+
+## Syntax
+
+` + "```" + `
+## not a section
+` + "```" + `
+
+## Open questions
+
+Many.
+`
+
+const changesNew = `# Postfix Aliases
+
+*   **Status**: Accepted
+*   **Author(s)**: someone@
+*   **Lifecycle**: Proposed
+
+Aliases for everything.
+
+## Objective
+
+Make it short.
+
+## Syntax
+
+` + "```" + `
+## still not a section
+` + "```" + `
+
+## Alternatives
+
+None.
+
+<!-- summary
+Approved.
+-->
+`
+
+// TestDiffRevisions tests comparing two revisions of a proposal by section
+// and metadata
+func TestDiffRevisions(t *testing.T) {
+	d := diffRevisions(changesOld, changesNew)
+	want := `- **Title**: Aliases → Postfix Aliases
+- **Status**: Draft → Accepted
+- **Lifecycle**: Proposed (new)
+- Added sections: Alternatives
+- Removed sections: Open questions
+- Changed sections: Syntax
+`
+	if got := d.markdown(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	if d := diffRevisions(changesOld, changesOld+"\n"); !d.empty() {
+		t.Errorf("Expected no changes, got:\n%s", d.markdown())
+	}
+	intro := strings.Replace(changesOld, "Aliases for everything.", "Aliases for some things.", 1)
+	if got := diffRevisions(changesOld, intro).markdown(); got != "- Changed the introduction\n" {
+		t.Errorf("Wrong changes to the introduction:\n%s", got)
+	}
+}
+
+// TestPublishedRevision tests finding the revision a discussion was last
+// updated with
+func TestPublishedRevision(t *testing.T) {
+	commit := "0123456789abcdef0123456789abcdef01234567"
+	for _, onMirror := range []bool{true, false} {
+		links := documentLinks("designs/language/4014-aliases.md", commit, onMirror, "https://review.gerrithub.io/c/cue-lang/proposal/+/1234")
+		body := "Notes\n" + managedBegin + "\n- **File**: " + links + "\n" + managedEnd
+		if got := publishedRevision(body); got != shortHash(commit) {
+			t.Errorf("publishedRevision(%q) = %q", links, got)
+		}
+	}
+	if got := publishedRevision("- **File**: [a.md](https://example.com) (latest)"); got != "" {
+		t.Errorf("Found a revision without one: %q", got)
+	}
+}
+
+// TestDescribeChanges tests describing the changes between two revisions
+// of a proposal, with and without a summarizer
+func TestDescribeChanges(t *testing.T) {
+	repo := NewTestRepo(t)
+	defer repo.Cleanup()
+
+	from := repo.createNumberedProposal("4014", "aliases", changesOld)
+	repo.writeFile("designs/language/4014-aliases.md", changesNew)
+	repo.run("git", "commit", "-am", "designs/language: update 4014")
+
+	oldDir, _ := os.Getwd()
+	os.Chdir(repo.dir)
+	defer os.Chdir(oldDir)
+
+	p := &Publisher{
+		logger:          NewLogger(),
+		commitRef:       "HEAD",
+		proposalFile:    "designs/language/4014-aliases.md",
+		newProposalFile: "designs/language/4014-aliases.md",
+	}
+	changes, err := p.describeChanges(shortHash(from), "HEAD")
+	if err != nil {
+		t.Fatalf("describeChanges failed: %v", err)
+	}
+	if !strings.HasPrefix(changes, "**Changes since "+shortHash(from)+":**\n\n- **Title**") ||
+		!strings.Contains(changes, "- Added sections: Alternatives\n") {
+		t.Errorf("Wrong changes:\n%s", changes)
+	}
+
+	fake := &fakeSummarizer{key: "fake"}
+	p.summarizer = fake
+	changes, err = p.describeChanges(from, "HEAD")
+	if err != nil {
+		t.Fatalf("describeChanges failed: %v", err)
+	}
+	if !strings.Contains(changes, ":**\n\nSummary 1 of Postfix Aliases\n\n- **Title**") {
+		t.Errorf("Summary of the changes missing:\n%s", changes)
+	}
+
+	if changes, err := p.describeChanges("HEAD", "HEAD"); err != nil || changes != "" {
+		t.Errorf("Expected no changes, got %q, %v", changes, err)
+	}
+	if _, err := p.describeChanges("0123456789ab", "HEAD"); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("Expected an error for an unknown revision, got: %v", err)
+	}
+}
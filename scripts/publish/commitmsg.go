@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// defaultCommitSubject is the subject of the commit of a draft once it is
+// numbered, unless publish.cfg sets commit-subject.
+const defaultCommitSubject = "{dir}: {number} {title}"
+
+// keepCommitSubject as the commit-subject setting leaves the subject alone.
+const keepCommitSubject = "keep"
+
+// discussionTrailer is the commit message trailer linking the discussion.
+const discussionTrailer = "Discussion"
+
+// commitSubject returns the subject for the commit of the proposal with the
+// given content, from the commit-subject pattern. It returns "" if the
+// subject is to be kept or the pattern cannot be filled in.
+func (p *Publisher) commitSubject(content string) string {
+	pattern := p.config.CommitSubject
+	switch pattern {
+	case keepCommitSubject:
+		return ""
+	case "":
+		pattern = defaultCommitSubject
+	}
+
+	file := p.newProposalFile
+	if file == "" {
+		file = p.proposalFile
+	}
+	complete := true
+	expand := func(placeholder, value string) {
+		if strings.Contains(pattern, placeholder) {
+			if value == "" {
+				complete = false
+			}
+			pattern = strings.ReplaceAll(pattern, placeholder, value)
+		}
+	}
+	expand("{dir}", path.Dir(file))
+	expand("{number}", p.discussionNumber)
+	expand("{title}", extractTitle(content))
+
+	if !complete {
+		return ""
+	}
+	return pattern
+}
+
+// setCommitSubject replaces the subject of a commit message, its first
+// paragraph, keeping the body and trailers.
+func setCommitSubject(message, subject string) string {
+	_, rest, ok := strings.Cut(strings.TrimLeft(message, "\n"), "\n\n")
+	if !ok {
+		return subject + "\n"
+	}
+	return subject + "\n\n" + rest
+}
+
+// setDiscussionTrailer adds a Discussion trailer with url to a commit
+// message, replacing any there is. git interpret-trailers puts it first in
+// the trailer block, so that trailers such as Signed-off-by and Change-Id
+// keep their order after it.
+func (p *Publisher) setDiscussionTrailer(message, url string) (string, error) {
+	out, stderr, err := p.runCommandInput(message, "git", "interpret-trailers", "--no-divider",
+		"--where", "start", "--if-exists", "replace", "--trailer", discussionTrailer+": "+url)
+	if err != nil {
+		return "", fmt.Errorf("failed to add %s trailer: %v (stderr: %s)", discussionTrailer, err, stderr)
+	}
+	return out, nil
+}
+
+// updateCommitMessage plans the changes to the message of the proposal
+// commit, for commitDocumentEdits: a draft gets the subject from the
+// commit-subject pattern, and every proposal whose commit is not published
+// yet a Discussion trailer. A published commit is not rewritten just for
+// the trailer, as checkRewritable would refuse to.
+func (p *Publisher) updateCommitMessage() error {
+	if p.isDraft {
+		content, err := p.readProposal()
+		if err != nil {
+			return err
+		}
+		if subject := p.commitSubject(content); subject != "" {
+			p.queueMessageEdit(fmt.Sprintf("set the commit subject to %q", subject), func(message string) (string, error) {
+				return setCommitSubject(message, subject), nil
+			})
+		}
+	}
+
+	if !p.isDraft {
+		commit := p.commitHashFull()
+		published, err := p.commitPublished(commit)
+		if err != nil {
+			p.logger.Warn("Could not check whether commit %s was published: %v", shortHash(commit), err)
+		}
+		if published != "" {
+			p.logger.Info("Not adding a %s trailer: commit %s %s", discussionTrailer, shortHash(commit), published)
+			return nil
+		}
+	}
+
+	p.queueMessageEdit(fmt.Sprintf("add a %s trailer", discussionTrailer), func(message string) (string, error) {
+		return p.setDiscussionTrailer(message, p.discussionURL)
+	})
+	return nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+// TestCommitSubject tests filling in the commit-subject pattern
+func TestCommitSubject(t *testing.T) {
+	content := "# Postfix Aliases\n\nText.\n"
+	tests := []struct {
+		name    string
+		pattern string
+		number  string
+		want    string
+	}{
+		{"Default", "", "4014", "designs/language: 4014 Postfix Aliases"},
+		{"Custom", "{dir}: add proposal {number}, {title}", "4014", "designs/language: add proposal 4014, Postfix Aliases"},
+		{"Keep", "keep", "4014", ""},
+		{"NoNumber", "", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Publisher{
+				config:           Config{CommitSubject: tt.pattern},
+				proposalFile:     "designs/language/xxxx-aliases.md",
+				newProposalFile:  "designs/language/4014-aliases.md",
+				discussionNumber: tt.number,
+			}
+			if got := p.commitSubject(content); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestSetCommitSubject tests replacing the subject of a commit message
+func TestSetCommitSubject(t *testing.T) {
+	tests := []struct {
+		message string
+		want    string
+	}{
+		{"designs: add xxxx proposal\n", "new\n"},
+		{"designs: add xxxx\nproposal\n\nBody.\n\nChange-Id: I1\n", "new\n\nBody.\n\nChange-Id: I1\n"},
+	}
+	for _, tt := range tests {
+		if got := setCommitSubject(tt.message, "new"); got != tt.want {
+			t.Errorf("setCommitSubject(%q) = %q, want %q", tt.message, got, tt.want)
+		}
+	}
+}
+
+// TestUpdateCommitMessage tests numbering the subject of a draft's commit
+// and adding a Discussion trailer before its other trailers
+func TestUpdateCommitMessage(t *testing.T) {
+	repo := NewTestRepo(t)
+	defer repo.Cleanup()
+
+	repo.writeFile("designs/language/xxxx-aliases.md", "# Aliases\n\n*   **Discussion Channel**: TBD\n")
+	repo.run("git", "add", "designs")
+	repo.run("git", "commit", "-m", "designs: add xxxx proposal\n\nAliases for everything.\n\nSigned-off-by: Test User <test@example.com>\nChange-Id: "+testChangeID)
+
+	oldDir, _ := os.Getwd()
+	os.Chdir(repo.dir)
+	defer os.Chdir(oldDir)
+
+	url := "https://github.com/cue-lang/cue/discussions/4014"
+	publisher := &Publisher{
+		logger:           NewLogger(),
+		commitRef:        "HEAD",
+		proposalFile:     "designs/language/xxxx-aliases.md",
+		basename:         "xxxx-aliases.md",
+		isDraft:          true,
+		discussionNumber: "4014",
+		discussionURL:    url,
+	}
+	if err := publisher.renameProposal(); err != nil {
+		t.Fatalf("renameProposal failed: %v", err)
+	}
+	if err := publisher.updateCommitMessage(); err != nil {
+		t.Fatalf("updateCommitMessage failed: %v", err)
+	}
+	if err := publisher.commitDocumentEdits(); err != nil {
+		t.Fatalf("commitDocumentEdits failed: %v", err)
+	}
+
+	want := "designs/language: 4014 Aliases\n\nAliases for everything.\n\n" +
+		"Discussion: " + url + "\n" +
+		"Signed-off-by: Test User <test@example.com>\n" +
+		"Change-Id: " + testChangeID + "\n"
+	if got := repo.run("git", "log", "-1", "--format=%B", "HEAD"); strings.TrimSpace(got) != strings.TrimSpace(want) {
+		t.Errorf("Wrong commit message:\n%s\nwant:\n%s", got, want)
+	}
+	if got := repo.run("git", "show", "HEAD:designs/language/4014-aliases.md"); !strings.Contains(got, url) {
+		t.Errorf("Document not updated in the same commit:\n%s", got)
+	}
+
+	// Once numbered, the trailer is kept and nothing is rewritten again.
+	head := repo.getCommitHash()
+	numbered := &Publisher{
+		logger:           NewLogger(),
+		commitRef:        "HEAD",
+		proposalFile:     "designs/language/4014-aliases.md",
+		basename:         "4014-aliases.md",
+		isNumbered:       true,
+		discussionNumber: "4014",
+		discussionURL:    url,
+	}
+	if err := numbered.renameProposal(); err != nil {
+		t.Fatalf("renameProposal failed: %v", err)
+	}
+	if err := numbered.updateCommitMessage(); err != nil {
+		t.Fatalf("updateCommitMessage failed: %v", err)
+	}
+	if err := numbered.commitDocumentEdits(); err != nil {
+		t.Fatalf("commitDocumentEdits failed: %v", err)
+	}
+	if repo.getCommitHash() != head {
+		t.Errorf("Commit rewritten again:\n%s", repo.run("git", "log", "-1", "--format=%B"))
+	}
+}
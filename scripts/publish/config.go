@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// configFile is the name of the per-repository configuration file, looked up
+// at the root of the repository. It uses the same "key: value" format as
+// codereview.cfg.
+const configFile = "publish.cfg"
+
+// Config holds per-repository settings for the publish tool.
+//
+// The zero value is valid and selects the default behaviour for every
+// setting.
+type Config struct {
+	// TitlePrefix is prepended to the proposal's "# " heading to form the
+	// discussion title. It may contain the placeholders {number}, {status}
+	// and {lifecycle}, which are expanded from the discussion number and the
+	// document's metadata. If any placeholder expands to an empty string
+	// the prefix is omitted altogether.
+	TitlePrefix string
+
+	// Labels are the labels every proposal discussion is expected to
+	// carry. They are given as a comma-separated list.
+	Labels []string
+
+	// Review is the review backend proposals are submitted to: "gerrit"
+	// (the default) or "github" for a pull request.
+	Review string
+
+	// PushRemote is the git remote the branch of a pull request is pushed
+	// to, for contributors who work from a fork. It defaults to origin.
+	PushRemote string
+
+	// CommitSubject is the pattern for the subject of the commit of a draft
+	// once it is numbered. It may contain the placeholders {dir}, {number}
+	// and {title}: the directory of the proposal, the discussion number and
+	// the document's "# " heading. It defaults to defaultCommitSubject;
+	// "keep" leaves the subject as the author wrote it.
+	CommitSubject string
+
+	// SummaryCommand is the command that generates the summary posted to
+	// the discussion, given the prompt on its standard input. It is given
+	// as space-separated arguments and defaults to defaultSummaryCommand.
+	SummaryCommand []string
+
+	// SummaryPrompt is the file holding the prompt template for the
+	// SummaryCommand, relative to the repository root. In the template
+	// {proposal} stands for the text of the proposal and {title} for its
+	// "# " heading. It defaults to defaultSummaryPrompt.
+	SummaryPrompt string
+
+	// Timeouts override the timeouts of the steps of the workflow, by step
+	// name; see defaultStepTimeouts. They are given as a comma-separated
+	// list of step=duration pairs, and a duration of 0 removes the limit.
+	Timeouts map[string]time.Duration
+}
+
+// loadConfig reads the configuration file from the repository rooted at dir.
+// A missing file is not an error and yields the default configuration.
+func loadConfig(dir string) (Config, error) {
+	var cfg Config
+
+	f, err := os.Open(filepath.Join(dir, configFile))
+	if os.IsNotExist(err) {
+		return cfg, nil
+	}
+	if err != nil {
+		return cfg, fmt.Errorf("failed to open %s: %v", configFile, err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return cfg, fmt.Errorf("%s:%d: expected \"key: value\", got %q", configFile, lineno, line)
+		}
+		key = strings.TrimSpace(key)
+		value = unquoteConfigValue(strings.TrimSpace(value))
+
+		switch key {
+		case "title-prefix":
+			cfg.TitlePrefix = value
+		case "labels":
+			cfg.Labels = nil
+			for _, label := range strings.Split(value, ",") {
+				if label = strings.TrimSpace(label); label != "" {
+					cfg.Labels = append(cfg.Labels, label)
+				}
+			}
+		case "review":
+			if value != backendGerrit && value != backendGitHub {
+				return cfg, fmt.Errorf("%s:%d: review must be %s or %s, got %q", configFile, lineno, backendGerrit, backendGitHub, value)
+			}
+			cfg.Review = value
+		case "push-remote":
+			cfg.PushRemote = value
+		case "commit-subject":
+			cfg.CommitSubject = value
+		case "summary-command":
+			cfg.SummaryCommand = strings.Fields(value)
+		case "summary-prompt":
+			if value != "" && !filepath.IsAbs(value) {
+				value = filepath.Join(dir, value)
+			}
+			cfg.SummaryPrompt = value
+		case "timeouts":
+			timeouts, err := parseTimeouts(value)
+			if err != nil {
+				return cfg, fmt.Errorf("%s:%d: %v", configFile, lineno, err)
+			}
+			cfg.Timeouts = timeouts
+		default:
+			return cfg, fmt.Errorf("%s:%d: unknown key %q", configFile, lineno, key)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return cfg, fmt.Errorf("failed to read %s: %v", configFile, err)
+	}
+
+	return cfg, nil
+}
+
+// unquoteConfigValue strips a single pair of surrounding double quotes, which
+// allows values with significant leading or trailing whitespace.
+func unquoteConfigValue(value string) string {
+	if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+		return value[1 : len(value)-1]
+	}
+	return value
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestLoadConfig tests parsing of the per-repository configuration file
+func TestLoadConfig(t *testing.T) {
+	t.Run("MissingFile", func(t *testing.T) {
+		cfg, err := loadConfig(t.TempDir())
+		if err != nil {
+			t.Fatalf("Missing config file should not be an error: %v", err)
+		}
+		if cfg.TitlePrefix != "" || cfg.Labels != nil {
+			t.Errorf("Expected default config, got %+v", cfg)
+		}
+	})
+
+	t.Run("TitlePrefix", func(t *testing.T) {
+		dir := t.TempDir()
+		content := "# Settings for scripts/publish\n\ntitle-prefix: \"#{number}: \"\n"
+		if err := os.WriteFile(filepath.Join(dir, configFile), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		cfg, err := loadConfig(dir)
+		if err != nil {
+			t.Fatalf("Failed to load config: %v", err)
+		}
+		if cfg.TitlePrefix != "#{number}: " {
+			t.Errorf("Wrong title prefix: %q", cfg.TitlePrefix)
+		}
+	})
+
+	t.Run("Labels", func(t *testing.T) {
+		dir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(dir, configFile), []byte("labels: Proposal, language ,\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		cfg, err := loadConfig(dir)
+		if err != nil {
+			t.Fatalf("Failed to load config: %v", err)
+		}
+		if strings.Join(cfg.Labels, "|") != "Proposal|language" {
+			t.Errorf("Wrong labels: %q", cfg.Labels)
+		}
+	})
+
+	t.Run("Review", func(t *testing.T) {
+		dir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(dir, configFile), []byte("review: github\npush-remote: fork\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		cfg, err := loadConfig(dir)
+		if err != nil {
+			t.Fatalf("Failed to load config: %v", err)
+		}
+		if cfg.Review != backendGitHub || cfg.PushRemote != "fork" {
+			t.Errorf("Wrong review settings: %+v", cfg)
+		}
+
+		if err := os.WriteFile(filepath.Join(dir, configFile), []byte("review: phabricator\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadConfig(dir); err == nil || !strings.Contains(err.Error(), "review must be") {
+			t.Errorf("Expected invalid review backend error, got: %v", err)
+		}
+	})
+
+	t.Run("CommitSubject", func(t *testing.T) {
+		dir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(dir, configFile), []byte("commit-subject: {dir}: add proposal {number}, {title}\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		cfg, err := loadConfig(dir)
+		if err != nil {
+			t.Fatalf("Failed to load config: %v", err)
+		}
+		if cfg.CommitSubject != "{dir}: add proposal {number}, {title}" {
+			t.Errorf("Wrong commit subject: %q", cfg.CommitSubject)
+		}
+	})
+
+	t.Run("Summary", func(t *testing.T) {
+		dir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(dir, configFile), []byte("summary-command: llm -m  gpt-4o\nsummary-prompt: scripts/summary.txt\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		cfg, err := loadConfig(dir)
+		if err != nil {
+			t.Fatalf("Failed to load config: %v", err)
+		}
+		if strings.Join(cfg.SummaryCommand, ",") != "llm,-m,gpt-4o" {
+			t.Errorf("Wrong summary command: %q", cfg.SummaryCommand)
+		}
+		if want := filepath.Join(dir, "scripts/summary.txt"); cfg.SummaryPrompt != want {
+			t.Errorf("Wrong summary prompt: %q, want %q", cfg.SummaryPrompt, want)
+		}
+	})
+
+	t.Run("Timeouts", func(t *testing.T) {
+		dir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(dir, configFile), []byte("timeouts: tests=15m, submit=0\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		cfg, err := loadConfig(dir)
+		if err != nil {
+			t.Fatalf("Failed to load config: %v", err)
+		}
+		if cfg.Timeouts[stepTests] != 15*time.Minute || len(cfg.Timeouts) != 2 {
+			t.Errorf("Wrong timeouts: %v", cfg.Timeouts)
+		}
+
+		if err := os.WriteFile(filepath.Join(dir, configFile), []byte("timeouts: mail=1m\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadConfig(dir); err == nil || !strings.Contains(err.Error(), `publish.cfg:1: unknown step "mail"`) {
+			t.Errorf("Expected unknown step error, got: %v", err)
+		}
+	})
+
+	t.Run("UnknownKey", func(t *testing.T) {
+		dir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(dir, configFile), []byte("colour: blue\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err := loadConfig(dir)
+		if err == nil || !strings.Contains(err.Error(), `unknown key "colour"`) {
+			t.Errorf("Expected unknown key error, got: %v", err)
+		}
+	})
+
+	t.Run("MalformedLine", func(t *testing.T) {
+		dir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(dir, configFile), []byte("title-prefix\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err := loadConfig(dir)
+		if err == nil || !strings.Contains(err.Error(), "publish.cfg:1") {
+			t.Errorf("Expected error with line number, got: %v", err)
+		}
+	})
+}
@@ -0,0 +1,60 @@
+package main
+
+import "testing"
+
+// TestUnifiedDiff tests the line-based unified diff
+func TestUnifiedDiff(t *testing.T) {
+	t.Run("Equal", func(t *testing.T) {
+		if got := unifiedDiff("a", "b", "x\ny\n", "x\ny\n"); got != "" {
+			t.Errorf("Expected no diff, got:\n%s", got)
+		}
+	})
+
+	t.Run("Change", func(t *testing.T) {
+		a := "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n"
+		b := "1\n2\n3\n4\nfive\n6\n7\n8\n9\n10\n"
+		want := `--- a
++++ b
+@@ -2,7 +2,7 @@
+ 2
+ 3
+ 4
+-5
++five
+ 6
+ 7
+ 8
+`
+		if got := unifiedDiff("a", "b", a, b); got != want {
+			t.Errorf("got:\n%s\nwant:\n%s", got, want)
+		}
+	})
+
+	t.Run("SeparateHunks", func(t *testing.T) {
+		a := "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n"
+		b := "0\n1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n"
+		want := `--- a
++++ b
+@@ -1,3 +1,4 @@
++0
+ 1
+ 2
+ 3
+@@ -9,4 +10,3 @@
+ 9
+ 10
+ 11
+-12
+`
+		if got := unifiedDiff("a", "b", a, b); got != want {
+			t.Errorf("got:\n%s\nwant:\n%s", got, want)
+		}
+	})
+
+	t.Run("FromEmpty", func(t *testing.T) {
+		want := "--- a\n+++ b\n@@ -0,0 +1,2 @@\n+x\n+y\n"
+		if got := unifiedDiff("a", "b", "", "x\ny"); got != want {
+			t.Errorf("got:\n%s\nwant:\n%s", got, want)
+		}
+	})
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// documentEdit is a change to the text of the proposal, made in memory.
+// The edits of a publish are queued while the workflow decides on them and
+// committed together by commitDocumentEdits.
+type documentEdit struct {
+	name  string // what the edit does, for the log
+	apply func(content string) (string, error)
+}
+
+// queueEdit queues an edit of the proposal text for commitDocumentEdits.
+func (p *Publisher) queueEdit(name string, apply func(content string) (string, error)) {
+	p.edits = append(p.edits, documentEdit{name: name, apply: apply})
+}
+
+// queueMessageEdit queues an edit of the message of the proposal commit for
+// commitDocumentEdits.
+func (p *Publisher) queueMessageEdit(name string, apply func(message string) (string, error)) {
+	p.messageEdits = append(p.messageEdits, documentEdit{name: name, apply: apply})
+}
+
+// composeEdits applies the edits to content in order. It returns the
+// result and the names of the edits that changed anything.
+func composeEdits(content string, edits []documentEdit) (string, []string, error) {
+	var changed []string
+	for _, e := range edits {
+		updated, err := e.apply(content)
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to %s: %v", e.name, err)
+		}
+		if updated != content {
+			changed = append(changed, e.name)
+		}
+		content = updated
+	}
+	return content, changed, nil
+}
+
+// readProposal returns the text of the proposal in the commit being
+// published.
+func (p *Publisher) readProposal() (string, error) {
+	content, _, err := p.runCommand("git", "show", fmt.Sprintf("%s:%s", p.commitRef, p.proposalFile))
+	if err != nil {
+		return "", fmt.Errorf("failed to read proposal file from commit: %v", err)
+	}
+	return content, nil
+}
+
+// commitDocumentEdits renames the proposal to newProposalFile, if that
+// differs, and applies the queued edits to its text and to the commit
+// message, all in a single rewrite of the commit being published. The
+// commits after it get the same edits to the document. Afterwards
+// commitRef and commitHash are the full hash of the new commit, unless
+// commitRef is HEAD. In dry-run mode the changes are shown as a diff
+// instead.
+func (p *Publisher) commitDocumentEdits() error {
+	edits, messageEdits := p.edits, p.messageEdits
+	p.edits, p.messageEdits = nil, nil
+
+	newFile := p.newProposalFile
+	if newFile == "" {
+		newFile = p.proposalFile
+	}
+	rename := newFile != p.proposalFile
+	if len(edits) == 0 && len(messageEdits) == 0 && !rename {
+		return nil
+	}
+
+	content, err := p.readProposal()
+	if err != nil {
+		return err
+	}
+	updated, changed, err := composeEdits(content, edits)
+	if err != nil {
+		return err
+	}
+	raw, _, err := p.runCommand("git", "cat-file", "commit", p.commitHashFull())
+	if err != nil {
+		return fmt.Errorf("failed to get commit message: %v", err)
+	}
+	_, message, _ := strings.Cut(raw, "\n\n")
+	newMessage, changedMessage, err := composeEdits(message, messageEdits)
+	if err != nil {
+		return err
+	}
+	if updated == content && newMessage == message && !rename {
+		p.logger.Info("The proposal document and commit message need no changes")
+		return nil
+	}
+
+	var changes []string
+	if rename {
+		changes = append(changes, fmt.Sprintf("rename %s to %s", p.proposalFile, newFile))
+	}
+	changes = append(changes, changed...)
+	changes = append(changes, changedMessage...)
+
+	if p.dryRun {
+		p.logger.Info("[DRY RUN] Would rewrite commit %s once to %s", shortHash(p.commitHashFull()), strings.Join(changes, ", "))
+		if diff := unifiedDiff("a/"+p.proposalFile, "b/"+newFile, content, updated); diff != "" {
+			p.logger.Info("[DRY RUN] Changes to the proposal:\n%s", diff)
+		}
+		if newMessage != message {
+			p.logger.Info("[DRY RUN] New commit message:\n%s", newMessage)
+		}
+		return nil
+	}
+
+	if p.commitRef != "HEAD" {
+		p.logger.Warn("Rewriting historical commit %s", shortHash(p.commitHashFull()))
+	}
+
+	reason := "publish: update proposal"
+	if rename {
+		reason = "publish: rename proposal"
+	}
+	edit := fileEdit{
+		path:    p.proposalFile,
+		newPath: newFile,
+		edit: func(content string) (string, error) {
+			updated, _, err := composeEdits(content, edits)
+			return updated, err
+		},
+	}
+	var setMessage func(string) (string, error)
+	if newMessage != message {
+		setMessage = func(string) (string, error) { return newMessage, nil }
+	}
+	if err := p.rewriteProposal([]fileEdit{edit}, setMessage, reason); err != nil {
+		return fmt.Errorf("failed to update proposal: %v", err)
+	}
+
+	p.logger.Success("Rewrote the proposal commit as %s to %s", shortHash(p.commitHashFull()), strings.Join(changes, ", "))
+	return nil
+}
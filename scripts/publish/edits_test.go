@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+// TestComposeEdits tests applying edits in order
+func TestComposeEdits(t *testing.T) {
+	edits := []documentEdit{
+		{name: "replace TBD", apply: func(c string) (string, error) { return strings.ReplaceAll(c, "TBD", "#4014"), nil }},
+		{name: "do nothing", apply: func(c string) (string, error) { return c, nil }},
+		{name: "link", apply: func(c string) (string, error) { return strings.ReplaceAll(c, "#4014", "[#4014](url)"), nil }},
+	}
+	got, changed, err := composeEdits("Discussion: TBD\n", edits)
+	if err != nil {
+		t.Fatalf("composeEdits failed: %v", err)
+	}
+	if got != "Discussion: [#4014](url)\n" {
+		t.Errorf("Wrong result: %q", got)
+	}
+	if strings.Join(changed, ",") != "replace TBD,link" {
+		t.Errorf("Wrong changed edits: %v", changed)
+	}
+
+	failing := documentEdit{name: "fail", apply: func(c string) (string, error) { return "", errors.New("boom") }}
+	if _, _, err := composeEdits("x", []documentEdit{failing}); err == nil || !strings.Contains(err.Error(), "failed to fail: boom") {
+		t.Errorf("Expected edit error, got: %v", err)
+	}
+}
+
+// TestCommitDocumentEdits tests that a draft is renamed, linked and has its
+// references updated in a single rewrite of its commit
+func TestCommitDocumentEdits(t *testing.T) {
+	repo := NewTestRepo(t)
+	defer repo.Cleanup()
+
+	base := repo.getCommitHash()
+	proposal := repo.createDraftProposal("aliases", "# Aliases\n\n*   **Author(s)**: test@\n*   **Discussion Channel**: TBD\n\nTracking issue: TBD\n")
+
+	oldDir, _ := os.Getwd()
+	os.Chdir(repo.dir)
+	defer os.Chdir(oldDir)
+
+	publisher := &Publisher{
+		logger:           NewLogger(),
+		commitRef:        proposal,
+		commitHash:       proposal,
+		proposalFile:     "designs/language/xxxx-aliases.md",
+		basename:         "xxxx-aliases.md",
+		isDraft:          true,
+		discussionNumber: "4014",
+		discussionURL:    "https://github.com/cue-lang/cue/discussions/4014",
+	}
+	plan := func() {
+		t.Helper()
+		if err := publisher.renameProposal(); err != nil {
+			t.Fatalf("renameProposal failed: %v", err)
+		}
+		if err := publisher.updateDocumentReferences(); err != nil {
+			t.Fatalf("updateDocumentReferences failed: %v", err)
+		}
+	}
+
+	// A dry run previews the changes without making them.
+	publisher.dryRun = true
+	plan()
+	if err := publisher.commitDocumentEdits(); err != nil {
+		t.Fatalf("commitDocumentEdits failed: %v", err)
+	}
+	if repo.getCommitHash() != proposal || publisher.commitRef != proposal {
+		t.Fatal("Dry run rewrote the commit")
+	}
+	if len(publisher.edits) != 0 {
+		t.Error("Edits still queued after commitDocumentEdits")
+	}
+
+	publisher.dryRun = false
+	plan()
+	if err := publisher.commitDocumentEdits(); err != nil {
+		t.Fatalf("commitDocumentEdits failed: %v", err)
+	}
+
+	head := repo.getCommitHash()
+	if head == proposal {
+		t.Fatal("Commit not rewritten")
+	}
+	if publisher.commitRef != head || publisher.commitHash != head {
+		t.Errorf("Not following the full new hash: commitRef %s, commitHash %s, HEAD %s", publisher.commitRef, publisher.commitHash, head)
+	}
+	if parent := strings.TrimSpace(repo.run("git", "rev-parse", "HEAD^")); parent != base {
+		t.Errorf("Rewritten commit has parent %s, want %s", parent, base)
+	}
+	if got := repo.run("git", "reflog", "--format=%gs", "HEAD"); strings.Count(got, "publish:") != 1 {
+		t.Errorf("Expected a single rewrite, reflog:\n%s", got)
+	}
+
+	want := "# Aliases\n\n*   **Author(s)**: test@\n*   **Discussion Channel**: https://github.com/cue-lang/cue/discussions/4014\n\nDiscussion: https://github.com/cue-lang/cue/discussions/4014\n"
+	if got := repo.run("git", "show", "HEAD:designs/language/4014-aliases.md"); got != want {
+		t.Errorf("Wrong proposal:\n%s", got)
+	}
+	if files := repo.run("git", "ls-tree", "-r", "--name-only", "HEAD", "designs"); files != "designs/language/4014-aliases.md\n" {
+		t.Errorf("Wrong files:\n%s", files)
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// waitOptions controls how long and how often the review backend is polled
+// while waiting for a review to be submitted.
+type waitOptions struct {
+	interval time.Duration // time between polls
+	timeout  time.Duration // give up after this long; zero waits indefinitely
+}
+
+// defaultPollInterval is the default time between review polls. Reviews take
+// hours to days, so there is no point in polling more often.
+const defaultPollInterval = time.Minute
+
+// waitForReview polls the review backend until the review of the commit
+// being published is merged or abandoned, and returns its final state. It
+// stops early if ctx is cancelled or the timeout expires.
+func (p *Publisher) waitForReview(ctx context.Context, opts waitOptions) (*reviewState, error) {
+	if opts.interval <= 0 {
+		opts.interval = defaultPollInterval
+	}
+	if opts.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.timeout)
+		defer cancel()
+	}
+
+	backend := p.reviewBackend()
+	lastStatus := ""
+	for {
+		state, err := backend.lookup()
+		if err != nil {
+			return nil, err
+		}
+		switch state.status {
+		case reviewMerged, reviewAbandoned:
+			return state, nil
+		}
+		if state.status != lastStatus {
+			p.logger.Info("%s is %s; waiting for it to be merged or abandoned (polling every %v)...",
+				backend.ref(state.number), state.status, opts.interval)
+			lastStatus = state.status
+		}
+
+		select {
+		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded {
+				return nil, fmt.Errorf("timed out after %v waiting for %s", opts.timeout, backend.ref(p.clNumber))
+			}
+			return nil, fmt.Errorf("stopped waiting for %s: %v", backend.ref(p.clNumber), ctx.Err())
+		case <-time.After(opts.interval):
+		}
+	}
+}
+
+// finalize waits for the review to be submitted and then regenerates the
+// discussion with the final state of the proposal: the review link, its
+// merged or abandoned status and links pinned to the merged commit.
+func (p *Publisher) finalize(ctx context.Context, opts waitOptions) error {
+	p.ctx = ctx
+	p.logger.Info("Step 6: Waiting for review approval and submission...")
+
+	backend := p.reviewBackend()
+	if p.dryRun {
+		p.logger.Info("[DRY RUN] Would wait for %s to be merged or abandoned, then update discussion #%s",
+			backend.ref(p.clNumber), p.discussionNumber)
+		return nil
+	}
+
+	state, err := p.waitForReview(ctx, opts)
+	if err != nil {
+		return err
+	}
+
+	p.clStatus = state.status
+	p.clRevision = state.revision
+	if state.status == reviewMerged {
+		p.mergedCommit = state.mergedCommit
+		p.logger.Success("%s was merged as %s", backend.ref(p.clNumber), shortHash(p.mergedCommit))
+	} else {
+		p.logger.Warn("%s was abandoned", backend.ref(p.clNumber))
+	}
+
+	return p.step(stepUpdate, func() error {
+		return p.updateDiscussionContent(p.clNumber)
+	})
+}
+
+// interruptContext returns a context that is cancelled when the user
+// presses Ctrl-C or the process is sent SIGTERM, so that the workflow can
+// stop its commands and clean up. A second signal ends the process at once.
+func interruptContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case sig := <-signals:
+			NewLogger().Warn("Received %v; cleaning up, signal again to exit at once", sig)
+			cancel(fmt.Errorf("received %v", sig))
+		case <-ctx.Done():
+		}
+		signal.Stop(signals)
+	}()
+	return ctx, func() { cancel(context.Canceled) }
+}
+
+// runFinalize implements "publish finalize": for a proposal that has
+// already been published, it waits for its review to be submitted and then
+// updates the discussion.
+func runFinalize(args []string) error {
+	fs := flag.NewFlagSet("finalize", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "Show what would be done without making changes")
+	useAI := fs.Bool("use-ai", true, "Generate the summary with the summary-command, Claude by default")
+	fullText := fs.Bool("full-text", false, "Post the complete proposal text to the discussion instead of a summary")
+	interval := fs.Duration("poll-interval", defaultPollInterval, "Time between checks of the CL status")
+	timeout := fs.Duration("timeout", 0, "Give up waiting after this long (default: wait until interrupted)")
+	review := fs.String("review", "", "Review backend the proposal was submitted to: gerrit or github (default from publish.cfg)")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s finalize [--poll-interval d] [--timeout d] [commit-ref]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Wait for the CL or pull request of a published proposal to be merged or\n")
+		fmt.Fprintf(os.Stderr, "abandoned, then update its GitHub discussion with the final state.\n\n")
+		fmt.Fprintf(os.Stderr, "Arguments:\n")
+		fmt.Fprintf(os.Stderr, "  commit-ref   Commit that was mailed for review (default: HEAD)\n\n")
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	commitRef := "HEAD"
+	switch fs.NArg() {
+	case 0:
+	case 1:
+		commitRef = fs.Arg(0)
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	p := NewPublisher(commitRef, *dryRun, *useAI)
+	p.fullText = *fullText
+	if err := p.loadConfig(); err != nil {
+		return err
+	}
+	if *review == "" {
+		*review = p.config.Review
+	}
+	if err := p.setReviewBackend(*review); err != nil {
+		return err
+	}
+
+	if err := p.findProposalFile(); err != nil {
+		return err
+	}
+	if !p.isNumbered {
+		return fmt.Errorf("%s is a draft; publish it before finalizing", p.proposalFile)
+	}
+	p.newProposalFile = p.proposalFile
+
+	backend := p.reviewBackend()
+	state, err := backend.lookup()
+	if err != nil {
+		return err
+	}
+	p.logger.Info("Found %s (%s): %s", backend.ref(state.number), state.status, state.url)
+
+	ctx, stop := interruptContext()
+	defer stop()
+	return p.finalize(ctx, waitOptions{interval: *interval, timeout: *timeout})
+}
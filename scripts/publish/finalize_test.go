@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestWaitForReview tests polling Gerrit until a CL is submitted
+func TestWaitForReview(t *testing.T) {
+	gerrit := newFakeGerrit(t)
+	t.Setenv("NETRC", filepath.Join(t.TempDir(), "netrc"))
+
+	repo := newGerritTestRepo(t, gerrit)
+	defer repo.Cleanup()
+
+	oldDir, _ := os.Getwd()
+	os.Chdir(repo.dir)
+	defer os.Chdir(oldDir)
+
+	opts := waitOptions{interval: 10 * time.Millisecond, timeout: 5 * time.Second}
+
+	t.Run("Merged", func(t *testing.T) {
+		gerrit.addChange(testChangeID, 4321, 2, "NEW")
+		timer := time.AfterFunc(50*time.Millisecond, func() {
+			gerrit.addChange(testChangeID, 4321, 3, "MERGED")
+		})
+		defer timer.Stop()
+
+		publisher := &Publisher{logger: NewLogger(), commitRef: "HEAD"}
+		state, err := publisher.waitForReview(context.Background(), opts)
+		if err != nil {
+			t.Fatalf("waitForReview failed: %v", err)
+		}
+		if state.status != reviewMerged || state.revision != 3 || state.mergedCommit == "" {
+			t.Errorf("Wrong final state: %+v", state)
+		}
+		if publisher.clNumber != "4321" {
+			t.Errorf("Wrong CL number: %s", publisher.clNumber)
+		}
+	})
+
+	t.Run("Abandoned", func(t *testing.T) {
+		gerrit.addChange(testChangeID, 4321, 2, "ABANDONED")
+
+		publisher := &Publisher{logger: NewLogger(), commitRef: "HEAD"}
+		state, err := publisher.waitForReview(context.Background(), opts)
+		if err != nil {
+			t.Fatalf("waitForReview failed: %v", err)
+		}
+		if state.status != reviewAbandoned {
+			t.Errorf("Wrong final state: %+v", state)
+		}
+	})
+
+	t.Run("Timeout", func(t *testing.T) {
+		gerrit.addChange(testChangeID, 4321, 2, "NEW")
+
+		publisher := &Publisher{logger: NewLogger(), commitRef: "HEAD"}
+		_, err := publisher.waitForReview(context.Background(), waitOptions{interval: 10 * time.Millisecond, timeout: 50 * time.Millisecond})
+		if err == nil || !strings.Contains(err.Error(), "timed out") {
+			t.Errorf("Expected timeout, got: %v", err)
+		}
+	})
+
+	t.Run("Cancelled", func(t *testing.T) {
+		gerrit.addChange(testChangeID, 4321, 2, "NEW")
+
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(50*time.Millisecond, cancel)
+
+		publisher := &Publisher{logger: NewLogger(), commitRef: "HEAD"}
+		_, err := publisher.waitForReview(ctx, opts)
+		if err == nil || !strings.Contains(err.Error(), "stopped waiting") {
+			t.Errorf("Expected cancellation, got: %v", err)
+		}
+	})
+}
+
+// TestFinalStatus tests the status shown in the discussion once the CL has
+// been submitted
+func TestFinalStatus(t *testing.T) {
+	repo := NewTestRepo(t)
+	defer repo.Cleanup()
+
+	commit := repo.createNumberedProposal("4014", "aliases", "# Aliases\n\n## Summary\n\nAliases for everything.\n")
+
+	oldDir, _ := os.Getwd()
+	os.Chdir(repo.dir)
+	defer os.Chdir(oldDir)
+
+	merged := strings.Repeat("f", 40)
+	publisher := &Publisher{
+		logger:          NewLogger(),
+		commitRef:       commit,
+		dryRun:          true,
+		isNumbered:      true,
+		newProposalFile: "designs/language/4014-aliases.md",
+		clURL:           "https://cue.gerrithub.io/c/cue-lang/proposal/+/4321",
+		clStatus:        "MERGED",
+		mergedCommit:    merged,
+	}
+	generated, err := publisher.generateDiscussionContent("4321", "", false)
+	if err != nil {
+		t.Fatalf("generateDiscussionContent failed: %v", err)
+	}
+	if !strings.Contains(generated.body, "- **Status**: Merged ✅") {
+		t.Errorf("Missing merged status:\n%s", generated.body)
+	}
+	if !strings.Contains(generated.body, "[CL 4321](https://cue.gerrithub.io/c/cue-lang/proposal/+/4321)") {
+		t.Errorf("Missing CL link:\n%s", generated.body)
+	}
+	if !strings.Contains(generated.body, proposalRepoURL+"/blob/"+merged+"/designs/language/4014-aliases.md") {
+		t.Errorf("Missing link pinned to merged commit:\n%s", generated.body)
+	}
+}
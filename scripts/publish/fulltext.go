@@ -0,0 +1,497 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// discussionBodyLimit is the maximum size GitHub accepts for the body of a
+// discussion or discussion comment. We stay a little below it, as the limit
+// is applied after GitHub's own normalization of the text.
+const discussionBodyLimit = 65536 - 1024
+
+// fullTextPlaceholder stands in for the proposal text in the discussion
+// body until the text has been laid out.
+const fullTextPlaceholder = "<!-- proposal-publish: full text -->"
+
+// fullTextMarkerPattern identifies the discussion comments holding the
+// continuation of the proposal text, so they can be updated in place when
+// the proposal is republished.
+var fullTextMarkerPattern = regexp.MustCompile(`<!-- proposal-publish: part (\d+) of (\d+) -->`)
+
+// docSection is a top-level ("## ") section of a proposal document.
+type docSection struct {
+	title  string // heading text; empty for the text before the first heading
+	anchor string // GitHub anchor for the heading
+	text   string // the section text including its heading line
+}
+
+// fullTextPart is the part of the proposal text posted in one place: the
+// first part goes in the discussion body, subsequent ones in comments.
+type fullTextPart struct {
+	sections []docSection
+}
+
+func (fp fullTextPart) text() string {
+	var b strings.Builder
+	for _, s := range fp.sections {
+		b.WriteString(s.text)
+	}
+	return b.String()
+}
+
+// splitSections splits a Markdown document at its "## " headings, ignoring
+// anything that looks like a heading inside fenced code blocks.
+func splitSections(content string) []docSection {
+	var sections []docSection
+	current := docSection{}
+	var b strings.Builder
+	inFence := false
+
+	flush := func() {
+		current.text = b.String()
+		if current.text != "" {
+			sections = append(sections, current)
+		}
+		b.Reset()
+	}
+
+	for _, line := range strings.SplitAfter(content, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~") {
+			inFence = !inFence
+		}
+		if !inFence && strings.HasPrefix(line, "## ") {
+			flush()
+			title := strings.TrimSpace(strings.TrimPrefix(line, "## "))
+			current = docSection{title: title, anchor: headingAnchor(title)}
+		}
+		b.WriteString(line)
+	}
+	flush()
+
+	return sections
+}
+
+// headingAnchor returns the anchor GitHub generates for a heading.
+func headingAnchor(title string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(title) {
+		switch {
+		case r == ' ' || r == '-':
+			b.WriteRune('-')
+		case r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r):
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// splitOversized splits a section that does not fit in limit bytes into
+// several pieces, preferring to split at subsection headings, then at
+// paragraph boundaries outside code blocks, then at line boundaries. The
+// first piece keeps the section's title so it can be found from the table
+// of contents; the others are untitled continuations.
+func splitOversized(s docSection, limit int) []docSection {
+	if len(s.text) <= limit {
+		return []docSection{s}
+	}
+
+	// Collect blocks: paragraphs separated by blank lines outside fences.
+	var blocks []string
+	var b strings.Builder
+	inFence := false
+	for _, line := range strings.SplitAfter(s.text, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~") {
+			inFence = !inFence
+		}
+		b.WriteString(line)
+		if !inFence && trimmed == "" {
+			blocks = append(blocks, b.String())
+			b.Reset()
+		}
+	}
+	if b.Len() > 0 {
+		blocks = append(blocks, b.String())
+	}
+
+	// Blocks that are too large on their own are split by lines, and
+	// lines that are too large are cut.
+	var units []string
+	for _, block := range blocks {
+		if len(block) <= limit {
+			units = append(units, block)
+			continue
+		}
+		for _, line := range strings.SplitAfter(block, "\n") {
+			for len(line) > limit {
+				cut := limit
+				for cut > 0 && !utf8.RuneStart(line[cut]) {
+					cut--
+				}
+				units = append(units, line[:cut])
+				line = line[cut:]
+			}
+			if line != "" {
+				units = append(units, line)
+			}
+		}
+	}
+
+	var pieces []docSection
+	var piece strings.Builder
+	emit := func() {
+		if piece.Len() == 0 {
+			return
+		}
+		p := docSection{text: piece.String()}
+		if len(pieces) == 0 {
+			p.title, p.anchor = s.title, s.anchor
+		}
+		pieces = append(pieces, p)
+		piece.Reset()
+	}
+	for _, unit := range units {
+		startsSubsection := strings.HasPrefix(unit, "### ")
+		if piece.Len()+len(unit) > limit || (startsSubsection && piece.Len() > limit/2) {
+			emit()
+		}
+		piece.WriteString(unit)
+	}
+	emit()
+
+	return pieces
+}
+
+// packParts distributes the sections of a document over parts of at most
+// limit bytes each. The first part has firstLimit bytes available, as it
+// shares the discussion body with the header and table of contents.
+// Sections are never split unless they are larger than a whole part.
+func packParts(sections []docSection, firstLimit, limit int) []fullTextPart {
+	var parts []fullTextPart
+	var current fullTextPart
+	size := 0
+	available := firstLimit
+
+	for _, s := range sections {
+		pieces := splitOversized(s, limit)
+		for _, piece := range pieces {
+			if size+len(piece.text) > available && (size > 0 || len(parts) == 0) {
+				parts = append(parts, current)
+				current = fullTextPart{}
+				size = 0
+				available = limit
+			}
+			current.sections = append(current.sections, piece)
+			size += len(piece.text)
+		}
+	}
+	if len(current.sections) > 0 {
+		parts = append(parts, current)
+	}
+	return parts
+}
+
+// tableOfContents returns a Markdown list linking every titled section to
+// the place it was posted: an anchor in the body for the first part, the
+// comment URL for subsequent ones.
+func tableOfContents(parts []fullTextPart, commentURLs []string) string {
+	var b strings.Builder
+	b.WriteString("## Contents\n\n")
+	for i, part := range parts {
+		for _, s := range part.sections {
+			if s.title == "" {
+				continue
+			}
+			switch {
+			case i == 0:
+				fmt.Fprintf(&b, "- [%s](#%s)\n", s.title, s.anchor)
+			case i-1 < len(commentURLs) && commentURLs[i-1] != "":
+				fmt.Fprintf(&b, "- [%s](%s) (part %d)\n", s.title, commentURLs[i-1], i+1)
+			default:
+				fmt.Fprintf(&b, "- %s (part %d)\n", s.title, i+1)
+			}
+		}
+	}
+	return b.String()
+}
+
+// tocPlaceholderURL is used to estimate the size of the table of contents
+// before the comment URLs are known.
+const tocPlaceholderURL = "https://github.com/cue-lang/cue/discussions/00000#discussioncomment-00000000"
+
+// layoutFullText splits the proposal content into the text for the
+// discussion body and the continuation comments, given the size of the rest
+// of the body.
+func layoutFullText(content string, headerSize int) []fullTextPart {
+	sections := splitSections(content)
+
+	// Reserve room for a table of contents in which every section links
+	// to a comment; that is its largest possible size.
+	var toc strings.Builder
+	for _, s := range sections {
+		if s.title != "" {
+			fmt.Fprintf(&toc, "- [%s](%s) (part 00)\n", s.title, tocPlaceholderURL)
+		}
+	}
+	firstLimit := discussionBodyLimit - headerSize - toc.Len() - len("## Contents\n\n")
+	commentLimit := discussionBodyLimit - len(fullTextCommentHeader(99, 99))
+	if firstLimit < 0 {
+		firstLimit = 0
+	}
+	return packParts(sections, firstLimit, commentLimit)
+}
+
+// fullTextCommentHeader returns the marker and heading of a continuation
+// comment.
+func fullTextCommentHeader(part, total int) string {
+	return fmt.Sprintf("<!-- proposal-publish: part %d of %d -->\n**Proposal text, part %d of %d**\n\n---\n\n",
+		part, total, part, total)
+}
+
+// discussionComment is a comment on a GitHub discussion.
+type discussionComment struct {
+	ID              string `json:"id"`
+	URL             string `json:"url"`
+	Body            string `json:"body"`
+	ViewerDidAuthor bool   `json:"viewerDidAuthor"`
+}
+
+// discussionComments returns the top-level comments on the discussion.
+func (p *Publisher) discussionComments() ([]discussionComment, error) {
+	query := `
+	query($number: Int!) {
+		repository(owner: "cue-lang", name: "cue") {
+			discussion(number: $number) {
+				comments(first: 100) {
+					nodes {
+						id
+						url
+						body
+						viewerDidAuthor
+					}
+				}
+			}
+		}
+	}`
+
+	numberInt, err := strconv.Atoi(p.discussionNumber)
+	if err != nil {
+		return nil, fmt.Errorf("invalid discussion number: %v", err)
+	}
+
+	reqData := map[string]interface{}{
+		"query":     query,
+		"variables": map[string]interface{}{"number": numberInt},
+	}
+
+	data, err := p.callGitHubAPI("POST", "graphql", reqData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get discussion comments: %v", err)
+	}
+
+	var response struct {
+		Data struct {
+			Repository struct {
+				Discussion struct {
+					Comments struct {
+						Nodes []discussionComment `json:"nodes"`
+					} `json:"comments"`
+				} `json:"discussion"`
+			} `json:"repository"`
+		} `json:"data"`
+		Errors []interface{} `json:"errors"`
+	}
+
+	if err := json.Unmarshal(data, &response); err != nil {
+		return nil, fmt.Errorf("failed to parse discussion comments: %v", err)
+	}
+
+	if len(response.Errors) > 0 {
+		return nil, fmt.Errorf("GraphQL errors: %v", response.Errors)
+	}
+
+	return response.Data.Repository.Discussion.Comments.Nodes, nil
+}
+
+// fullTextComments returns the continuation comments previously posted by
+// us on the discussion, indexed by part number.
+func (p *Publisher) fullTextComments() (map[int]discussionComment, error) {
+	all, err := p.discussionComments()
+	if err != nil {
+		return nil, err
+	}
+
+	comments := make(map[int]discussionComment)
+	for _, c := range all {
+		if !c.ViewerDidAuthor {
+			continue
+		}
+		if m := fullTextMarkerPattern.FindStringSubmatch(c.Body); m != nil {
+			part, _ := strconv.Atoi(m[1])
+			comments[part] = c
+		}
+	}
+	return comments, nil
+}
+
+// publishFullTextComments posts parts 2 and onwards of the proposal text as
+// discussion comments, updating the comments of a previous publish in
+// place and deleting the ones no longer needed. It returns the comment URLs
+// in part order.
+func (p *Publisher) publishFullTextComments(discussionID string, parts []fullTextPart) ([]string, error) {
+	total := len(parts)
+
+	if p.dryRun {
+		for i, part := range parts[1:] {
+			p.logger.Info("[DRY RUN] Would post part %d of %d (%d bytes) as a discussion comment", i+2, total, len(part.text()))
+		}
+		return nil, nil
+	}
+
+	existing, err := p.fullTextComments()
+	if err != nil {
+		return nil, err
+	}
+
+	var urls []string
+	for i, part := range parts[1:] {
+		number := i + 2
+		body := fullTextCommentHeader(number, total) + part.text()
+
+		var url string
+		if c, ok := existing[number]; ok {
+			delete(existing, number)
+			if c.Body == body {
+				urls = append(urls, c.URL)
+				continue
+			}
+			url, err = p.updateDiscussionComment(c.ID, body)
+		} else {
+			url, err = p.addDiscussionComment(discussionID, body)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to post part %d of the proposal text: %v", number, err)
+		}
+		urls = append(urls, url)
+	}
+
+	// The proposal got shorter: remove parts that are no longer needed.
+	for number, c := range existing {
+		_, err := p.callGitHubAPI("POST", "graphql", map[string]interface{}{
+			"query": `
+	mutation($id: ID!) {
+		deleteDiscussionComment(input: {id: $id}) {
+			comment {
+				id
+			}
+		}
+	}`,
+			"variables": map[string]interface{}{"id": c.ID},
+		})
+		if err != nil {
+			p.logger.Warning("Could not delete obsolete part %d of the proposal text: %v", number, err)
+		}
+	}
+
+	p.logger.Success("Published proposal text in %d part(s)", total)
+	return urls, nil
+}
+
+// addDiscussionComment adds a comment to the discussion with the given node
+// ID and returns its URL.
+func (p *Publisher) addDiscussionComment(discussionID, body string) (string, error) {
+	return p.mutateDiscussionComment(`
+	mutation($discussionId: ID!, $body: String!) {
+		addDiscussionComment(input: {discussionId: $discussionId, body: $body}) {
+			comment {
+				url
+			}
+		}
+	}`, map[string]interface{}{"discussionId": discussionID, "body": body}, "addDiscussionComment")
+}
+
+// updateDiscussionComment replaces the body of a discussion comment and
+// returns its URL.
+func (p *Publisher) updateDiscussionComment(commentID, body string) (string, error) {
+	return p.mutateDiscussionComment(`
+	mutation($commentId: ID!, $body: String!) {
+		updateDiscussionComment(input: {commentId: $commentId, body: $body}) {
+			comment {
+				url
+			}
+		}
+	}`, map[string]interface{}{"commentId": commentID, "body": body}, "updateDiscussionComment")
+}
+
+// mutateDiscussionComment runs a mutation returning a discussion comment
+// under field and returns the comment's URL.
+func (p *Publisher) mutateDiscussionComment(mutation string, variables map[string]interface{}, field string) (string, error) {
+	data, err := p.callGitHubAPI("POST", "graphql", map[string]interface{}{
+		"query":     mutation,
+		"variables": variables,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	var response struct {
+		Data map[string]struct {
+			Comment struct {
+				URL string `json:"url"`
+			} `json:"comment"`
+		} `json:"data"`
+		Errors []interface{} `json:"errors"`
+	}
+	if err := json.Unmarshal(data, &response); err != nil {
+		return "", fmt.Errorf("failed to parse comment response: %v", err)
+	}
+	if len(response.Errors) > 0 {
+		return "", fmt.Errorf("GraphQL errors: %v", response.Errors)
+	}
+	return response.Data[field].Comment.URL, nil
+}
+
+// fullTextBody lays out the proposal text for the discussion and returns the
+// content for the discussion body: the table of contents followed by the
+// first part of the text. If publish is set, the continuation comments are
+// posted as well; otherwise the ones already on the discussion are linked.
+func (p *Publisher) fullTextBody(discussionID, content string, headerSize int, publish bool) (string, error) {
+	parts := layoutFullText(content, headerSize)
+	if len(parts) == 0 {
+		return "", nil
+	}
+
+	var urls []string
+	if publish {
+		if len(parts) > 1 {
+			p.logger.Info("Proposal text exceeds the discussion size limit; splitting into %d parts", len(parts))
+		}
+
+		var err error
+		urls, err = p.publishFullTextComments(discussionID, parts)
+		if err != nil {
+			return "", err
+		}
+		if p.dryRun && len(parts) > 1 {
+			fmt.Fprintf(os.Stderr, "Proposal text split into %d parts\n", len(parts))
+		}
+	} else if len(parts) > 1 {
+		existing, err := p.fullTextComments()
+		if err != nil {
+			return "", err
+		}
+		for number := 2; number <= len(parts); number++ {
+			urls = append(urls, existing[number].URL)
+		}
+	}
+
+	return tableOfContents(parts, urls) + "\n" + parts[0].text(), nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestSplitSections tests splitting a document at its top-level headings
+func TestSplitSections(t *testing.T) {
+	content := "# Title\n\nIntro.\n\n## Objective\n\nText.\n\n```\n## not a heading\n```\n\n## Detailed Design\n\nMore.\n"
+
+	sections := splitSections(content)
+	if len(sections) != 3 {
+		t.Fatalf("Expected 3 sections, got %d: %+v", len(sections), sections)
+	}
+
+	if sections[0].title != "" || !strings.HasPrefix(sections[0].text, "# Title") {
+		t.Errorf("Wrong preamble: %+v", sections[0])
+	}
+	if sections[1].title != "Objective" || !strings.Contains(sections[1].text, "## not a heading") {
+		t.Errorf("Wrong second section: %+v", sections[1])
+	}
+	if sections[2].anchor != "detailed-design" {
+		t.Errorf("Wrong anchor: %q", sections[2].anchor)
+	}
+
+	var joined strings.Builder
+	for _, s := range sections {
+		joined.WriteString(s.text)
+	}
+	if joined.String() != content {
+		t.Error("Sections do not add up to the original content")
+	}
+}
+
+// TestHeadingAnchor tests GitHub-style heading anchors
+func TestHeadingAnchor(t *testing.T) {
+	tests := map[string]string{
+		"Detailed Design":               "detailed-design",
+		"Objective / Abstract":          "objective--abstract",
+		"The `try` construct":           "the-try-construct",
+		"Q&A: what about `x?`":          "qa-what-about-x",
+		"Step 1 - Background_Info (v2)": "step-1---background_info-v2",
+	}
+	for title, want := range tests {
+		if got := headingAnchor(title); got != want {
+			t.Errorf("headingAnchor(%q) = %q, want %q", title, got, want)
+		}
+	}
+}
+
+// TestPackParts tests distributing sections over size-limited parts
+func TestPackParts(t *testing.T) {
+	section := func(title string, size int) docSection {
+		text := "## " + title + "\n\n" + strings.Repeat("x", size-len(title)-6) + "\n\n"
+		return docSection{title: title, anchor: headingAnchor(title), text: text}
+	}
+
+	t.Run("FitsInBody", func(t *testing.T) {
+		parts := packParts([]docSection{section("A", 100), section("B", 100)}, 1000, 1000)
+		if len(parts) != 1 || len(parts[0].sections) != 2 {
+			t.Errorf("Expected everything in one part, got %d parts", len(parts))
+		}
+	})
+
+	t.Run("SectionAligned", func(t *testing.T) {
+		parts := packParts([]docSection{section("A", 400), section("B", 400), section("C", 400)}, 500, 1000)
+		if len(parts) != 2 {
+			t.Fatalf("Expected 2 parts, got %d", len(parts))
+		}
+		if len(parts[0].sections) != 1 || parts[0].sections[0].title != "A" {
+			t.Errorf("Wrong first part: %+v", parts[0].sections)
+		}
+		if len(parts[1].sections) != 2 {
+			t.Errorf("Wrong second part: %+v", parts[1].sections)
+		}
+	})
+
+	t.Run("OversizedSection", func(t *testing.T) {
+		var b strings.Builder
+		b.WriteString("## Big\n\n")
+		for i := 0; i < 30; i++ {
+			b.WriteString(strings.Repeat("y", 90) + "\n\n")
+		}
+		big := docSection{title: "Big", anchor: "big", text: b.String()}
+
+		parts := packParts([]docSection{big}, 1000, 1000)
+		if len(parts) < 3 {
+			t.Fatalf("Expected oversized section to be split, got %d parts", len(parts))
+		}
+		var joined strings.Builder
+		for i, part := range parts {
+			if len(part.text()) > 1000 {
+				t.Errorf("Part %d exceeds limit: %d bytes", i+1, len(part.text()))
+			}
+			joined.WriteString(part.text())
+		}
+		if joined.String() != big.text {
+			t.Error("Parts do not add up to the original section")
+		}
+		if parts[0].sections[0].title != "Big" || parts[1].sections[0].title != "" {
+			t.Error("Only the first piece of a split section should be titled")
+		}
+	})
+}
+
+// TestTableOfContents tests linking sections to where they were posted
+func TestTableOfContents(t *testing.T) {
+	parts := []fullTextPart{
+		{sections: []docSection{{text: "# T\n"}, {title: "Objective", anchor: "objective"}}},
+		{sections: []docSection{{title: "Design", anchor: "design"}}},
+		{sections: []docSection{{title: "Appendix", anchor: "appendix"}}},
+	}
+
+	got := tableOfContents(parts, []string{"https://example.com/c1"})
+	want := "## Contents\n\n" +
+		"- [Objective](#objective)\n" +
+		"- [Design](https://example.com/c1) (part 2)\n" +
+		"- Appendix (part 3)\n"
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+// TestFullTextCommentMarker tests that comment headers can be recognized
+func TestFullTextCommentMarker(t *testing.T) {
+	m := fullTextMarkerPattern.FindStringSubmatch(fullTextCommentHeader(3, 4) + "text")
+	if m == nil || m[1] != "3" || m[2] != "4" {
+		t.Errorf("Marker not recognized: %v", m)
+	}
+}
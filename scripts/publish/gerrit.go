@@ -0,0 +1,593 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// gerritXSSIPrefix is prepended by Gerrit to every JSON response to prevent
+// cross-site script inclusion; it has to be stripped before decoding.
+const gerritXSSIPrefix = ")]}'"
+
+// gerritEndpoint identifies the Gerrit server and project the repository is
+// reviewed on. All CL URLs and API calls are derived from it, so that they
+// agree with each other and with what git codereview mails to.
+type gerritEndpoint struct {
+	// scheme and host of the Gerrit web UI and REST API, such as https
+	// and cue.gerrithub.io.
+	scheme string
+	host   string
+
+	// project is the Gerrit project name, such as cue-lang/proposal.
+	project string
+
+	// authenticated selects the "/a/" endpoints, which require
+	// credentials but also see private and draft changes.
+	authenticated bool
+}
+
+// parseGerritEndpoint parses the URL of a repository hosted on Gerrit, in
+// any of the forms used by codereview.cfg or a git remote:
+//
+//	https://cue.gerrithub.io/a/cue-lang/proposal
+//	https://review.gerrithub.io/cue-lang/proposal.git
+//	ssh://user@cue.gerrithub.io:29418/cue-lang/proposal
+//	user@cue.gerrithub.io:cue-lang/proposal
+//	https://cue.googlesource.com/proposal
+//
+// For googlesource.com repositories the review host is the "-review" host
+// that goes with the git host.
+func parseGerritEndpoint(rawURL string) (*gerritEndpoint, error) {
+	rawURL = strings.TrimSpace(rawURL)
+
+	// Turn scp-like syntax (user@host:path) into an ssh URL.
+	if !strings.Contains(rawURL, "://") {
+		if at, colon := strings.Index(rawURL, "@"), strings.Index(rawURL, ":"); colon > at {
+			rawURL = "ssh://" + rawURL[:colon] + "/" + strings.TrimPrefix(rawURL[colon+1:], "/")
+		}
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid gerrit URL %q", rawURL)
+	}
+
+	e := &gerritEndpoint{scheme: u.Scheme, host: u.Hostname()}
+	switch u.Scheme {
+	case "https", "http":
+		// The port, if any, serves both git and the REST API.
+		e.host = u.Host
+	case "ssh":
+		// Gerrit serves ssh on a separate port; the web UI and REST API
+		// are on the default https port of the same host.
+		e.scheme = "https"
+	default:
+		return nil, fmt.Errorf("unsupported gerrit URL scheme in %q", rawURL)
+	}
+
+	path := strings.Trim(u.Path, "/")
+	if path == "a" || strings.HasPrefix(path, "a/") {
+		e.authenticated = true
+		path = strings.TrimPrefix(path[1:], "/")
+	}
+	e.project = strings.TrimSuffix(path, ".git")
+	if e.project == "" {
+		return nil, fmt.Errorf("gerrit URL %q does not name a project", rawURL)
+	}
+
+	if sub, ok := strings.CutSuffix(e.host, ".googlesource.com"); ok && !strings.HasSuffix(sub, "-review") {
+		e.host = sub + "-review.googlesource.com"
+	}
+
+	return e, nil
+}
+
+// baseURL returns the root URL of the Gerrit server, without trailing slash.
+func (e *gerritEndpoint) baseURL() string {
+	return e.scheme + "://" + e.host
+}
+
+// apiURL returns the URL of a REST API path such as /changes/.
+func (e *gerritEndpoint) apiURL(path string) string {
+	if e.authenticated {
+		return e.baseURL() + "/a" + path
+	}
+	return e.baseURL() + path
+}
+
+// changeURL returns the web URL of the change with the given number.
+func (e *gerritEndpoint) changeURL(number string) string {
+	return fmt.Sprintf("%s/c/%s/+/%s", e.baseURL(), e.project, number)
+}
+
+// changeIDURL returns a web URL that finds a change by its Change-Id,
+// for when the number is not known.
+func (e *gerritEndpoint) changeIDURL(changeID string) string {
+	return fmt.Sprintf("%s/q/%s", e.baseURL(), changeID)
+}
+
+// changeURLPattern returns a pattern matching web URLs of changes on this
+// endpoint, capturing the change number.
+func (e *gerritEndpoint) changeURLPattern() *regexp.Regexp {
+	return regexp.MustCompile(regexp.QuoteMeta(e.baseURL()) + `/c/` + regexp.QuoteMeta(e.project) + `/\+/(\d+)`)
+}
+
+// gerritClient is a minimal client for the Gerrit REST API.
+type gerritClient struct {
+	endpoint *gerritEndpoint
+
+	// Credentials for the server, from .netrc or the git cookie file.
+	username, password string
+	cookies            []*http.Cookie
+
+	// context returns the context requests are made in, so that
+	// interrupts and step timeouts stop them; nil for none.
+	context func() context.Context
+
+	httpClient *http.Client
+}
+
+// gerritChange is the subset of Gerrit's ChangeInfo used by this tool.
+type gerritChange struct {
+	ID              string `json:"id"`
+	Project         string `json:"project"`
+	Branch          string `json:"branch"`
+	ChangeID        string `json:"change_id"`
+	Subject         string `json:"subject"`
+	Status          string `json:"status"` // NEW, MERGED or ABANDONED
+	Number          int    `json:"_number"`
+	CurrentRevision string `json:"current_revision"`
+	Revisions       map[string]struct {
+		Number int `json:"_number"`
+	} `json:"revisions"`
+}
+
+// CurrentPatchset returns the number of the change's current patchset, or
+// zero if the revisions were not requested.
+func (c *gerritChange) CurrentPatchset() int {
+	return c.Revisions[c.CurrentRevision].Number
+}
+
+// newGerritClient returns a client for the Gerrit endpoint, using the
+// credentials for its host from .netrc or, if not empty, cookieFile.
+func newGerritClient(endpoint *gerritEndpoint, cookieFile string) *gerritClient {
+	c := &gerritClient{
+		endpoint:   endpoint,
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+	}
+	host := endpoint.host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	c.username, c.password = netrcCredentials(host)
+	c.cookies = gitCookies(cookieFile, host)
+	return c
+}
+
+// do performs a request against the REST API and decodes the JSON response
+// into v, if v is not nil.
+func (c *gerritClient) do(method, path string, body, v interface{}) error {
+	data, err := c.fetch(method, path, body)
+	if err != nil || v == nil {
+		return err
+	}
+	data = bytes.TrimPrefix(data, []byte(gerritXSSIPrefix))
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("failed to parse gerrit response: %v", err)
+	}
+	return nil
+}
+
+// fetch performs a request against the REST API and returns the body of
+// the response as is.
+func (c *gerritClient) fetch(method, path string, body interface{}) ([]byte, error) {
+	endpoint := c.endpoint.apiURL(path)
+
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal JSON: %v", err)
+		}
+		reqBody = bytes.NewReader(data)
+	}
+
+	ctx := context.Background()
+	if c.context != nil {
+		ctx = c.context()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, reqBody)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.username != "" {
+		req.SetBasicAuth(c.username, c.password)
+	}
+	for _, cookie := range c.cookies {
+		req.AddCookie(cookie)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil && ctx.Err() != nil {
+		return nil, fmt.Errorf("gerrit request stopped: %w", context.Cause(ctx))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("gerrit request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read gerrit response: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &gerritError{
+			method: method,
+			url:    endpoint,
+			status: resp.StatusCode,
+			body:   strings.TrimSpace(string(data)),
+		}
+	}
+	return data, nil
+}
+
+// gerritError is returned for requests Gerrit did not answer with 200 OK.
+type gerritError struct {
+	method string
+	url    string
+	status int
+	body   string
+}
+
+func (e *gerritError) Error() string {
+	msg := fmt.Sprintf("gerrit %s %s: %s", e.method, e.url, http.StatusText(e.status))
+	if e.body != "" {
+		msg += ": " + e.body
+	}
+	if e.status == http.StatusUnauthorized || e.status == http.StatusForbidden {
+		msg += " (check the credentials for the host in ~/.netrc or the git http.cookiefile)"
+	}
+	return msg
+}
+
+// changeByID looks up the change with the given Change-Id, including its
+// current revision. It returns nil without error if there is no such change.
+func (c *gerritClient) changeByID(changeID string) (*gerritChange, error) {
+	query := url.Values{}
+	query.Set("q", "change:"+changeID)
+	query.Add("o", "CURRENT_REVISION")
+
+	var changes []*gerritChange
+	if err := c.do("GET", "/changes/?"+query.Encode(), nil, &changes); err != nil {
+		return nil, err
+	}
+
+	switch len(changes) {
+	case 0:
+		return nil, nil
+	case 1:
+		return changes[0], nil
+	}
+
+	// The same Change-Id may be used on several branches; prefer master.
+	for _, change := range changes {
+		if change.Branch == "master" || change.Branch == "main" {
+			return change, nil
+		}
+	}
+	return nil, fmt.Errorf("Change-Id %s matches %d changes", changeID, len(changes))
+}
+
+// gerritMessage is a message posted on a change, such as a review comment.
+type gerritMessage struct {
+	ID       string `json:"id"`
+	Tag      string `json:"tag"`
+	Message  string `json:"message"`
+	Date     string `json:"date"`
+	Revision int    `json:"_revision_number"`
+}
+
+// gerritReview is the input to the set-review endpoint.
+type gerritReview struct {
+	Message string `json:"message"`
+	Tag     string `json:"tag,omitempty"`
+	Notify  string `json:"notify,omitempty"`
+}
+
+// changeMessages returns the messages posted on a change, oldest first.
+func (c *gerritClient) changeMessages(change *gerritChange) ([]gerritMessage, error) {
+	var messages []gerritMessage
+	if err := c.do("GET", "/changes/"+change.ID+"/messages", nil, &messages); err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+// gerritComment is an inline comment on a file of a change.
+type gerritComment struct {
+	ID        string `json:"id"`
+	InReplyTo string `json:"in_reply_to"`
+	PatchSet  int    `json:"patch_set"`
+	Line      int    `json:"line"` // zero for file-level comments
+	Range     *struct {
+		StartLine int `json:"start_line"`
+		EndLine   int `json:"end_line"`
+	} `json:"range"`
+	Message    string `json:"message"`
+	Updated    string `json:"updated"`
+	Unresolved bool   `json:"unresolved"`
+	Author     struct {
+		Name     string `json:"name"`
+		Username string `json:"username"`
+	} `json:"author"`
+}
+
+// changeComments returns the published inline comments of a change,
+// indexed by file path.
+func (c *gerritClient) changeComments(change *gerritChange) (map[string][]gerritComment, error) {
+	var comments map[string][]gerritComment
+	if err := c.do("GET", "/changes/"+change.ID+"/comments", nil, &comments); err != nil {
+		return nil, err
+	}
+	return comments, nil
+}
+
+// fileContent returns the content of file in the given patchset of a
+// change.
+func (c *gerritClient) fileContent(change *gerritChange, patchset int, file string) (string, error) {
+	data, err := c.fetch("GET", fmt.Sprintf("/changes/%s/revisions/%d/files/%s/content", change.ID, patchset, url.PathEscape(file)), nil)
+	if err != nil {
+		return "", err
+	}
+	// Gerrit sends the content base64-encoded, not as JSON.
+	content, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return "", fmt.Errorf("failed to decode content of %s: %v", file, err)
+	}
+	return string(content), nil
+}
+
+// setReview posts a review on the current revision of a change.
+func (c *gerritClient) setReview(change *gerritChange, review *gerritReview) error {
+	return c.do("POST", "/changes/"+change.ID+"/revisions/current/review", review, nil)
+}
+
+// netrcCredentials returns the login and password for host from the netrc
+// file ($NETRC or ~/.netrc), or empty strings if there are none.
+func netrcCredentials(host string) (login, password string) {
+	path := os.Getenv("NETRC")
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", ""
+		}
+		path = filepath.Join(home, ".netrc")
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", ""
+	}
+	return parseNetrc(string(data), host)
+}
+
+// parseNetrc returns the credentials for host from the contents of a netrc
+// file, falling back to a "default" entry.
+func parseNetrc(data, host string) (login, password string) {
+	var defLogin, defPassword string
+	var machine string
+	inDefault := false
+
+	fields := strings.Fields(data)
+	for i := 0; i < len(fields); i++ {
+		switch fields[i] {
+		case "machine":
+			if i+1 < len(fields) {
+				i++
+				machine = fields[i]
+			}
+			inDefault = false
+		case "default":
+			machine = ""
+			inDefault = true
+		case "login", "password", "account":
+			if i+1 >= len(fields) {
+				break
+			}
+			key, value := fields[i], fields[i+1]
+			i++
+			switch {
+			case machine == host && key == "login":
+				login = value
+			case machine == host && key == "password":
+				password = value
+			case inDefault && key == "login":
+				defLogin = value
+			case inDefault && key == "password":
+				defPassword = value
+			}
+		case "macdef":
+			// Macro definitions run to the next blank line, which
+			// Fields cannot tell apart; they are not expected in
+			// files used for HTTP credentials, so stop here.
+			i = len(fields)
+		}
+	}
+
+	if login == "" && password == "" {
+		return defLogin, defPassword
+	}
+	return login, password
+}
+
+// gitCookies returns the cookies for host from path, the cookie file
+// configured with git's http.cookiefile as set up by the Gerrit
+// "gitcookies" scripts.
+func gitCookies(path, host string) []*http.Cookie {
+	if path == "" {
+		return nil
+	}
+	if strings.HasPrefix(path, "~/") {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil
+		}
+		path = filepath.Join(home, path[2:])
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	return parseCookieFile(f, host)
+}
+
+// parseCookieFile parses a Netscape format cookie file and returns the
+// cookies that apply to host.
+func parseCookieFile(r io.Reader, host string) []*http.Cookie {
+	var cookies []*http.Cookie
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		// curl marks HttpOnly cookies with this prefix.
+		line = strings.TrimPrefix(line, "#HttpOnly_")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		// domain, include subdomains, path, secure, expiry, name, value
+		f := strings.Split(line, "\t")
+		if len(f) != 7 {
+			continue
+		}
+		domain := f[0]
+		matches := host == strings.TrimPrefix(domain, ".")
+		if !matches && (strings.HasPrefix(domain, ".") || f[1] == "TRUE") {
+			matches = strings.HasSuffix(host, "."+strings.TrimPrefix(domain, "."))
+		}
+		if !matches {
+			continue
+		}
+		if expiry, err := strconv.ParseInt(f[4], 10, 64); err == nil && expiry != 0 && time.Unix(expiry, 0).Before(time.Now()) {
+			continue
+		}
+		cookies = append(cookies, &http.Cookie{Name: f[5], Value: f[6]})
+	}
+	return cookies
+}
+
+// codereviewConfig reads the key: value pairs of codereview.cfg at the root
+// of the repository in dir. A missing file yields an empty map.
+func codereviewConfig(dir string) (map[string]string, error) {
+	cfg := make(map[string]string)
+
+	data, err := os.ReadFile(filepath.Join(dir, "codereview.cfg"))
+	if os.IsNotExist(err) {
+		return cfg, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read codereview.cfg: %v", err)
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		cfg[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+	return cfg, nil
+}
+
+// gerritEndpoint returns the Gerrit endpoint of the repository, from the
+// "gerrit" key of codereview.cfg or, if that is missing or set to "origin"
+// as git codereview allows, from the URL of the origin remote.
+func (p *Publisher) gerritEndpoint() (*gerritEndpoint, error) {
+	if p.endpoint != nil {
+		return p.endpoint, nil
+	}
+
+	root, _, err := p.runCommand("git", "rev-parse", "--show-toplevel")
+	if err != nil {
+		return nil, fmt.Errorf("failed to find repository root: %v", err)
+	}
+	cfg, err := codereviewConfig(strings.TrimSpace(root))
+	if err != nil {
+		return nil, err
+	}
+
+	source := "codereview.cfg"
+	gerritURL := cfg["gerrit"]
+	switch gerritURL {
+	case "off":
+		return nil, fmt.Errorf("gerrit is disabled in codereview.cfg")
+	case "", "origin":
+		source = "origin remote"
+		origin, _, err := p.runCommand("git", "config", "--get", "remote.origin.url")
+		if err != nil || strings.TrimSpace(origin) == "" {
+			return nil, fmt.Errorf("no gerrit server configured in codereview.cfg and no origin remote")
+		}
+		gerritURL = strings.TrimSpace(origin)
+	}
+
+	endpoint, err := parseGerritEndpoint(gerritURL)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", source, err)
+	}
+	p.endpoint = endpoint
+	return p.endpoint, nil
+}
+
+// changeURL returns the web URL of the CL with the given number on the
+// repository's Gerrit endpoint. If the endpoint cannot be determined it
+// returns fallback, such as a URL reported by git codereview.
+func (p *Publisher) changeURL(number, fallback string) string {
+	endpoint, err := p.gerritEndpoint()
+	if err != nil {
+		return fallback
+	}
+	return endpoint.changeURL(number)
+}
+
+// gerritClient returns the client for the repository's Gerrit endpoint.
+func (p *Publisher) gerritClient() (*gerritClient, error) {
+	if p.gerrit != nil {
+		return p.gerrit, nil
+	}
+
+	endpoint, err := p.gerritEndpoint()
+	if err != nil {
+		return nil, err
+	}
+
+	// No cookie file configured is not an error.
+	cookieFile, _, _ := p.runCommand("git", "config", "--get", "http.cookiefile")
+
+	p.gerrit = newGerritClient(endpoint, strings.TrimSpace(cookieFile))
+	p.gerrit.context = p.context
+	return p.gerrit, nil
+}
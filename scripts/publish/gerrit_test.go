@@ -0,0 +1,386 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const testChangeID = "I0123456789abcdef0123456789abcdef01234567"
+
+// fakeGerrit is a minimal stand-in for the Gerrit REST API
+type fakeGerrit struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	changes  map[string]string                     // Change-Id to ChangeInfo JSON
+	messages map[string][]gerritMessage            // Change-Id to messages
+	comments map[string]map[string][]gerritComment // Change-Id to comments by file
+	files    map[string]map[string]string          // Change-Id to content by "patchset/file"
+	requests []*http.Request
+}
+
+func newFakeGerrit(t *testing.T) *fakeGerrit {
+	t.Helper()
+
+	g := &fakeGerrit{
+		changes:  make(map[string]string),
+		messages: make(map[string][]gerritMessage),
+		comments: make(map[string]map[string][]gerritComment),
+		files:    make(map[string]map[string]string),
+	}
+	g.Server = httptest.NewServer(http.HandlerFunc(g.serve))
+	t.Cleanup(g.Close)
+	return g
+}
+
+func (g *fakeGerrit) serve(w http.ResponseWriter, r *http.Request) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.requests = append(g.requests, r)
+
+	path := strings.TrimPrefix(r.URL.Path, "/a")
+	switch {
+	case path == "/changes/":
+		id := strings.TrimPrefix(r.URL.Query().Get("q"), "change:")
+		fmt.Fprint(w, gerritXSSIPrefix+"\n")
+		if change, ok := g.changes[id]; ok {
+			fmt.Fprintf(w, "[%s]\n", change)
+		} else {
+			fmt.Fprint(w, "[]\n")
+		}
+	case strings.HasPrefix(path, "/changes/") && strings.HasSuffix(path, "/messages"):
+		id := changeIDFromPath(strings.TrimSuffix(path, "/messages"))
+		data, _ := json.Marshal(g.messages[id])
+		fmt.Fprintf(w, "%s\n%s\n", gerritXSSIPrefix, data)
+	case strings.HasPrefix(path, "/changes/") && strings.HasSuffix(path, "/comments"):
+		id := changeIDFromPath(strings.TrimSuffix(path, "/comments"))
+		data, _ := json.Marshal(g.comments[id])
+		fmt.Fprintf(w, "%s\n%s\n", gerritXSSIPrefix, data)
+	case strings.HasPrefix(path, "/changes/") && strings.HasSuffix(path, "/content"):
+		// The file name is a single escaped segment of the path.
+		parts := strings.Split(strings.TrimPrefix(r.URL.EscapedPath(), "/a"), "/")
+		if len(parts) != 8 || parts[3] != "revisions" || parts[5] != "files" {
+			http.NotFound(w, r)
+			return
+		}
+		file, _ := url.PathUnescape(parts[6])
+		content, ok := g.files[changeIDFromPath(parts[2])][parts[4]+"/"+file]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, base64.StdEncoding.EncodeToString([]byte(content)))
+	case strings.HasPrefix(path, "/changes/") && strings.HasSuffix(path, "/revisions/current/review") && r.Method == "POST":
+		id := changeIDFromPath(strings.TrimSuffix(path, "/revisions/current/review"))
+		var review gerritReview
+		if err := json.NewDecoder(r.Body).Decode(&review); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		g.messages[id] = append(g.messages[id], gerritMessage{
+			ID:      fmt.Sprint(len(g.messages[id]) + 1),
+			Tag:     review.Tag,
+			Message: "Patch Set 1:\n\n" + review.Message,
+		})
+		fmt.Fprint(w, gerritXSSIPrefix+"\n{}\n")
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// changeIDFromPath returns the Change-Id of a /changes/project~branch~id
+// path.
+func changeIDFromPath(path string) string {
+	return path[strings.LastIndex(path, "~")+1:]
+}
+
+func (g *fakeGerrit) addChange(changeID string, number, patchset int, status string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.changes[changeID] = fmt.Sprintf(`{
+		"id": "cue-lang%%2Fproposal~master~%[1]s",
+		"project": "cue-lang/proposal",
+		"branch": "master",
+		"change_id": "%[1]s",
+		"status": "%[4]s",
+		"_number": %[2]d,
+		"current_revision": "abc123",
+		"revisions": {"abc123": {"_number": %[3]d}}
+	}`, changeID, number, patchset, status)
+}
+
+// TestGerritClient tests querying changes through the REST API
+func TestGerritClient(t *testing.T) {
+	gerrit := newFakeGerrit(t)
+	gerrit.addChange(testChangeID, 1234, 3, "NEW")
+
+	t.Setenv("NETRC", filepath.Join(t.TempDir(), "netrc"))
+
+	endpoint := func(path string) *gerritEndpoint {
+		e, err := parseGerritEndpoint(gerrit.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return e
+	}
+
+	t.Run("ChangeByID", func(t *testing.T) {
+		client := newGerritClient(endpoint("/cue-lang/proposal"), "")
+		change, err := client.changeByID(testChangeID)
+		if err != nil {
+			t.Fatalf("changeByID failed: %v", err)
+		}
+		if change == nil {
+			t.Fatal("Change not found")
+		}
+		if change.Number != 1234 || change.CurrentPatchset() != 3 || change.Status != "NEW" {
+			t.Errorf("Wrong change: %+v", change)
+		}
+		if got := client.endpoint.changeURL(strconv.Itoa(change.Number)); got != gerrit.URL+"/c/cue-lang/proposal/+/1234" {
+			t.Errorf("Wrong change URL: %s", got)
+		}
+	})
+
+	t.Run("UnknownChange", func(t *testing.T) {
+		client := newGerritClient(endpoint("/cue-lang/proposal"), "")
+		change, err := client.changeByID("Ifffffffffffffffffffffffffffffffffffffff")
+		if err != nil || change != nil {
+			t.Errorf("Expected no change and no error, got %v, %v", change, err)
+		}
+	})
+
+	t.Run("AuthenticatedWithNetrc", func(t *testing.T) {
+		host := strings.TrimPrefix(gerrit.URL, "http://")
+		host = host[:strings.Index(host, ":")]
+		netrc := fmt.Sprintf("machine %s login gopher password secret\n", host)
+		if err := os.WriteFile(os.Getenv("NETRC"), []byte(netrc), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		client := newGerritClient(endpoint("/a/cue-lang/proposal"), "")
+		if _, err := client.changeByID(testChangeID); err != nil {
+			t.Fatalf("changeByID failed: %v", err)
+		}
+
+		r := gerrit.requests[len(gerrit.requests)-1]
+		if !strings.HasPrefix(r.URL.Path, "/a/changes/") {
+			t.Errorf("Authenticated request should use /a/ endpoint: %s", r.URL.Path)
+		}
+		user, password, ok := r.BasicAuth()
+		if !ok || user != "gopher" || password != "secret" {
+			t.Errorf("Wrong credentials: %q %q %v", user, password, ok)
+		}
+	})
+
+	t.Run("Cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancelCause(context.Background())
+		cancel(errors.New("received interrupt"))
+		client := newGerritClient(endpoint("/cue-lang/proposal"), "")
+		client.context = func() context.Context { return ctx }
+		_, err := client.changeByID(testChangeID)
+		if err == nil || !strings.Contains(err.Error(), "stopped: received interrupt") {
+			t.Errorf("Expected the request to be stopped, got: %v", err)
+		}
+	})
+
+	t.Run("ErrorStatus", func(t *testing.T) {
+		client := newGerritClient(endpoint("/cue-lang/proposal"), "")
+		err := client.do("GET", "/nonexistent", nil, nil)
+		if err == nil || !strings.Contains(err.Error(), "Not Found") {
+			t.Errorf("Expected not found error, got: %v", err)
+		}
+	})
+}
+
+// TestParseGerritEndpoint tests the Gerrit URL shapes found in
+// codereview.cfg and git remotes
+func TestParseGerritEndpoint(t *testing.T) {
+	tests := []struct {
+		name    string
+		url     string
+		base    string
+		project string
+		auth    bool
+	}{
+		{"Authenticated", "https://cue.gerrithub.io/a/cue-lang/proposal", "https://cue.gerrithub.io", "cue-lang/proposal", true},
+		{"Anonymous", "https://cue.gerrithub.io/cue-lang/proposal", "https://cue.gerrithub.io", "cue-lang/proposal", false},
+		{"GitSuffix", "https://review.gerrithub.io/cue-lang/proposal.git", "https://review.gerrithub.io", "cue-lang/proposal", false},
+		{"TrailingSlash", "https://cue.gerrithub.io/a/cue-lang/proposal/", "https://cue.gerrithub.io", "cue-lang/proposal", true},
+		{"Port", "http://127.0.0.1:8080/cue-lang/proposal", "http://127.0.0.1:8080", "cue-lang/proposal", false},
+		{"SSH", "ssh://gopher@cue.gerrithub.io:29418/cue-lang/proposal", "https://cue.gerrithub.io", "cue-lang/proposal", false},
+		{"SCP", "gopher@cue.gerrithub.io:cue-lang/proposal.git", "https://cue.gerrithub.io", "cue-lang/proposal", false},
+		{"GoogleSource", "https://cue.googlesource.com/proposal", "https://cue-review.googlesource.com", "proposal", false},
+		{"GoogleSourceReview", "https://cue-review.googlesource.com/a/proposal", "https://cue-review.googlesource.com", "proposal", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := parseGerritEndpoint(tt.url)
+			if err != nil {
+				t.Fatalf("parseGerritEndpoint failed: %v", err)
+			}
+			if e.baseURL() != tt.base || e.project != tt.project || e.authenticated != tt.auth {
+				t.Errorf("Got base %q, project %q, authenticated %v", e.baseURL(), e.project, e.authenticated)
+			}
+			if got, want := e.changeURL("42"), tt.base+"/c/"+tt.project+"/+/42"; got != want {
+				t.Errorf("Wrong change URL: %s, want %s", got, want)
+			}
+			if m := e.changeURLPattern().FindStringSubmatch("remote:   " + e.changeURL("42") + " [NEW]"); m == nil || m[1] != "42" {
+				t.Errorf("Change URL pattern did not match: %v", m)
+			}
+		})
+	}
+
+	for _, bad := range []string{"", "https://cue.gerrithub.io", "https://cue.gerrithub.io/a/", "file:///tmp/proposal"} {
+		if _, err := parseGerritEndpoint(bad); err == nil {
+			t.Errorf("Expected error for %q", bad)
+		}
+	}
+}
+
+// TestGerritEndpointConfig tests locating the endpoint from codereview.cfg
+// and the origin remote
+func TestGerritEndpointConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string // contents of codereview.cfg, if any
+		origin string // URL of the origin remote, if any
+		want   string // expected base URL and project, or "" for an error
+	}{
+		{"Config", "gerrit: https://cue.gerrithub.io/a/cue-lang/proposal\n", "", "https://cue.gerrithub.io cue-lang/proposal"},
+		{"ConfigOverOrigin", "gerrit: https://cue.gerrithub.io/a/cue-lang/proposal\n", "https://example.com/other", "https://cue.gerrithub.io cue-lang/proposal"},
+		{"OriginKeyword", "gerrit: origin\n", "https://cue.gerrithub.io/a/cue-lang/proposal", "https://cue.gerrithub.io cue-lang/proposal"},
+		{"MissingKey", "github: https://github.com/cue-lang/proposal\n", "ssh://gopher@cue.gerrithub.io:29418/cue-lang/proposal", "https://cue.gerrithub.io cue-lang/proposal"},
+		{"NoConfig", "", "https://cue.googlesource.com/proposal", "https://cue-review.googlesource.com proposal"},
+		{"Off", "gerrit: off\n", "https://cue.gerrithub.io/a/cue-lang/proposal", ""},
+		{"Nothing", "", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := NewTestRepo(t)
+			if tt.config != "" {
+				repo.writeFile("codereview.cfg", tt.config)
+			}
+			if tt.origin != "" {
+				repo.run("git", "remote", "add", "origin", tt.origin)
+			}
+
+			oldDir, _ := os.Getwd()
+			os.Chdir(repo.dir)
+			defer os.Chdir(oldDir)
+
+			publisher := &Publisher{logger: NewLogger()}
+			e, err := publisher.gerritEndpoint()
+			if tt.want == "" {
+				if err == nil {
+					t.Fatalf("Expected error, got endpoint %+v", e)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("gerritEndpoint failed: %v", err)
+			}
+			if got := e.baseURL() + " " + e.project; got != tt.want {
+				t.Errorf("Got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestParseNetrc tests extracting credentials from netrc files
+func TestParseNetrc(t *testing.T) {
+	netrc := `machine github.com login octocat password gh
+machine cue.gerrithub.io
+	login gopher
+	password secret
+default login anonymous password guest
+`
+	if login, password := parseNetrc(netrc, "cue.gerrithub.io"); login != "gopher" || password != "secret" {
+		t.Errorf("Wrong credentials: %q %q", login, password)
+	}
+	if login, password := parseNetrc(netrc, "example.com"); login != "anonymous" || password != "guest" {
+		t.Errorf("Expected default credentials, got: %q %q", login, password)
+	}
+	if login, _ := parseNetrc("machine a login b", "example.com"); login != "" {
+		t.Errorf("Expected no credentials, got: %q", login)
+	}
+}
+
+// TestParseCookieFile tests reading git http.cookiefile entries
+func TestParseCookieFile(t *testing.T) {
+	cookies := "# Netscape HTTP Cookie File\n" +
+		"cue.gerrithub.io\tFALSE\t/\tTRUE\t2147483647\to\tgit-gopher=secret\n" +
+		".gerrithub.io\tTRUE\t/\tTRUE\t2147483647\tdomain\tshared\n" +
+		"#HttpOnly_other.example.com\tFALSE\t/\tTRUE\t2147483647\to\tother\n" +
+		"cue.gerrithub.io\tFALSE\t/\tTRUE\t1\texpired\tvalue\n"
+
+	got := parseCookieFile(strings.NewReader(cookies), "cue.gerrithub.io")
+	var names []string
+	for _, c := range got {
+		names = append(names, c.Name+"="+c.Value)
+	}
+	if strings.Join(names, " ") != "o=git-gopher=secret domain=shared" {
+		t.Errorf("Wrong cookies: %v", names)
+	}
+}
+
+// TestGetExistingCL tests resolving the CL of a commit from its Change-Id
+func TestGetExistingCL(t *testing.T) {
+	gerrit := newFakeGerrit(t)
+	gerrit.addChange(testChangeID, 4321, 2, "NEW")
+	t.Setenv("NETRC", filepath.Join(t.TempDir(), "netrc"))
+
+	repo := newGerritTestRepo(t, gerrit)
+	defer repo.Cleanup()
+
+	oldDir, _ := os.Getwd()
+	os.Chdir(repo.dir)
+	defer os.Chdir(oldDir)
+
+	t.Run("Found", func(t *testing.T) {
+		publisher := &Publisher{logger: NewLogger(), commitRef: "HEAD"}
+		if err := publisher.getExistingCL(); err != nil {
+			t.Fatalf("getExistingCL failed: %v", err)
+		}
+		if publisher.clNumber != "4321" {
+			t.Errorf("Wrong CL number: %s", publisher.clNumber)
+		}
+		if publisher.clURL != gerrit.URL+"/c/cue-lang/proposal/+/4321" {
+			t.Errorf("Wrong CL URL: %s", publisher.clURL)
+		}
+	})
+
+	t.Run("NoChangeID", func(t *testing.T) {
+		publisher := &Publisher{logger: NewLogger(), commitRef: "HEAD~1"}
+		if err := publisher.getExistingCL(); err == nil || !strings.Contains(err.Error(), "no Change-Id") {
+			t.Errorf("Expected missing Change-Id error, got: %v", err)
+		}
+	})
+}
+
+// newGerritTestRepo creates a repository reviewed on the fake Gerrit server,
+// whose HEAD adds a numbered proposal with testChangeID.
+func newGerritTestRepo(t *testing.T, gerrit *fakeGerrit) *TestRepo {
+	t.Helper()
+
+	repo := NewTestRepo(t)
+	repo.writeFile("codereview.cfg", "gerrit: "+gerrit.URL+"/cue-lang/proposal\n")
+	repo.run("git", "add", "codereview.cfg")
+	repo.run("git", "commit", "-m", "Add codereview.cfg")
+
+	repo.writeFile("designs/language/4014-aliases.md", "# Aliases\n")
+	repo.run("git", "add", "designs")
+	repo.run("git", "commit", "-m", "designs: add aliases\n\nChange-Id: "+testChangeID)
+	return repo
+}
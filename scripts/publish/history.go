@@ -0,0 +1,430 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// fileEdit is a change to one file in the tree of a commit.
+type fileEdit struct {
+	path    string                               // file to change
+	newPath string                               // new name of the file; "" keeps the name
+	edit    func(content string) (string, error) // new content from the old; nil keeps the content
+}
+
+// treeEntry is an entry of a git tree object, as listed by git ls-tree.
+type treeEntry struct {
+	mode string
+	kind string // blob, tree or commit
+	hash string
+	name string
+}
+
+// readTree returns the entries of a tree object. The tree "" has none.
+func (p *Publisher) readTree(tree string) ([]treeEntry, error) {
+	if tree == "" {
+		return nil, nil
+	}
+	out, _, err := p.runCommand("git", "ls-tree", "-z", tree)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tree %s: %v", shortHash(tree), err)
+	}
+	var entries []treeEntry
+	for _, record := range strings.Split(out, "\x00") {
+		info, name, ok := strings.Cut(record, "\t")
+		fields := strings.Fields(info)
+		if !ok || len(fields) != 3 {
+			continue
+		}
+		entries = append(entries, treeEntry{mode: fields[0], kind: fields[1], hash: fields[2], name: name})
+	}
+	return entries, nil
+}
+
+// writeTree writes a tree object with the given entries and returns its
+// hash. git mktree sorts the entries.
+func (p *Publisher) writeTree(entries []treeEntry) (string, error) {
+	var input strings.Builder
+	for _, e := range entries {
+		fmt.Fprintf(&input, "%s %s %s\t%s\x00", e.mode, e.kind, e.hash, e.name)
+	}
+	out, stderr, err := p.runCommandInput(input.String(), "git", "mktree", "-z")
+	if err != nil {
+		return "", fmt.Errorf("failed to write tree: %v (stderr: %s)", err, stderr)
+	}
+	return strings.TrimSpace(out), nil
+}
+
+// setTreeFile returns tree with the file at path set to blob with the given
+// mode, or removed if blob is "". Directories along the path are created as
+// needed and dropped once empty, as git does not record empty directories;
+// a tree left without any entries is returned as "".
+func (p *Publisher) setTreeFile(tree, path, mode, blob string) (string, error) {
+	entries, err := p.readTree(tree)
+	if err != nil {
+		return "", err
+	}
+
+	name, rest, nested := strings.Cut(path, "/")
+	var kept []treeEntry
+	var subtree string
+	for _, e := range entries {
+		if e.name == name {
+			if nested && e.kind == "tree" {
+				subtree = e.hash
+			}
+			continue
+		}
+		kept = append(kept, e)
+	}
+
+	switch {
+	case nested:
+		newSubtree, err := p.setTreeFile(subtree, rest, mode, blob)
+		if err != nil {
+			return "", err
+		}
+		if newSubtree != "" {
+			kept = append(kept, treeEntry{mode: "040000", kind: "tree", hash: newSubtree, name: name})
+		}
+	case blob != "":
+		kept = append(kept, treeEntry{mode: mode, kind: "blob", hash: blob, name: name})
+	}
+
+	if len(kept) == 0 {
+		return "", nil
+	}
+	return p.writeTree(kept)
+}
+
+// applyFileEdits returns tree with the edits applied. Edits of files that
+// are not in the tree are skipped.
+func (p *Publisher) applyFileEdits(tree string, edits []fileEdit) (string, error) {
+	for _, e := range edits {
+		out, _, err := p.runCommand("git", "ls-tree", "-z", tree, "--", e.path)
+		if err != nil {
+			return "", fmt.Errorf("failed to look up %s: %v", e.path, err)
+		}
+		info, _, _ := strings.Cut(out, "\t")
+		fields := strings.Fields(info)
+		if len(fields) != 3 || fields[1] != "blob" {
+			continue
+		}
+		mode, blob := fields[0], fields[2]
+
+		if e.edit != nil {
+			content, _, err := p.runCommand("git", "cat-file", "blob", blob)
+			if err != nil {
+				return "", fmt.Errorf("failed to read %s: %v", e.path, err)
+			}
+			updated, err := e.edit(content)
+			if err != nil {
+				return "", fmt.Errorf("failed to edit %s: %v", e.path, err)
+			}
+			if updated != content {
+				out, stderr, err := p.runCommandInput(updated, "git", "hash-object", "-w", "--stdin")
+				if err != nil {
+					return "", fmt.Errorf("failed to write %s: %v (stderr: %s)", e.path, err, stderr)
+				}
+				blob = strings.TrimSpace(out)
+			}
+		}
+
+		target := e.path
+		if e.newPath != "" && e.newPath != e.path {
+			if tree, err = p.setTreeFile(tree, e.path, "", ""); err != nil {
+				return "", err
+			}
+			target = e.newPath
+		}
+		if tree, err = p.setTreeFile(tree, target, mode, blob); err != nil {
+			return "", err
+		}
+	}
+	return tree, nil
+}
+
+// rewriteHistory recreates first, which must be an ancestor of HEAD, and
+// every commit after it up to HEAD. rewrite is given the hash, object header
+// and message of each commit and returns the header and message to use;
+// parents are remapped to the recreated commits afterwards. It returns the
+// hashes of the new commits by those of the old ones.
+//
+// Only new objects are written. The branch is then moved by updateBranch,
+// provided it still points where it did, so the rewrite either happens
+// completely or not at all. The index and worktree are not used; if the
+// rewrite changes the files of HEAD, only those files are brought along in
+// the checkout, as git checkout would, keeping any local changes. In a
+// worktree opened by openWorktree, the worktree's branch is moved instead.
+func (p *Publisher) rewriteHistory(first, reason string, rewrite func(commit, header, message string) (string, string, error)) (map[string]string, error) {
+	if _, _, err := p.runCommand("git", "merge-base", "--is-ancestor", first, "HEAD"); err != nil {
+		return nil, fmt.Errorf("commit %s is not on the current branch; check out the branch it is on", shortHash(first))
+	}
+
+	oldHead, _, err := p.runCommand("git", "rev-parse", "HEAD")
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve HEAD: %v", err)
+	}
+	oldHead = strings.TrimSpace(oldHead)
+
+	commits, err := p.commitsToRewrite(first)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.checkRewritable(commits); err != nil {
+		return nil, err
+	}
+
+	rewritten := make(map[string]string)
+	newHead := oldHead
+	for _, commit := range commits {
+		raw, _, err := p.runCommand("git", "cat-file", "commit", commit)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read commit %s: %v", shortHash(commit), err)
+		}
+		header, message, _ := strings.Cut(raw, "\n\n")
+
+		header, message, err = rewrite(commit, header, message)
+		if err != nil {
+			return nil, fmt.Errorf("failed to rewrite commit %s: %v", shortHash(commit), err)
+		}
+		newHash, err := p.writeCommit(rewriteCommitHeader(header, rewritten), message)
+		if err != nil {
+			return nil, fmt.Errorf("failed to rewrite commit %s: %v", shortHash(commit), err)
+		}
+		rewritten[commit] = newHash
+		newHead = newHash
+	}
+
+	if p.worktree != nil {
+		// The branch of the worktree is temporary; the user's branch
+		// follows it when the worktree is closed.
+		if err := p.moveHead(oldHead, newHead, reason); err != nil {
+			return nil, err
+		}
+		p.worktree.reasons = append(p.worktree.reasons, reason)
+		return rewritten, nil
+	}
+	if err := p.updateBranch(oldHead, newHead, reason); err != nil {
+		return nil, err
+	}
+	return rewritten, nil
+}
+
+// updateBranch moves the current branch from oldHead to newHead with
+// moveHead, after saving oldHead as a backup for publish undo.
+func (p *Publisher) updateBranch(oldHead, newHead, reason string) error {
+	backupRef, err := p.backupHead(oldHead, reason)
+	if err != nil {
+		return err
+	}
+	if err := p.moveHead(oldHead, newHead, reason); err != nil {
+		p.runCommand("git", "update-ref", "-d", backupRef, oldHead)
+		return err
+	}
+	p.logger.Info("Saved previous branch tip %s as %s; publish undo restores it", shortHash(oldHead), backupRef)
+	return nil
+}
+
+// commitsToRewrite returns first and the commits after it up to HEAD that
+// rewriting first recreates, oldest first. Only descendants of first need
+// to be recreated; commits merged in from elsewhere keep their hashes.
+func (p *Publisher) commitsToRewrite(first string) ([]string, error) {
+	out, _, err := p.runCommand("git", "rev-list", "--reverse", "--topo-order", "--ancestry-path", first+"..HEAD")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list commits to rewrite: %v", err)
+	}
+	return append([]string{first}, strings.Fields(out)...), nil
+}
+
+// checkRewritable refuses to rewrite commits, the first of which the others
+// descend from, if others may have them already: if they are on a
+// remote-tracking branch, other than the one the review backend pushes to
+// itself, or were merged through the review backend. With --force-rewrite
+// it only warns.
+func (p *Publisher) checkRewritable(commits []string) error {
+	backend := p.reviewBackend()
+	var published []string
+
+	// Any branch with one of the commits has the first one too.
+	refs, err := p.remoteBranchesWith(commits[0])
+	if err != nil {
+		return err
+	}
+	if len(refs) > 0 {
+		published = append(published, fmt.Sprintf("commit %s is already on %s", shortHash(commits[0]), strings.Join(refs, ", ")))
+	}
+
+	for _, commit := range commits {
+		merged, err := backend.mergedAs(commit)
+		if err != nil {
+			p.logger.Warn("Could not check whether the commits to rewrite were merged: %v", err)
+			break
+		}
+		if merged != "" {
+			subject, _, _ := p.runCommand("git", "log", "-1", "--format=%s", commit)
+			published = append(published, fmt.Sprintf("commit %s (%s) was %s", shortHash(commit), strings.TrimSpace(subject), merged))
+		}
+	}
+
+	if len(published) == 0 {
+		return nil
+	}
+	if p.forceRewrite {
+		for _, problem := range published {
+			p.logger.Warn("%s", capitalize(problem))
+		}
+		p.logger.Warn("Rewriting anyway as --force-rewrite was given")
+		return nil
+	}
+	for _, problem := range published {
+		p.logger.Error("%s", capitalize(problem))
+	}
+	return fmt.Errorf("refusing to rewrite %d commit(s) that others may already have; pass --force-rewrite to rewrite them anyway", len(commits))
+}
+
+// remoteBranchesWith returns the remote-tracking branches commit is on,
+// other than the one the review backend pushes to itself.
+func (p *Publisher) remoteBranchesWith(commit string) ([]string, error) {
+	out, _, err := p.runCommand("git", "for-each-ref", "--contains", commit, "--format=%(refname)", "refs/remotes/")
+	if err != nil {
+		return nil, fmt.Errorf("failed to find remote branches with commit %s: %v", shortHash(commit), err)
+	}
+	var refs []string
+	for _, ref := range strings.Fields(out) {
+		if ref == p.reviewBackend().pushedRef() || strings.HasSuffix(ref, "/HEAD") {
+			continue
+		}
+		refs = append(refs, strings.TrimPrefix(ref, "refs/remotes/"))
+	}
+	return refs, nil
+}
+
+// commitPublished describes how others may already have commit, as
+// checkRewritable does, or returns "" if they cannot.
+func (p *Publisher) commitPublished(commit string) (string, error) {
+	refs, err := p.remoteBranchesWith(commit)
+	if err != nil {
+		return "", err
+	}
+	if len(refs) > 0 {
+		return "is already on " + strings.Join(refs, ", "), nil
+	}
+	merged, err := p.reviewBackend().mergedAs(commit)
+	if err != nil {
+		return "", err
+	}
+	if merged != "" {
+		return "was " + merged, nil
+	}
+	return "", nil
+}
+
+// moveHead moves the current branch from oldHead to newHead, updating the
+// files of the checkout that differ between them. Local changes to those
+// files stop the move before anything is changed.
+func (p *Publisher) moveHead(oldHead, newHead, reason string) error {
+	oldTree := p.treeOf(oldHead)
+	newTree := p.treeOf(newHead)
+	inWorktree, _, _ := p.runCommand("git", "rev-parse", "--is-inside-work-tree")
+	syncCheckout := oldTree != newTree && strings.TrimSpace(inWorktree) == "true"
+
+	if syncCheckout {
+		// A two-way merge updates only the files that differ between the
+		// trees and refuses to overwrite local changes to them.
+		p.runCommand("git", "update-index", "-q", "--refresh")
+		if _, stderr, err := p.runCommand("git", "read-tree", "-m", "-u", oldHead, newHead); err != nil {
+			return fmt.Errorf("local changes conflict with rewriting the branch; commit or stash them first: %s", strings.TrimSpace(stderr))
+		}
+	}
+
+	// Move the branch only if nobody else moved it in the meantime.
+	if _, stderr, err := p.runCommand("git", "update-ref", "-m", reason, "HEAD", newHead, oldHead); err != nil {
+		if syncCheckout {
+			p.runCommand("git", "read-tree", "-m", "-u", newHead, oldHead)
+		}
+		return fmt.Errorf("failed to update HEAD: %v (stderr: %s)", err, stderr)
+	}
+	return nil
+}
+
+// treeOf returns the tree of a commit, or "" if it cannot be read.
+func (p *Publisher) treeOf(commit string) string {
+	out, _, err := p.runCommand("git", "rev-parse", commit+"^{tree}")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(out)
+}
+
+// rewriteCommit replaces commit, which must be an ancestor of HEAD, with one
+// whose tree has the edits applied. The commits after it are recreated on
+// top with the same edits applied to their trees, so that they keep them;
+// their own changes to the edited files are carried over. If message is not
+// nil, it gives the new message of commit from the old one; the messages of
+// the commits after it are kept. It returns the hash of the new commit.
+func (p *Publisher) rewriteCommit(commit string, edits []fileEdit, message func(string) (string, error), reason string) (string, error) {
+	full, _, err := p.runCommand("git", "rev-parse", "--verify", commit+"^{commit}")
+	if err != nil {
+		return "", fmt.Errorf("invalid commit reference: %s", commit)
+	}
+	commit = strings.TrimSpace(full)
+
+	rewritten, err := p.rewriteHistory(commit, reason, func(c, header, msg string) (string, string, error) {
+		tree, ok := commitHeaderField(header, "tree")
+		if !ok {
+			return "", "", fmt.Errorf("commit has no tree")
+		}
+		newTree, err := p.applyFileEdits(tree, edits)
+		if err != nil {
+			return "", "", err
+		}
+		if c == commit && message != nil {
+			if msg, err = message(msg); err != nil {
+				return "", "", err
+			}
+		}
+		return strings.Replace(header, "tree "+tree, "tree "+newTree, 1), msg, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return rewritten[commit], nil
+}
+
+// commitHeaderField returns the value of the first header line of a commit
+// object with the given key.
+func commitHeaderField(header, key string) (string, bool) {
+	for _, line := range strings.Split(header, "\n") {
+		if value, ok := strings.CutPrefix(line, key+" "); ok {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// followRewrite keeps following the commit being published after it was
+// rewritten. A commitRef of HEAD follows by itself.
+func (p *Publisher) followRewrite(published string, rewritten map[string]string) {
+	newHash, ok := rewritten[published]
+	if !ok {
+		return
+	}
+	if p.commitRef != "HEAD" {
+		p.commitRef = newHash
+	}
+	p.commitHash = newHash
+}
+
+// rewriteProposal applies the edits, and the message edit if not nil, to the
+// commit being published, as rewriteCommit does, and follows it to its new
+// hash.
+func (p *Publisher) rewriteProposal(edits []fileEdit, message func(string) (string, error), reason string) error {
+	published := p.commitHashFull()
+	newHash, err := p.rewriteCommit(published, edits, message, reason)
+	if err != nil {
+		return err
+	}
+	p.followRewrite(published, map[string]string{published: newHash})
+	return nil
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestSetTreeFile tests editing nested trees with git mktree
+func TestSetTreeFile(t *testing.T) {
+	repo := NewTestRepo(t)
+	defer repo.Cleanup()
+	repo.writeFile("designs/language/xxxx-aliases.md", "# Aliases\n")
+	repo.run("git", "add", "designs")
+	repo.run("git", "commit", "-m", "designs: add aliases")
+
+	oldDir, _ := os.Getwd()
+	os.Chdir(repo.dir)
+	defer os.Chdir(oldDir)
+
+	p := &Publisher{logger: NewLogger()}
+	tree := p.treeOf("HEAD")
+	blob := strings.TrimSpace(repo.run("git", "rev-parse", "HEAD:designs/language/xxxx-aliases.md"))
+
+	added, err := p.setTreeFile(tree, "designs/language/4014-aliases.md", "100644", blob)
+	if err != nil {
+		t.Fatalf("setTreeFile failed: %v", err)
+	}
+	removed, err := p.setTreeFile(added, "designs/language/xxxx-aliases.md", "", "")
+	if err != nil {
+		t.Fatalf("setTreeFile failed: %v", err)
+	}
+	got := repo.run("git", "ls-tree", "-r", "--name-only", removed)
+	if got != "README.md\ndesigns/language/4014-aliases.md\n" {
+		t.Errorf("Wrong files after rename:\n%s", got)
+	}
+
+	// Removing the last file of a directory removes the directory.
+	empty, err := p.setTreeFile(removed, "designs/language/4014-aliases.md", "", "")
+	if err != nil {
+		t.Fatalf("setTreeFile failed: %v", err)
+	}
+	if got := repo.run("git", "ls-tree", "-r", "--name-only", empty); got != "README.md\n" {
+		t.Errorf("Wrong files after removal:\n%s", got)
+	}
+}
+
+// TestRenameHistoricalCommit tests renaming a draft in a commit that is not
+// HEAD without using the index or worktree
+func TestRenameHistoricalCommit(t *testing.T) {
+	repo := NewTestRepo(t)
+	defer repo.Cleanup()
+
+	proposal := repo.createDraftProposal("aliases", "# Aliases\n\n*   **Author(s)**: test@\n*   **Discussion Channel**: TBD\n\nFirst draft.\n")
+
+	// A later commit changes the proposal, another one something else.
+	repo.writeFile("designs/language/xxxx-aliases.md", "# Aliases\n\n*   **Author(s)**: test@\n*   **Discussion Channel**: TBD\n\nSecond draft.\n")
+	repo.run("git", "commit", "-a", "-m", "designs: revise aliases\n\nChange-Id: "+testChangeID)
+	repo.writeFile("notes.txt", "notes\n")
+	repo.run("git", "add", "notes.txt")
+	repo.run("git", "commit", "-m", "add notes")
+	oldHead := repo.getCommitHash()
+
+	// Local changes to other files are left alone.
+	repo.writeFile("notes.txt", "work in progress\n")
+	repo.writeFile("README.md", "# Staged\n")
+	repo.run("git", "add", "README.md")
+
+	oldDir, _ := os.Getwd()
+	os.Chdir(repo.dir)
+	defer os.Chdir(oldDir)
+
+	publisher := &Publisher{
+		logger:           NewLogger(),
+		commitRef:        proposal,
+		commitHash:       proposal,
+		proposalFile:     "designs/language/xxxx-aliases.md",
+		basename:         "xxxx-aliases.md",
+		isDraft:          true,
+		discussionNumber: "4014",
+		discussionURL:    "https://github.com/cue-lang/cue/discussions/4014",
+	}
+	if err := publisher.renameProposal(); err != nil {
+		t.Fatalf("renameProposal failed: %v", err)
+	}
+	if err := publisher.commitDocumentEdits(); err != nil {
+		t.Fatalf("commitDocumentEdits failed: %v", err)
+	}
+
+	if publisher.commitRef == proposal {
+		t.Fatal("commitRef not moved to the rewritten commit")
+	}
+	if got := repo.run("git", "rev-list", "--count", publisher.commitRef+"..HEAD"); got != "2\n" {
+		t.Errorf("Expected 2 commits after the proposal, got %s", got)
+	}
+	if got := repo.run("git", "show", publisher.commitRef+":designs/language/4014-aliases.md"); !strings.Contains(got, "discussions/4014") || !strings.Contains(got, "First draft") {
+		t.Errorf("Wrong renamed proposal:\n%s", got)
+	}
+
+	// The later commits keep their changes, on top of the renamed file.
+	if got := repo.run("git", "show", "HEAD~1:designs/language/4014-aliases.md"); !strings.Contains(got, "discussions/4014") || !strings.Contains(got, "Second draft") {
+		t.Errorf("Later change to the proposal lost:\n%s", got)
+	}
+	if files := repo.run("git", "ls-tree", "-r", "--name-only", "HEAD", "designs"); files != "designs/language/4014-aliases.md\n" {
+		t.Errorf("Old file name still in HEAD:\n%s", files)
+	}
+	if msg := repo.run("git", "log", "-1", "--format=%B", "HEAD~1"); !strings.Contains(msg, testChangeID) {
+		t.Errorf("Change-Id of later commit lost:\n%s", msg)
+	}
+	if got := repo.run("git", "reflog", "-1", "--format=%gs", "HEAD"); !strings.Contains(got, "publish: rename proposal") {
+		t.Errorf("Wrong reflog entry: %s", got)
+	}
+
+	// The checkout follows the rename and keeps the local changes.
+	if !repo.fileExists("designs/language/4014-aliases.md") || repo.fileExists("designs/language/xxxx-aliases.md") {
+		t.Error("Checkout does not follow the rename")
+	}
+	if got := repo.readFile("notes.txt"); got != "work in progress\n" {
+		t.Errorf("Worktree change lost: %q", got)
+	}
+	status := repo.run("git", "status", "--porcelain")
+	if status != "M  README.md\n M notes.txt\n" {
+		t.Errorf("Unexpected status:\n%s", status)
+	}
+	if oldHead == repo.getCommitHash() {
+		t.Error("Branch not moved")
+	}
+}
+
+// TestUpdateDiscussionLinkHistorical tests filling in the discussion link of
+// a numbered proposal in a commit that is not HEAD
+func TestUpdateDiscussionLinkHistorical(t *testing.T) {
+	repo := NewTestRepo(t)
+	defer repo.Cleanup()
+
+	repo.writeFile("designs/language/4014-aliases.md", "# Aliases\n\n*   **Discussion Channel**: {link}\n")
+	repo.run("git", "add", "designs")
+	repo.run("git", "commit", "-m", "designs: add aliases\n\nChange-Id: "+testChangeID)
+	proposal := repo.getCommitHash()
+
+	repo.writeFile("notes.txt", "notes\n")
+	repo.run("git", "add", "notes.txt")
+	repo.run("git", "commit", "-m", "add notes\n\nChange-Id: I1111111111111111111111111111111111111111")
+
+	oldDir, _ := os.Getwd()
+	os.Chdir(repo.dir)
+	defer os.Chdir(oldDir)
+
+	publisher := &Publisher{
+		logger:           NewLogger(),
+		commitRef:        proposal,
+		commitHash:       proposal,
+		proposalFile:     "designs/language/4014-aliases.md",
+		isNumbered:       true,
+		discussionNumber: "4014",
+		discussionURL:    "https://github.com/cue-lang/cue/discussions/4014",
+	}
+	if err := publisher.updateDiscussionLink(); err != nil {
+		t.Fatalf("updateDiscussionLink failed: %v", err)
+	}
+	if err := publisher.commitDocumentEdits(); err != nil {
+		t.Fatalf("commitDocumentEdits failed: %v", err)
+	}
+
+	want := "*   **Discussion Channel**: https://github.com/cue-lang/cue/discussions/4014\n"
+	for _, rev := range []string{publisher.commitRef, "HEAD"} {
+		if got := repo.run("git", "show", rev+":designs/language/4014-aliases.md"); !strings.Contains(got, want) {
+			t.Errorf("Link not filled in at %s:\n%s", rev, got)
+		}
+	}
+	if parent := strings.TrimSpace(repo.run("git", "rev-parse", "HEAD^")); parent != publisher.commitRef {
+		t.Errorf("HEAD^ is %s, want the rewritten commit %s", parent, publisher.commitRef)
+	}
+	if msg := repo.run("git", "log", "-1", "--format=%B", publisher.commitRef); !strings.Contains(msg, "Change-Id: "+testChangeID) {
+		t.Errorf("Change-Id lost:\n%s", msg)
+	}
+	if msg := repo.run("git", "log", "-1", "--format=%B", "HEAD"); !strings.Contains(msg, "Change-Id: I1111111111111111111111111111111111111111") {
+		t.Errorf("Change-Id of later commit lost:\n%s", msg)
+	}
+	if got := repo.readFile("designs/language/4014-aliases.md"); got != "# Aliases\n\n"+want {
+		t.Errorf("Checkout not updated: %q", got)
+	}
+
+	// Publishing again leaves the commit alone.
+	rewritten := publisher.commitRef
+	if err := publisher.updateDiscussionLink(); err != nil {
+		t.Fatalf("updateDiscussionLink failed: %v", err)
+	}
+	if err := publisher.commitDocumentEdits(); err != nil {
+		t.Fatalf("commitDocumentEdits failed: %v", err)
+	}
+	if publisher.commitRef != rewritten {
+		t.Error("Commit rewritten again although the link is filled in")
+	}
+}
+
+// TestRewriteConflictingChanges tests that local changes to the edited file
+// stop a rewrite before anything is changed
+func TestRewriteConflictingChanges(t *testing.T) {
+	repo := NewTestRepo(t)
+	defer repo.Cleanup()
+
+	repo.createDraftProposal("aliases", "# Aliases\n\n*   **Discussion Channel**: TBD\n")
+	oldHead := repo.getCommitHash()
+	repo.writeFile("designs/language/xxxx-aliases.md", "# Aliases, edited\n")
+
+	oldDir, _ := os.Getwd()
+	os.Chdir(repo.dir)
+	defer os.Chdir(oldDir)
+
+	publisher := &Publisher{logger: NewLogger(), commitRef: "HEAD"}
+	edit := fileEdit{path: "designs/language/xxxx-aliases.md", newPath: "designs/language/4014-aliases.md"}
+	if err := publisher.rewriteProposal([]fileEdit{edit}, nil, "publish: test"); err == nil || !strings.Contains(err.Error(), "local changes") {
+		t.Errorf("Expected local changes error, got: %v", err)
+	}
+
+	if repo.getCommitHash() != oldHead {
+		t.Error("Branch moved despite the conflict")
+	}
+	if got := repo.readFile("designs/language/xxxx-aliases.md"); got != "# Aliases, edited\n" {
+		t.Errorf("Local change lost: %q", got)
+	}
+}
+
+// TestRewritePublishedCommits tests that commits on remote branches or
+// merged on Gerrit are only rewritten with --force-rewrite
+func TestRewritePublishedCommits(t *testing.T) {
+	edit := fileEdit{
+		path: "designs/language/4014-aliases.md",
+		edit: func(content string) (string, error) { return content + "Edited.\n", nil },
+	}
+
+	t.Run("RemoteBranch", func(t *testing.T) {
+		repo := NewTestRepo(t)
+		defer repo.Cleanup()
+		remote := filepath.Join(t.TempDir(), "proposal.git")
+		repo.run("git", "init", "--bare", remote)
+		repo.run("git", "remote", "add", "origin", remote)
+		repo.createNumberedProposal("4014", "aliases", "# Aliases\n")
+		repo.run("git", "push", "-q", "origin", "HEAD:refs/heads/shared")
+		oldHead := repo.getCommitHash()
+
+		oldDir, _ := os.Getwd()
+		os.Chdir(repo.dir)
+		defer os.Chdir(oldDir)
+
+		publisher := &Publisher{logger: NewLogger(), commitRef: "HEAD"}
+		err := publisher.rewriteProposal([]fileEdit{edit}, nil, "publish: test")
+		if err == nil || !strings.Contains(err.Error(), "--force-rewrite") {
+			t.Errorf("Expected refusal, got: %v", err)
+		}
+		if repo.getCommitHash() != oldHead {
+			t.Error("Branch rewritten despite the remote branch")
+		}
+
+		publisher.forceRewrite = true
+		if err := publisher.rewriteProposal([]fileEdit{edit}, nil, "publish: test"); err != nil {
+			t.Fatalf("rewriteProposal with --force-rewrite failed: %v", err)
+		}
+		if repo.getCommitHash() == oldHead {
+			t.Error("Branch not rewritten with --force-rewrite")
+		}
+	})
+
+	t.Run("PullRequestBranch", func(t *testing.T) {
+		repo := NewTestRepo(t)
+		defer repo.Cleanup()
+		remote := filepath.Join(t.TempDir(), "proposal.git")
+		repo.run("git", "init", "--bare", remote)
+		repo.run("git", "remote", "add", "origin", remote)
+		repo.createNumberedProposal("4014", "aliases", "# Aliases\n")
+		repo.run("git", "push", "-q", "origin", "HEAD:refs/heads/proposal/4014-aliases")
+
+		oldDir, _ := os.Getwd()
+		os.Chdir(repo.dir)
+		defer os.Chdir(oldDir)
+
+		// The branch of the pull request is force-pushed on every update.
+		publisher := &Publisher{logger: NewLogger(), commitRef: "HEAD", proposalFile: "designs/language/4014-aliases.md"}
+		if err := publisher.setReviewBackend(backendGitHub); err != nil {
+			t.Fatal(err)
+		}
+		if err := publisher.rewriteProposal([]fileEdit{edit}, nil, "publish: test"); err != nil {
+			t.Errorf("rewriteProposal failed: %v", err)
+		}
+	})
+
+	t.Run("MergedOnGerrit", func(t *testing.T) {
+		gerrit := newFakeGerrit(t)
+		gerrit.addChange(testChangeID, 4321, 3, "MERGED")
+		t.Setenv("NETRC", filepath.Join(t.TempDir(), "netrc"))
+
+		repo := newGerritTestRepo(t, gerrit)
+		defer repo.Cleanup()
+		oldHead := repo.getCommitHash()
+
+		oldDir, _ := os.Getwd()
+		os.Chdir(repo.dir)
+		defer os.Chdir(oldDir)
+
+		publisher := &Publisher{logger: NewLogger(), commitRef: "HEAD"}
+		err := publisher.rewriteProposal([]fileEdit{edit}, nil, "publish: test")
+		if err == nil || !strings.Contains(err.Error(), "--force-rewrite") {
+			t.Errorf("Expected refusal, got: %v", err)
+		}
+		if repo.getCommitHash() != oldHead {
+			t.Error("Branch rewritten despite the merged CL")
+		}
+
+		// A change that is still open can be amended.
+		gerrit.addChange(testChangeID, 4321, 3, "NEW")
+		if err := publisher.rewriteProposal([]fileEdit{edit}, nil, "publish: test"); err != nil {
+			t.Errorf("rewriteProposal failed: %v", err)
+		}
+	})
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// proposalRepoURL is the GitHub repository the proposal documents live in.
+const proposalRepoURL = "https://github.com/cue-lang/proposal"
+
+// linkRewriter turns the relative links and images of a proposal document
+// into absolute URLs, so that content copied out of the repository (for
+// instance into a GitHub discussion) keeps working.
+//
+// All URLs are pinned to a single commit, so that they continue to refer to
+// the revision that was published even after the document changes.
+type linkRewriter struct {
+	repoURL string // e.g. https://github.com/cue-lang/proposal
+	commit  string // full commit hash the links are pinned to
+	file    string // repository path of the document being rewritten
+}
+
+var (
+	// inlineLinkPattern matches inline links and images: [text](target) and
+	// ![alt](target "title"). The target is captured up to the first
+	// whitespace or closing parenthesis.
+	inlineLinkPattern = regexp.MustCompile(`(!?)\[((?:[^\[\]]|\[[^\[\]]*\])*)\]\(\s*(<[^>]*>|[^\s)]*)([^)]*)\)`)
+
+	// refDefinitionPattern matches link reference definitions: [id]: target
+	refDefinitionPattern = regexp.MustCompile(`^(\s{0,3}\[[^\]]+\]:\s*)(<[^>]*>|\S+)(.*)$`)
+
+	// schemePattern matches targets that carry a URL scheme.
+	schemePattern = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9+.-]*:`)
+)
+
+// rewrite returns markdown with all relative link and image targets
+// replaced by absolute URLs. Code spans and fenced code blocks are left
+// untouched.
+func (r *linkRewriter) rewrite(markdown string) string {
+	lines := strings.Split(markdown, "\n")
+	inFence := false
+	fence := ""
+
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if inFence {
+			if strings.HasPrefix(trimmed, fence) {
+				inFence = false
+			}
+			continue
+		}
+		if strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~") {
+			inFence = true
+			fence = trimmed[:3]
+			continue
+		}
+
+		if m := refDefinitionPattern.FindStringSubmatch(line); m != nil {
+			// Reference definitions are used by both links and images;
+			// treat the target as an image only if it looks like one.
+			target := r.resolve(m[2], isImagePath(m[2]))
+			lines[i] = m[1] + target + m[3]
+			continue
+		}
+
+		lines[i] = r.rewriteLine(line)
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// rewriteLine rewrites inline links and images in a single line, skipping
+// anything inside code spans.
+func (r *linkRewriter) rewriteLine(line string) string {
+	var b strings.Builder
+	for line != "" {
+		// Copy code spans verbatim.
+		start := strings.Index(line, "`")
+		if start < 0 {
+			b.WriteString(r.rewriteText(line))
+			break
+		}
+		b.WriteString(r.rewriteText(line[:start]))
+		line = line[start:]
+
+		ticks := len(line) - len(strings.TrimLeft(line, "`"))
+		end := strings.Index(line[ticks:], line[:ticks])
+		if end < 0 {
+			b.WriteString(line)
+			break
+		}
+		end += 2 * ticks
+		b.WriteString(line[:end])
+		line = line[end:]
+	}
+	return b.String()
+}
+
+// rewriteText rewrites inline links and images in text without code spans.
+func (r *linkRewriter) rewriteText(text string) string {
+	return inlineLinkPattern.ReplaceAllStringFunc(text, func(match string) string {
+		m := inlineLinkPattern.FindStringSubmatch(match)
+		image, label, target, rest := m[1] == "!", m[2], m[3], m[4]
+		if image {
+			// Links in the alt text of an image are not rendered.
+			return fmt.Sprintf("![%s](%s%s)", label, r.resolve(target, true), rest)
+		}
+		return fmt.Sprintf("[%s](%s%s)", r.rewriteText(label), r.resolve(target, false), rest)
+	})
+}
+
+// resolve returns the absolute URL for a link target. Targets that are
+// already absolute are returned unchanged.
+func (r *linkRewriter) resolve(target string, image bool) string {
+	bracketed := strings.HasPrefix(target, "<") && strings.HasSuffix(target, ">")
+	if bracketed {
+		target = target[1 : len(target)-1]
+	}
+
+	resolved := r.resolveTarget(target, image)
+	if bracketed {
+		return "<" + resolved + ">"
+	}
+	return resolved
+}
+
+func (r *linkRewriter) resolveTarget(target string, image bool) string {
+	if target == "" || schemePattern.MatchString(target) || strings.HasPrefix(target, "//") {
+		return target
+	}
+
+	if strings.HasPrefix(target, "#") {
+		return r.blobURL(r.file) + target
+	}
+
+	filePath, fragment, _ := strings.Cut(target, "#")
+	filePath, query, _ := strings.Cut(filePath, "?")
+	if unescaped, err := url.PathUnescape(filePath); err == nil {
+		filePath = unescaped
+	}
+
+	if strings.HasPrefix(filePath, "/") {
+		filePath = path.Clean(strings.TrimPrefix(filePath, "/"))
+	} else {
+		filePath = path.Join(path.Dir(r.file), filePath)
+	}
+
+	var resolved string
+	if image {
+		resolved = r.rawURL(filePath)
+	} else {
+		resolved = r.blobURL(filePath)
+	}
+	if query != "" {
+		resolved += "?" + query
+	}
+	if fragment != "" {
+		resolved += "#" + fragment
+	}
+	return resolved
+}
+
+// blobURL returns the GitHub page for file at the pinned commit.
+func (r *linkRewriter) blobURL(file string) string {
+	return fmt.Sprintf("%s/blob/%s/%s", r.repoURL, r.commit, escapePath(file))
+}
+
+// rawURL returns the raw file contents URL for file at the pinned commit,
+// which is what images need to render.
+func (r *linkRewriter) rawURL(file string) string {
+	return fmt.Sprintf("%s/raw/%s/%s", r.repoURL, r.commit, escapePath(file))
+}
+
+// escapePath escapes each segment of a slash-separated repository path.
+func escapePath(p string) string {
+	segments := strings.Split(p, "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+	return strings.Join(segments, "/")
+}
+
+// isImagePath reports whether target refers to a file with an image
+// extension.
+func isImagePath(target string) bool {
+	target, _, _ = strings.Cut(target, "#")
+	target, _, _ = strings.Cut(target, "?")
+	switch strings.ToLower(path.Ext(strings.Trim(target, "<>"))) {
+	case ".png", ".jpg", ".jpeg", ".gif", ".svg", ".webp":
+		return true
+	}
+	return false
+}
+
+// documentLinks returns the Markdown links to a published document: a link
+// to the latest version on the default branch and a permalink to the exact
+// commit that was published.
+//
+// The permalink only resolves once the commit has reached the public GitHub
+// mirror, which does not happen before the change is merged. Until then
+// onMirror should be false, and reviewFileURL, the URL of the file in the
+// revision under review, is linked instead if it is known.
+func documentLinks(file, commit string, onMirror bool, reviewFileURL string) string {
+	latest := fmt.Sprintf("%s/blob/main/%s", proposalRepoURL, escapePath(file))
+	links := fmt.Sprintf("[%s](%s) (latest)", file, latest)
+
+	switch {
+	case onMirror:
+		pinned := &linkRewriter{repoURL: proposalRepoURL, commit: commit}
+		links += fmt.Sprintf(" · [permalink](%s) (%s)", pinned.blobURL(file), shortHash(commit))
+	case reviewFileURL != "":
+		links += fmt.Sprintf(" · [revision under review](%s) (%s)", reviewFileURL, shortHash(commit))
+	}
+	return links
+}
+
+// shortHash abbreviates a commit hash for display.
+func shortHash(commit string) string {
+	if len(commit) > 12 {
+		return commit[:12]
+	}
+	return commit
+}
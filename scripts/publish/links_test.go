@@ -0,0 +1,104 @@
+package main
+
+import "testing"
+
+// TestLinkRewriter tests turning relative links into absolute URLs
+func TestLinkRewriter(t *testing.T) {
+	const commit = "0123456789abcdef0123456789abcdef01234567"
+	rewriter := &linkRewriter{
+		repoURL: proposalRepoURL,
+		commit:  commit,
+		file:    "designs/language/4014-aliases-v2.md",
+	}
+	blob := proposalRepoURL + "/blob/" + commit + "/"
+	raw := proposalRepoURL + "/raw/" + commit + "/"
+
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{{
+		name: "SiblingFile",
+		in:   "See [validators](./4019-try.md).",
+		want: "See [validators](" + blob + "designs/language/4019-try.md).",
+	}, {
+		name: "ParentFile",
+		in:   "See [functions](../4293-user-functions-and-validators.md#detailed-design).",
+		want: "See [functions](" + blob + "designs/4293-user-functions-and-validators.md#detailed-design).",
+	}, {
+		name: "RootRelative",
+		in:   "Read the [README](/README.md).",
+		want: "Read the [README](" + blob + "README.md).",
+	}, {
+		name: "Anchor",
+		in:   "As described in [the design](#detailed-design).",
+		want: "As described in [the design](" + blob + "designs/language/4014-aliases-v2.md#detailed-design).",
+	}, {
+		name: "Image",
+		in:   `![diagram](images/flow.png "Flow")`,
+		want: `![diagram](` + raw + `designs/language/images/flow.png "Flow")`,
+	}, {
+		name: "ImageInsideLink",
+		in:   "[![badge](badge.svg)](./4019-try.md)",
+		want: "[![badge](" + raw + "designs/language/badge.svg)](" + blob + "designs/language/4019-try.md)",
+	}, {
+		name: "Absolute",
+		in:   "See [issue](https://github.com/cue-lang/cue/issues/1) and [mail](mailto:a@b.c).",
+		want: "See [issue](https://github.com/cue-lang/cue/issues/1) and [mail](mailto:a@b.c).",
+	}, {
+		name: "ReferenceDefinition",
+		in:   "[try]: ./4019-try.md\n[img]: ./img.png",
+		want: "[try]: " + blob + "designs/language/4019-try.md\n[img]: " + raw + "designs/language/img.png",
+	}, {
+		name: "CodeSpan",
+		in:   "Write `[x](./y.md)` to link, or [y](./y.md).",
+		want: "Write `[x](./y.md)` to link, or [y](" + blob + "designs/language/y.md).",
+	}, {
+		name: "FencedCode",
+		in:   "```\n[x](./y.md)\n```\n[y](./y.md)",
+		want: "```\n[x](./y.md)\n```\n[y](" + blob + "designs/language/y.md)",
+	}, {
+		name: "EscapedPath",
+		in:   "[doc](<my doc.md>)",
+		want: "[doc](<" + blob + "designs/language/my%20doc.md>)",
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rewriter.rewrite(tt.in); got != tt.want {
+				t.Errorf("rewrite(%q)\ngot:  %q\nwant: %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestDocumentLinks tests the latest and pinned links to a document
+func TestDocumentLinks(t *testing.T) {
+	const (
+		file   = "designs/language/4014-aliases-v2.md"
+		commit = "0123456789abcdef0123456789abcdef01234567"
+		latest = "[designs/language/4014-aliases-v2.md](https://github.com/cue-lang/proposal/blob/main/designs/language/4014-aliases-v2.md) (latest)"
+	)
+
+	t.Run("OnMirror", func(t *testing.T) {
+		got := documentLinks(file, commit, true, "")
+		want := latest + " · [permalink](https://github.com/cue-lang/proposal/blob/" + commit + "/" + file + ") (0123456789ab)"
+		if got != want {
+			t.Errorf("got:  %s\nwant: %s", got, want)
+		}
+	})
+
+	t.Run("UnderReview", func(t *testing.T) {
+		got := documentLinks(file, commit, false, "https://review.gerrithub.io/c/cue-lang/proposal/+/12345/3/"+file)
+		want := latest + " · [revision under review](https://review.gerrithub.io/c/cue-lang/proposal/+/12345/3/" + file + ") (0123456789ab)"
+		if got != want {
+			t.Errorf("got:  %s\nwant: %s", got, want)
+		}
+	})
+
+	t.Run("NoReview", func(t *testing.T) {
+		if got := documentLinks(file, commit, false, ""); got != latest {
+			t.Errorf("got:  %s\nwant: %s", got, latest)
+		}
+	})
+}
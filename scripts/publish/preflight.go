@@ -0,0 +1,235 @@
+package main
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+// validChangeIDPattern matches a well-formed Change-Id trailer line.
+var validChangeIDPattern = regexp.MustCompile(`^Change-Id: I[0-9a-f]{40}$`)
+
+// checkChangeID reports what is wrong with the Change-Id trailers of a
+// commit message, or "" if it has exactly one valid Change-Id.
+func checkChangeID(message string) string {
+	var valid, invalid int
+	for _, line := range strings.Split(message, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(strings.ToLower(line), "change-id:") {
+			continue
+		}
+		if validChangeIDPattern.MatchString(line) {
+			valid++
+		} else {
+			invalid++
+		}
+	}
+	switch {
+	case invalid > 0:
+		return "malformed Change-Id"
+	case valid == 0:
+		return "no Change-Id"
+	case valid > 1:
+		return "more than one Change-Id"
+	}
+	return ""
+}
+
+// mailedCommits returns the commits git codereview mail sends for review
+// when mailing the commit being published: those between the upstream
+// branch and the commit, oldest first.
+func (p *Publisher) mailedCommits() ([]string, error) {
+	var upstream string
+	candidates := []string{"@{upstream}", "origin/master", "origin/main"}
+	for _, c := range candidates {
+		if out, _, err := p.runCommand("git", "rev-parse", "--verify", "--quiet", c); err == nil {
+			upstream = strings.TrimSpace(out)
+			break
+		}
+	}
+	if upstream == "" {
+		// No upstream to compare with; at least check the commit itself.
+		hash, _, err := p.runCommand("git", "rev-parse", p.commitRef)
+		if err != nil {
+			return nil, fmt.Errorf("invalid commit reference: %s", p.commitRef)
+		}
+		return []string{strings.TrimSpace(hash)}, nil
+	}
+
+	out, _, err := p.runCommand("git", "rev-list", "--reverse", upstream+".."+p.commitRef)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list commits to mail: %v", err)
+	}
+	return strings.Fields(out), nil
+}
+
+// commitMsgHookInstalled reports whether the commit-msg hook that adds
+// Change-Ids is installed.
+func (p *Publisher) commitMsgHookInstalled() bool {
+	hook, _, err := p.runCommand("git", "rev-parse", "--git-path", "hooks/commit-msg")
+	if err != nil {
+		return false
+	}
+	info, err := os.Stat(strings.TrimSpace(hook))
+	return err == nil && info.Mode()&0111 != 0
+}
+
+// checkChangeIDs checks that the commits to be mailed can be reviewed on
+// Gerrit: every commit needs a valid Change-Id, which the commit-msg hook
+// installed by "git codereview hooks" adds. Missing Change-Ids can be added
+// on request.
+func (p *Publisher) checkChangeIDs() error {
+	if !p.commitMsgHookInstalled() {
+		p.logger.Warn("The git codereview commit-msg hook is not installed; new commits will lack a Change-Id")
+		install := false
+		if !p.dryRun {
+			var err error
+			if install, err = p.confirm("Install it now with git codereview hooks? [y/N] "); err != nil {
+				return err
+			}
+		}
+		if install {
+			if _, stderr, err := p.runCommand("git", "codereview", "hooks"); err != nil {
+				return fmt.Errorf("failed to install hooks: %v (stderr: %s)", err, stderr)
+			}
+			p.logger.Success("Installed git codereview hooks")
+		}
+	}
+
+	commits, err := p.mailedCommits()
+	if err != nil {
+		return err
+	}
+
+	var missing []string
+	for _, commit := range commits {
+		message, _, err := p.runCommand("git", "log", "-1", "--format=%B", commit)
+		if err != nil {
+			return fmt.Errorf("failed to get commit message of %s: %v", shortHash(commit), err)
+		}
+		if problem := checkChangeID(message); problem != "" {
+			subject, _, _ := strings.Cut(strings.TrimSpace(message), "\n")
+			p.logger.Error("Commit %s (%s) has %s", shortHash(commit), subject, problem)
+			if problem != "no Change-Id" {
+				return fmt.Errorf("commit %s has %s; fix its message before publishing", shortHash(commit), problem)
+			}
+			missing = append(missing, commit)
+		}
+	}
+
+	if len(missing) == 0 {
+		p.logger.Success("All %d commit(s) to be mailed have a Change-Id", len(commits))
+		return nil
+	}
+	if p.dryRun {
+		p.logger.Info("[DRY RUN] Would offer to add a Change-Id to %d commit(s)", len(missing))
+		return nil
+	}
+	add, err := p.confirm(fmt.Sprintf("Add a Change-Id to %d commit(s)? This rewrites them. [y/N] ", len(missing)))
+	if err != nil {
+		return err
+	}
+	if !add {
+		return fmt.Errorf("%d commit(s) have no Change-Id; run git codereview hooks and amend them", len(missing))
+	}
+	return p.addChangeIDs(missing)
+}
+
+// confirm asks the user a yes/no question. Without a terminal to ask on, the
+// answer is no.
+func (p *Publisher) confirm(question string) (bool, error) {
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return false, nil
+	}
+	answer, err := p.ask("%s", question)
+	if err != nil {
+		return false, err
+	}
+	answer = strings.ToLower(answer)
+	return answer == "y" || answer == "yes", nil
+}
+
+// addChangeIDs adds a Change-Id to each of the given commits, which must be
+// ancestors of HEAD. The commits from the first of them up to HEAD are
+// recreated with the same trees, so the index and worktree stay as they
+// are, and the current branch is moved to the new HEAD.
+func (p *Publisher) addChangeIDs(missing []string) error {
+	needsID := make(map[string]bool)
+	for _, c := range missing {
+		// Only descendants of the first commit are recreated.
+		if _, _, err := p.runCommand("git", "merge-base", "--is-ancestor", missing[0], c); err != nil {
+			return fmt.Errorf("commit %s does not descend from %s; add its Change-Id by hand", shortHash(c), shortHash(missing[0]))
+		}
+		needsID[c] = true
+	}
+
+	published := p.commitHashFull()
+	rewritten, err := p.rewriteHistory(missing[0], "publish: add Change-Id", func(commit, header, message string) (string, string, error) {
+		if !needsID[commit] {
+			return header, message, nil
+		}
+		raw := header + "\n\n" + message
+		id := fmt.Sprintf("I%x", sha1.Sum([]byte(raw)))
+		message, _, err := p.runCommandInput(message, "git", "interpret-trailers", "--no-divider", "--trailer", "Change-Id: "+id)
+		if err != nil {
+			return "", "", fmt.Errorf("failed to add Change-Id: %v", err)
+		}
+		return header, message, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	p.followRewrite(published, rewritten)
+	newHead, _, _ := p.runCommand("git", "rev-parse", "HEAD")
+	p.logger.Success("Added a Change-Id to %d commit(s); HEAD is now %s", len(missing), shortHash(strings.TrimSpace(newHead)))
+	return nil
+}
+
+// rewriteCommitHeader returns a commit object header with its parents
+// replaced according to rewritten. Signatures no longer match the new
+// content and are dropped.
+func rewriteCommitHeader(header string, rewritten map[string]string) string {
+	var lines []string
+	inSignature := false
+	for _, line := range strings.Split(header, "\n") {
+		if inSignature && strings.HasPrefix(line, " ") {
+			continue
+		}
+		inSignature = false
+		if strings.HasPrefix(line, "gpgsig ") || strings.HasPrefix(line, "gpgsig-sha256 ") {
+			inSignature = true
+			continue
+		}
+		if parent, ok := strings.CutPrefix(line, "parent "); ok {
+			if newParent, ok := rewritten[parent]; ok {
+				line = "parent " + newParent
+			}
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// writeCommit writes a commit object with the given header and message and
+// returns its hash.
+func (p *Publisher) writeCommit(header, message string) (string, error) {
+	out, stderr, err := p.runCommandInput(header+"\n\n"+message, "git", "hash-object", "-t", "commit", "-w", "--stdin")
+	if err != nil {
+		return "", fmt.Errorf("%v (stderr: %s)", err, stderr)
+	}
+	return strings.TrimSpace(out), nil
+}
+
+// commitHashFull returns the full hash of the commit being published.
+func (p *Publisher) commitHashFull() string {
+	out, _, err := p.runCommand("git", "rev-parse", p.commitRef)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(out)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+// TestCheckChangeID tests validating the Change-Id trailer
+func TestCheckChangeID(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+		want    string
+	}{
+		{"Valid", "designs: add aliases\n\nChange-Id: " + testChangeID + "\n", ""},
+		{"Missing", "designs: add aliases\n\nSigned-off-by: Gopher <gopher@example.com>\n", "no Change-Id"},
+		{"Short", "designs: add aliases\n\nChange-Id: I0123\n", "malformed Change-Id"},
+		{"Uppercase", "designs: add aliases\n\nChange-Id: " + strings.ToUpper(testChangeID) + "\n", "malformed Change-Id"},
+		{"Twice", "x\n\nChange-Id: " + testChangeID + "\nChange-Id: " + testChangeID + "\n", "more than one Change-Id"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := checkChangeID(tt.message); got != tt.want {
+				t.Errorf("Got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestPreflight tests checking and adding Change-Ids of the commits to be
+// mailed
+func TestPreflight(t *testing.T) {
+	repo := NewTestRepo(t)
+	defer repo.Cleanup()
+
+	// Everything from here on is ahead of upstream.
+	repo.run("git", "update-ref", "refs/remotes/origin/master", "HEAD")
+
+	repo.writeFile("designs/language/xxxx-aliases.md", "# Aliases\n")
+	repo.run("git", "add", "designs")
+	repo.run("git", "commit", "-m", "designs: add aliases\n\nSigned-off-by: Gopher <gopher@example.com>")
+	proposal := repo.getCommitHash()
+
+	repo.writeFile("notes.txt", "notes\n")
+	repo.run("git", "add", "notes.txt")
+	repo.run("git", "commit", "-m", "add notes\n\nChange-Id: "+testChangeID)
+
+	// Uncommitted changes must survive the rewrite.
+	repo.writeFile("notes.txt", "work in progress\n")
+
+	oldDir, _ := os.Getwd()
+	os.Chdir(repo.dir)
+	defer os.Chdir(oldDir)
+
+	publisher := &Publisher{logger: NewLogger(), commitRef: proposal, commitHash: proposal}
+
+	t.Run("Missing", func(t *testing.T) {
+		commits, err := publisher.mailedCommits()
+		if err != nil || len(commits) != 1 || commits[0] != proposal {
+			t.Fatalf("Wrong commits to mail: %v, %v", commits, err)
+		}
+		// Tests do not run on a terminal, so the offer is declined.
+		if err := publisher.preflight(); err == nil || !strings.Contains(err.Error(), "no Change-Id") {
+			t.Errorf("Expected missing Change-Id error, got: %v", err)
+		}
+	})
+
+	t.Run("Add", func(t *testing.T) {
+		oldTree := strings.TrimSpace(repo.run("git", "rev-parse", proposal+"^{tree}"))
+
+		if err := publisher.addChangeIDs([]string{proposal}); err != nil {
+			t.Fatalf("addChangeIDs failed: %v", err)
+		}
+
+		if publisher.commitRef == proposal {
+			t.Fatal("commitRef not moved to the rewritten commit")
+		}
+		message := repo.run("git", "log", "-1", "--format=%B", publisher.commitRef)
+		if problem := checkChangeID(message); problem != "" {
+			t.Errorf("Rewritten commit has %s:\n%s", problem, message)
+		}
+		if i, j := strings.Index(message, "Signed-off-by"), strings.Index(message, "Change-Id"); i > j {
+			t.Errorf("Change-Id should follow existing trailers:\n%s", message)
+		}
+		if tree := strings.TrimSpace(repo.run("git", "rev-parse", publisher.commitRef+"^{tree}")); tree != oldTree {
+			t.Errorf("Tree changed: %s, want %s", tree, oldTree)
+		}
+
+		// The later commit is rebuilt on top, keeping its Change-Id.
+		if parent := strings.TrimSpace(repo.run("git", "rev-parse", "HEAD^")); parent != publisher.commitRef {
+			t.Errorf("HEAD^ is %s, want %s", parent, publisher.commitRef)
+		}
+		if head := repo.run("git", "log", "-1", "--format=%B", "HEAD"); !strings.Contains(head, testChangeID) {
+			t.Errorf("Later commit lost its Change-Id:\n%s", head)
+		}
+
+		if got := repo.readFile("notes.txt"); got != "work in progress\n" {
+			t.Errorf("Worktree changed: %q", got)
+		}
+		if status := repo.run("git", "status", "--porcelain"); strings.TrimSpace(status) != "M notes.txt" {
+			t.Errorf("Unexpected status:\n%s", status)
+		}
+
+		if err := publisher.preflight(); err != nil {
+			t.Errorf("preflight failed after adding Change-Id: %v", err)
+		}
+	})
+}
@@ -1,21 +1,46 @@
 // Command publish automates the CUE proposal publication workflow.
 //
-// Usage: go run publish.go [--dry-run] [commit-ref]
+// Usage: go run . [--dry-run] [--wait] [commit-ref]
 //
 // This command automates the complete workflow for publishing a CUE proposal:
 //  1. Finds the proposal file in the specified commit (or HEAD if not specified)
+//     and checks that the commits to be mailed have a Change-Id
 //  2. Runs tests to ensure the proposal is ready
 //  3. Creates a GitHub discussion (for draft proposals)
 //  4. Renames the proposal file with the discussion number (for drafts)
 //  5. Submits the commit through git codereview
-//  6. Runs trybots and waits for confirmation
-//  7. Waits for CL approval and submission
-//  8. Updates the GitHub discussion with proposal summary
+//  6. Updates the GitHub discussion with proposal summary and CL link
+//  7. Posts a review message on the CL linking the discussion
+//  8. Runs trybots and waits for confirmation
+//  9. With --wait, waits for CL approval and submission and updates the
+//     discussion with the final state
+//
+// The finalize subcommand performs the last step on its own, for a proposal
+// that was published without --wait:
+//
+//	go run . finalize [--poll-interval d] [--timeout d] [commit-ref]
+//
+// The sync-review subcommand posts a digest of the Gerrit comment threads on
+// the proposal to its discussion:
+//
+//	go run . sync-review [--dry-run] [commit-ref]
+//
+// The status subcommand reports discussions that have drifted from the
+// proposals in the repository:
+//
+//	go run . status [--all] [NNNN|file]
+//
+// Before rewriting history, publish saves the branch tip under
+// refs/proposal-publish/backup/. The undo subcommand restores the latest
+// backup, or a named one, and the backups subcommand lists and prunes them:
+//
+//	go run . undo [--dry-run] [backup]
+//	go run . backups [--prune [--keep n] [--older-than d]]
 package main
 
 import (
 	"bufio"
-	"bytes"
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -34,6 +59,7 @@ import (
 // Logger provides colored output for different message types.
 type Logger struct {
 	colors bool
+	input  *bufio.Reader // answers to prompts; standard input if nil
 }
 
 // Color constants for terminal output.
@@ -84,34 +110,60 @@ func (l *Logger) Warn(format string, args ...interface{}) {
 	fmt.Fprintf(os.Stderr, "%s %s\n", l.colorize(colorYellow, "[WARN]"), msg)
 }
 
-func (l *Logger) Prompt(format string, args ...interface{}) string {
+// Prompt asks the user a question and returns the answer. It fails if there
+// is no answer, as when standard input is closed.
+func (l *Logger) Prompt(format string, args ...interface{}) (string, error) {
 	msg := fmt.Sprintf(format, args...)
 	fmt.Fprintf(os.Stderr, "%s %s", l.colorize(colorYellow, "[PROMPT]"), msg)
 
-	reader := bufio.NewReader(os.Stdin)
-	response, err := reader.ReadString('\n')
+	if l.input == nil {
+		l.input = bufio.NewReader(os.Stdin)
+	}
+	response, err := l.input.ReadString('\n')
 	if err != nil {
-		log.Fatal("failed to read user input:", err)
+		fmt.Fprintln(os.Stderr)
+		return "", fmt.Errorf("failed to read user input: %v", err)
 	}
-	return strings.TrimSpace(response)
+	return strings.TrimSpace(response), nil
 }
 
 // Publisher manages the proposal publication workflow.
 type Publisher struct {
-	logger           *Logger
-	commitRef        string
-	commitHash       string
-	dryRun           bool
-	proposalFile     string
-	basename         string
-	isDraft          bool
-	isNumbered       bool
-	discussionNumber string
-	discussionURL    string
-	newProposalFile  string
-	clNumber         string
-	clURL            string
-	useAI            bool
+	logger            *Logger
+	commitRef         string
+	commitHash        string
+	dryRun            bool
+	proposalFile      string
+	basename          string
+	isDraft           bool
+	isNumbered        bool
+	discussionNumber  string
+	discussionURL     string
+	newProposalFile   string
+	clNumber          string // number of the review, CL or pull request
+	clURL             string
+	useAI             bool
+	summarizer        Summarizer // summarizer to use instead of the configured one
+	reviewSummaries   bool       // have the author review the summary before it is posted
+	approvedSummary   string     // summary approved by the author in this run
+	postChangeSummary bool       // post the changes since the last published revision
+	fullText          bool
+	forceRewrite      bool // rewrite commits even if others may have them
+	config            Config
+	clStatus          string         // Gerrit status of the CL, once known: NEW, MERGED or ABANDONED
+	clRevision        int            // revision (patchset) of the review, once known
+	mergedCommit      string         // commit the CL was merged as
+	summary           string         // summary posted to the discussion
+	edits             []documentEdit // changes to the proposal, for commitDocumentEdits
+	messageEdits      []documentEdit // changes to its commit message
+	checks            []checkResult
+	endpoint          *gerritEndpoint
+	gerrit            *gerritClient
+	backend           reviewBackend
+	commands          Runner          // runs commands; see Publisher.runner
+	ctx               context.Context // context commands run in; see Publisher.context
+	dir               string          // directory commands run in; "" for the current one
+	worktree          *worktree       // temporary worktree the workflow runs in, if any
 }
 
 // NewPublisher creates a new publisher for the given commit reference.
@@ -124,25 +176,46 @@ func NewPublisher(commitRef string, dryRun bool, useAI bool) *Publisher {
 	}
 }
 
-// runCommand executes a command and returns stdout, stderr, and error.
+// command returns the command to run name with args in p.dir, for commands
+// that need the terminal, such as an editor, and so cannot go through the
+// Runner. It is stopped when p.context() is done.
+func (p *Publisher) command(name string, args ...string) *exec.Cmd {
+	return newCommand(p.context(), p.dir, name, args...)
+}
+
+// runCommand executes a command in p.dir and returns stdout, stderr, and
+// error.
 func (p *Publisher) runCommand(name string, args ...string) (string, string, error) {
-	cmd := exec.Command(name, args...)
-	var stdout, stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
-	err := cmd.Run()
-	return stdout.String(), stderr.String(), err
+	return p.runCommandInput("", name, args...)
 }
 
-// runCommandInput executes a command with stdin input.
+// runCommandInput executes a command in p.dir with stdin input. If the
+// command was stopped because it was interrupted or timed out, the error
+// says so, and so does stderr, as callers often only report that.
 func (p *Publisher) runCommandInput(input string, name string, args ...string) (string, string, error) {
-	cmd := exec.Command(name, args...)
-	var stdout, stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
-	cmd.Stdin = strings.NewReader(input)
-	err := cmd.Run()
-	return stdout.String(), stderr.String(), err
+	ctx := p.context()
+	stdout, stderr, err := p.runner().Run(ctx, p.dir, input, name, args...)
+	if err != nil && ctx.Err() != nil {
+		cause := context.Cause(ctx)
+		stderr += fmt.Sprintf("\n%s stopped: %v", name, cause)
+		err = fmt.Errorf("%s stopped: %w", name, cause)
+	}
+	return stdout, stderr, err
+}
+
+// loadConfig loads the per-repository configuration from the root of the
+// current repository.
+func (p *Publisher) loadConfig() error {
+	root, _, err := p.runCommand("git", "rev-parse", "--show-toplevel")
+	if err != nil {
+		return fmt.Errorf("failed to find repository root: %v", err)
+	}
+	cfg, err := loadConfig(strings.TrimSpace(root))
+	if err != nil {
+		return err
+	}
+	p.config = cfg
+	return nil
 }
 
 // findProposalFile finds the proposal file in the specified commit.
@@ -245,10 +318,11 @@ func (p *Publisher) runTests() error {
 	p.logger.Info("Step 1: Running tests...")
 
 	// Run Go tests (may have no test files)
-	_, _, err := p.runCommand("go", "test", "./...")
+	stdout, _, err := p.runCommand("go", "test", "./...")
 	if err != nil {
 		p.logger.Warning("Go tests failed or no tests found")
 	}
+	p.checks = append(p.checks, checkResult{name: "go test ./...", passed: err == nil, detail: stdout})
 
 	// Check CUE workflow generation
 	p.logger.Info("Checking CUE workflow generation...")
@@ -257,6 +331,7 @@ func (p *Publisher) runTests() error {
 		p.logger.Warning("CUE workflow generation failed: %s", stderr)
 		// Don't fail the whole workflow for CUE errors
 	}
+	p.checks = append(p.checks, checkResult{name: "CUE workflow generation", passed: err == nil, detail: stderr})
 
 	p.logger.Success("Tests completed successfully")
 	return nil
@@ -370,21 +445,12 @@ func (p *Publisher) createDiscussion() error {
 	if err != nil {
 		return fmt.Errorf("failed to read proposal file from commit: %v", err)
 	}
-	content := []byte(stdout)
-
-	titlePattern := regexp.MustCompile(`^# (.+)$`)
-	lines := strings.Split(string(content), "\n")
-	var title string
-	for _, line := range lines {
-		if matches := titlePattern.FindStringSubmatch(line); matches != nil {
-			title = strings.TrimSpace(matches[1])
-			break
-		}
-	}
+	content := stdout
 
-	if title == "" {
+	if extractTitle(content) == "" {
 		return fmt.Errorf("could not extract title from proposal file (no '# Title' found)")
 	}
+	title := p.discussionTitle(content)
 
 	// Create discussion body - we'll update with the full content after renaming
 	// Extract the proposal name without xxxx- prefix for a cleaner message
@@ -600,7 +666,9 @@ func min(a, b int) int {
 	return b
 }
 
-// renameProposal renames the draft proposal file with the discussion number.
+// renameProposal plans renaming the draft proposal file with the discussion
+// number and filling in its discussion link. Like the other document
+// changes, the rename is made by commitDocumentEdits.
 func (p *Publisher) renameProposal() error {
 	if !p.isDraft {
 		p.logger.Info("Step 3: Skipping file rename (already numbered: %s)", p.basename)
@@ -621,327 +689,144 @@ func (p *Publisher) renameProposal() error {
 	newBasename := strings.Replace(p.basename, "xxxx-", p.discussionNumber+"-", 1)
 	p.newProposalFile = filepath.Join(dirname, newBasename)
 
-	if p.dryRun {
-		p.logger.Info("[DRY RUN] Would rename %s to %s", p.proposalFile, p.newProposalFile)
-		return nil
+	content, err := p.readProposal()
+	if err != nil {
+		return err
 	}
-
-	// Rename the file in git
-	if p.commitRef == "HEAD" {
-		// Working on HEAD - can directly modify
-		_, _, err := p.runCommand("git", "mv", p.proposalFile, p.newProposalFile)
-		if err != nil {
-			return fmt.Errorf("failed to rename file: %v", err)
-		}
-
-		// Update the Discussion Channel link in the document
-		if err := p.updateDiscussionLink(); err != nil {
-			return fmt.Errorf("failed to update discussion link: %v", err)
-		}
-
-		_, _, err = p.runCommand("git", "add", p.newProposalFile)
-		if err != nil {
-			return fmt.Errorf("failed to add renamed file: %v", err)
-		}
-
-		_, _, err = p.runCommand("git", "commit", "--amend", "--no-edit")
-		if err != nil {
-			return fmt.Errorf("failed to amend commit: %v", err)
-		}
-
-		// Get the new commit hash after amending
-		newCommitHash, _, err := p.runCommand("git", "rev-parse", "HEAD")
-		if err != nil {
-			return fmt.Errorf("failed to get new commit hash: %v", err)
-		}
-		p.commitHash = strings.TrimSpace(newCommitHash)[:8]
-		p.commitRef = "HEAD"
-	} else {
-		// For non-HEAD commits, we have a few options:
-		// 1. Cherry-pick approach (safest)
-		// 2. Rebase approach (more complex)
-		// 3. Filter-branch approach (cleanest but requires tool)
-
-		p.logger.Warn("Renaming in historical commit %s", p.commitHash[:8])
-		p.logger.Warn("This will rewrite history - make sure to coordinate with team")
-
-		// Check for uncommitted changes and stash if needed
-		stdout, _, err := p.runCommand("git", "status", "--porcelain")
-		if err != nil {
-			return fmt.Errorf("failed to check git status: %v", err)
-		}
-
-		var stashCreated bool
-		if stdout != "" {
-			p.logger.Warn("Uncommitted changes detected, stashing them temporarily...")
-			_, _, err = p.runCommand("git", "stash", "push", "-m", "proposal-rename: auto-stash")
-			if err != nil {
-				p.logger.Error("Failed to stash changes. Please commit or stash manually.")
-				return fmt.Errorf("failed to stash changes: %v", err)
-			}
-			stashCreated = true
-		}
-
-		// Get current branch
-		currentBranch, _, err := p.runCommand("git", "rev-parse", "--abbrev-ref", "HEAD")
-		if err != nil {
-			return fmt.Errorf("failed to get current branch: %v", err)
-		}
-		currentBranch = strings.TrimSpace(currentBranch)
-
-		// Create temporary branch at the target commit
-		tempBranch := fmt.Sprintf("proposal-rename-%d", time.Now().Unix())
-		_, stderr, err := p.runCommand("git", "checkout", "-b", tempBranch, p.commitHash)
-		if err != nil {
-			p.logger.Error("Failed to create temp branch: %s", stderr)
-			return fmt.Errorf("failed to create temp branch: %v (stderr: %s)", err, stderr)
-		}
-
-		// Ensure we return to original branch on exit
-		cleanupDone := false
-		cleanup := func() {
-			if !cleanupDone {
-				p.runCommand("git", "checkout", currentBranch)
-				p.runCommand("git", "branch", "-D", tempBranch)
-				if stashCreated {
-					p.logger.Info("Restoring stashed changes...")
-					p.runCommand("git", "stash", "pop")
-				}
-				cleanupDone = true
-			}
-		}
-		defer cleanup()
-
-		// Perform the rename
-		_, _, err = p.runCommand("git", "mv", p.proposalFile, p.newProposalFile)
-		if err != nil {
-			return fmt.Errorf("failed to rename file: %v", err)
-		}
-
-		// Update the Discussion Channel link in the document
-		if err := p.updateDiscussionLink(); err != nil {
-			return fmt.Errorf("failed to update discussion link: %v", err)
-		}
-
-		// Amend the commit
-		_, _, err = p.runCommand("git", "commit", "--amend", "--no-edit")
-		if err != nil {
-			return fmt.Errorf("failed to amend commit: %v", err)
-		}
-
-		// Get the new commit hash
-		newCommitHash, _, err := p.runCommand("git", "rev-parse", "HEAD")
-		if err != nil {
-			return fmt.Errorf("failed to get new commit hash: %v", err)
-		}
-		newCommitHash = strings.TrimSpace(newCommitHash)
-
-		// Check if there are commits after the original
-		commitsAfter, _, _ := p.runCommand("git", "rev-list", "--count",
-			fmt.Sprintf("%s..%s", p.commitHash, currentBranch))
-		numCommits, _ := strconv.Atoi(strings.TrimSpace(commitsAfter))
-
-		if numCommits == 0 {
-			// No commits after - just update the branch
-			_, _, err = p.runCommand("git", "checkout", currentBranch)
-			if err != nil {
-				return fmt.Errorf("failed to checkout original branch: %v", err)
-			}
-			_, _, err = p.runCommand("git", "reset", "--hard", newCommitHash)
-			if err != nil {
-				return fmt.Errorf("failed to update branch: %v", err)
-			}
-		} else {
-			// There are commits after - need to cherry-pick them
-			p.logger.Info("Cherry-picking %d commits after the renamed commit...", numCommits)
-
-			// Get list of commits to cherry-pick
-			commitList, _, err := p.runCommand("git", "rev-list", "--reverse",
-				fmt.Sprintf("%s..%s", p.commitHash, currentBranch))
-			if err != nil {
-				return fmt.Errorf("failed to get commit list: %v", err)
-			}
-
-			commits := strings.Fields(commitList)
-			for _, commit := range commits {
-				_, _, err = p.runCommand("git", "cherry-pick", commit)
-				if err != nil {
-					return fmt.Errorf("failed to cherry-pick %s: %v", commit[:8], err)
-				}
-			}
-
-			// Update the original branch
-			newHead, _, _ := p.runCommand("git", "rev-parse", "HEAD")
-			newHead = strings.TrimSpace(newHead)
-
-			_, _, err = p.runCommand("git", "checkout", currentBranch)
-			if err != nil {
-				return fmt.Errorf("failed to checkout original branch: %v", err)
-			}
-			_, _, err = p.runCommand("git", "reset", "--hard", newHead)
-			if err != nil {
-				return fmt.Errorf("failed to update branch: %v", err)
-			}
-		}
-
-		// Update the commit reference to the new hash
-		p.commitHash = newCommitHash[:8]
-		p.commitRef = p.commitHash
-
-		// Cleanup is successful, mark it done
-		cleanup()
-
-		p.logger.Success("Successfully renamed file in commit %s", p.commitHash)
+	if _, found := setDiscussionLink(content, p.discussionURL); !found {
+		p.logger.Warn("Could not find or add Discussion Channel field in proposal")
 	}
-
-	p.logger.Success("Renamed %s to %s", p.proposalFile, p.newProposalFile)
+	p.queueEdit("fill in the Discussion Channel link", func(content string) (string, error) {
+		updated, _ := setDiscussionLink(content, p.discussionURL)
+		return updated, nil
+	})
 	return nil
 }
 
-// updateDiscussionLink updates the Discussion Channel link in the proposal document.
-func (p *Publisher) updateDiscussionLink() error {
-	if p.dryRun {
-		p.logger.Info("[DRY RUN] Would update Discussion Channel link to %s", p.discussionURL)
-		return nil
-	}
+// discussionChannelPattern matches the Discussion Channel line of a proposal,
+// in formats like "**Discussion Channel** GitHub: {link}",
+// "**Discussion Channel**: {link}" or "*   **Discussion Channel**: TBD".
+var discussionChannelPattern = regexp.MustCompile(`^(\*\s+\*\*Discussion Channel\*\*:\s*|\*\*Discussion Channel\*\*\s*:?\s*(?:GitHub:?\s*)?)(.*)$`)
 
-	// Read the current content of the file (from working directory for drafts, from commit for numbered)
-	var content []byte
-	var err error
+// authorPattern matches the Author(s) line of a proposal.
+var authorPattern = regexp.MustCompile(`^\*\s+\*\*Author\(s\)\*\*:`)
 
-	if p.isDraft {
-		// For drafts, read from working directory (after rename)
-		content, err = os.ReadFile(p.newProposalFile)
-		if err != nil {
-			return fmt.Errorf("failed to read proposal file: %v", err)
+// setDiscussionLink fills in the Discussion Channel of a proposal with url if
+// it is a placeholder ({link}, TBD or TODO), or adds the field after the
+// Author(s) if there is none. A link that is already filled in is kept. It
+// reports whether the document has a Discussion Channel field afterwards.
+func setDiscussionLink(content, url string) (string, bool) {
+	lines := strings.Split(content, "\n")
+	for i, line := range lines {
+		matches := discussionChannelPattern.FindStringSubmatch(line)
+		if matches == nil {
+			continue
 		}
-	} else {
-		// For numbered proposals, read from the commit
-		stdout, _, err := p.runCommand("git", "show", fmt.Sprintf("%s:%s", p.commitRef, p.proposalFile))
-		if err != nil {
-			return fmt.Errorf("failed to read proposal file from commit: %v", err)
+		if strings.Contains(matches[2], "{link}") || strings.Contains(matches[2], "TBD") || strings.Contains(matches[2], "TODO") {
+			lines[i] = matches[1] + url
+			return strings.Join(lines, "\n"), true
 		}
-		content = []byte(stdout)
+		return content, true
 	}
 
-	// Look for the Discussion Channel line and update it
-	lines := strings.Split(string(content), "\n")
-	updated := false
-	// Match formats like: **Discussion Channel** GitHub: {link}, **Discussion Channel**: {link}, or *   **Discussion Channel**: TBD
-	discussionChannelPattern := regexp.MustCompile(`^(\*\s+\*\*Discussion Channel\*\*:\s*|\*\*Discussion Channel\*\*\s*:?\s*(?:GitHub:?\s*)?)(.*)$`)
-
 	for i, line := range lines {
-		if matches := discussionChannelPattern.FindStringSubmatch(line); matches != nil {
-			// Check if it contains a placeholder like {link} or needs updating
-			if strings.Contains(matches[2], "{link}") || strings.Contains(matches[2], "TBD") || strings.Contains(matches[2], "TODO") {
-				// Update the line with the GitHub discussion URL
-				lines[i] = fmt.Sprintf("%s%s", matches[1], p.discussionURL)
-				updated = true
-				break
-			}
+		if authorPattern.MatchString(line) {
+			newLine := fmt.Sprintf("*   **Discussion Channel**: %s", url)
+			lines = append(lines[:i+1], append([]string{newLine}, lines[i+1:]...)...)
+			return strings.Join(lines, "\n"), true
 		}
 	}
+	return content, false
+}
 
-	if !updated {
-		// If no Discussion Channel line found, try to add one after Author(s)
-		authorPattern := regexp.MustCompile(`^\*\s+\*\*Author\(s\)\*\*:`)
-		for i, line := range lines {
-			if authorPattern.MatchString(line) {
-				// Insert Discussion Channel after Author(s)
-				newLine := fmt.Sprintf("*   **Discussion Channel**: %s", p.discussionURL)
-				lines = append(lines[:i+1], append([]string{newLine}, lines[i+1:]...)...)
-				updated = true
-				break
-			}
-		}
+// updateDiscussionLink plans filling in the Discussion Channel link of a
+// numbered proposal if it is missing, for commitDocumentEdits. Its commit
+// may be any commit on the current branch.
+func (p *Publisher) updateDiscussionLink() error {
+	content, err := p.readProposal()
+	if err != nil {
+		return err
 	}
-
-	if updated {
-		updatedContent := strings.Join(lines, "\n")
-
-		if p.isDraft {
-			// For drafts, write to working directory file
-			if err := os.WriteFile(p.newProposalFile, []byte(updatedContent), 0644); err != nil {
-				return fmt.Errorf("failed to write updated proposal file: %v", err)
-			}
-		} else {
-			// For numbered proposals, we need to update the commit
-			// This is complex for non-HEAD commits, so for now we'll use a different approach
-			if p.commitRef == "HEAD" {
-				// Write to working directory and amend
-				if err := os.WriteFile(p.proposalFile, []byte(updatedContent), 0644); err != nil {
-					return fmt.Errorf("failed to write updated proposal file: %v", err)
-				}
-
-				// Stage and amend the commit
-				_, _, err := p.runCommand("git", "add", p.proposalFile)
-				if err != nil {
-					return fmt.Errorf("failed to stage updated file: %v", err)
-				}
-
-				_, _, err = p.runCommand("git", "commit", "--amend", "--no-edit")
-				if err != nil {
-					return fmt.Errorf("failed to amend commit: %v", err)
-				}
-			} else {
-				// For historical commits, this is complex - we'd need to rewrite history
-				p.logger.Warn("Cannot update discussion link in historical commit %s", p.commitRef)
-				p.logger.Info("The discussion link update will be included in the discussion content instead")
-			}
-		}
-
-		p.logger.Success("Updated Discussion Channel link to %s", p.discussionURL)
-	} else {
+	updated, found := setDiscussionLink(content, p.discussionURL)
+	switch {
+	case !found:
 		p.logger.Warn("Could not find or add Discussion Channel field in proposal")
+		return nil
+	case updated == content:
+		return nil
 	}
 
+	p.queueEdit("fill in the Discussion Channel link", func(content string) (string, error) {
+		updated, _ := setDiscussionLink(content, p.discussionURL)
+		return updated, nil
+	})
 	return nil
 }
 
-// generateProposalSummary uses claude CLI to create an intelligent summary.
-func (p *Publisher) generateProposalSummary(content string) (string, error) {
-	if !p.useAI {
-		return "", fmt.Errorf("AI summary generation disabled")
-	}
+// titlePattern matches the heading of a proposal, its title.
+var titlePattern = regexp.MustCompile(`^# (.+)$`)
 
-	prompt := `You are summarizing a CUE language proposal for a GitHub discussion. Create a clear, concise summary that captures the essence of the proposal.
+// extractTitle returns the text of the first "# " heading in content, or the
+// empty string if there is none.
+func extractTitle(content string) string {
+	for _, line := range strings.Split(content, "\n") {
+		if matches := titlePattern.FindStringSubmatch(line); matches != nil {
+			return strings.TrimSpace(matches[1])
+		}
+	}
+	return ""
+}
 
-Focus on:
-1. The problem being addressed
-2. The proposed solution
-3. Some key examples or use cases
-4. Key benefits and impact
-5. Any important technical details or considerations
+// metadataFieldPattern matches a metadata line of a proposal, such as
+// "**Status:** Draft", "*   **Status**: Draft" or "**Status:** Draft<br>",
+// capturing the name and value of the field.
+var metadataFieldPattern = regexp.MustCompile(`^(?:\*\s+)?\*\*([^*:]+)(?::\*\*|\*\*:)\s*(.*?)\s*(?:<br>)?\s*$`)
+
+// extractMetadataField returns the value of the metadata field called name,
+// or the empty string if the document has no such field.
+func extractMetadataField(content, name string) string {
+	for _, line := range strings.Split(content, "\n") {
+		matches := metadataFieldPattern.FindStringSubmatch(strings.TrimSpace(line))
+		if matches != nil && strings.TrimSpace(matches[1]) == name {
+			return matches[2]
+		}
+	}
+	return ""
+}
 
-Guidelines:
-- Write 3-5 paragraphs
-- Use clear, accessible language
-- Highlight the most important aspects
-- Format in markdown
-- Don't include metadata lines (Status:, Author:, etc.)
-- Focus on the actual proposal content
+// discussionTitle returns the title the discussion should carry for the
+// given proposal content: the document heading, preceded by the configured
+// title prefix.
+func (p *Publisher) discussionTitle(content string) string {
+	title := extractTitle(content)
+	if title == "" {
+		title = "CUE Proposal"
+	}
 
-Please summarize this proposal:`
+	prefix := p.config.TitlePrefix
+	if prefix == "" {
+		return title
+	}
 
-	// Use claude CLI to generate summary
-	stdout, stderr, err := p.runCommandInput(content+"\n"+prompt, "claude")
-	if err != nil {
-		// Check if claude is not installed
-		if strings.Contains(stderr, "command not found") || strings.Contains(stderr, "not found") {
-			return "", fmt.Errorf("claude CLI not available")
+	complete := true
+	expand := func(placeholder, value string) {
+		if strings.Contains(prefix, placeholder) {
+			if value == "" {
+				complete = false
+			}
+			prefix = strings.ReplaceAll(prefix, placeholder, value)
 		}
-		return "", fmt.Errorf("claude summary generation failed: %s", stderr)
 	}
+	expand("{number}", p.discussionNumber)
+	expand("{status}", extractMetadataField(content, "Status"))
+	expand("{lifecycle}", extractMetadataField(content, "Lifecycle"))
 
-	summary := strings.TrimSpace(stdout)
-	if summary == "" {
-		return "", fmt.Errorf("claude returned empty summary")
+	if !complete {
+		// A prefix with missing pieces (e.g. no number yet for a new draft)
+		// would only look broken; it is added on a later republish.
+		return title
 	}
-
-	// Add a note that this was AI-generated
-	summary += "\n\n_[Summary generated by Claude AI]_"
-
-	return summary, nil
+	return prefix + title
 }
 
 // submitCL submits the changes via git codereview mail.
@@ -951,7 +836,11 @@ func (p *Publisher) submitCL() error {
 	if p.dryRun {
 		p.logger.Info("[DRY RUN] Would submit CL via git codereview mail")
 		p.clNumber = "12345"
-		p.clURL = "https://review.gerrithub.io/c/cue-lang/proposal/+/12345"
+		if endpoint, err := p.gerritEndpoint(); err == nil {
+			p.clURL = endpoint.changeURL(p.clNumber)
+		} else {
+			p.logger.Warn("Could not determine Gerrit endpoint: %v", err)
+		}
 		return nil
 	}
 
@@ -963,7 +852,7 @@ func (p *Publisher) submitCL() error {
 			p.logger.Info("No new changes to submit (CL may already exist)")
 			// Try to get the existing CL number
 			if err := p.getExistingCL(); err != nil {
-				return fmt.Errorf("failed to get existing CL: %v", err)
+				p.logger.Warn("Could not find existing CL: %v", err)
 			}
 			return nil
 		}
@@ -971,23 +860,27 @@ func (p *Publisher) submitCL() error {
 	}
 
 	// Extract CL number from output
-	// Example: "https://review.gerrithub.io/c/cue-lang/proposal/+/123456 [NEW]"
+	// Example: "https://cue.gerrithub.io/c/cue-lang/proposal/+/123456 [NEW]"
 	clPattern := regexp.MustCompile(`https://[^\s]+/(\d+)`)
+	endpoint, err := p.gerritEndpoint()
+	if err == nil {
+		clPattern = endpoint.changeURLPattern()
+	}
 	if matches := clPattern.FindStringSubmatch(stdout); matches != nil {
 		p.clNumber = matches[1]
-		p.clURL = matches[0]
+		p.clURL = p.changeURL(p.clNumber, matches[0])
 		p.logger.Success("Submitted CL %s: %s", p.clNumber, p.clURL)
 	} else {
 		// Try to get from stderr as well
 		if matches := clPattern.FindStringSubmatch(stderr); matches != nil {
 			p.clNumber = matches[1]
-			p.clURL = matches[0]
+			p.clURL = p.changeURL(p.clNumber, matches[0])
 			p.logger.Success("Submitted CL %s: %s", p.clNumber, p.clURL)
 		} else {
 			p.logger.Warn("Could not extract CL number from git codereview output")
 			// Try to get it another way
 			if err := p.getExistingCL(); err != nil {
-				return fmt.Errorf("failed to get CL number: %v", err)
+				p.logger.Warn("Could not find CL number: %v", err)
 			}
 		}
 	}
@@ -995,75 +888,82 @@ func (p *Publisher) submitCL() error {
 	return nil
 }
 
-// getExistingCL tries to get the CL number for the current commit.
+// changeIDPattern matches the Change-Id trailer Gerrit uses to identify a
+// change across patchsets.
+var changeIDPattern = regexp.MustCompile(`Change-Id: (I[a-f0-9]{40})`)
+
+// getExistingCL looks up the CL for the commit being published on Gerrit,
+// using the Change-Id in its commit message.
 func (p *Publisher) getExistingCL() error {
-	// Try using git config to get the change-id
-	stdout, _, err := p.runCommand("git", "log", "-1", "--format=%B")
+	change, err := p.lookupCL()
+	if err != nil {
+		return err
+	}
+	p.logger.Info("Found CL %s (patchset %d, %s): %s", p.clNumber, change.CurrentPatchset(), change.Status, p.clURL)
+	return nil
+}
+
+// lookupCL queries Gerrit for the current state of the CL of the commit
+// being published and records its number and URL.
+func (p *Publisher) lookupCL() (*gerritChange, error) {
+	stdout, _, err := p.runCommand("git", "log", "-1", "--format=%B", p.commitRef)
 	if err != nil {
-		return fmt.Errorf("failed to get commit message: %v", err)
+		return nil, fmt.Errorf("failed to get commit message: %v", err)
 	}
 
-	// Look for Change-Id in commit message
-	changeIDPattern := regexp.MustCompile(`Change-Id: (I[a-f0-9]{40})`)
-	if matches := changeIDPattern.FindStringSubmatch(stdout); matches != nil {
-		changeID := matches[1]
-		// Query Gerrit for this change
-		stdout, _, err := p.runCommand("git", "config", "--get", "remote.origin.url")
-		if err != nil {
-			return fmt.Errorf("failed to get remote URL: %v", err)
-		}
+	matches := changeIDPattern.FindStringSubmatch(stdout)
+	if matches == nil {
+		return nil, fmt.Errorf("commit %s has no Change-Id", p.commitRef)
+	}
+	changeID := matches[1]
 
-		// Extract Gerrit URL and construct CL URL
-		if strings.Contains(stdout, "gerrithub.io") {
-			// For now, just construct a likely URL
-			p.clURL = fmt.Sprintf("https://review.gerrithub.io/q/%s", changeID)
-			p.logger.Info("CL may be at: %s", p.clURL)
-		}
+	client, err := p.gerritClient()
+	if err != nil {
+		return nil, err
+	}
+	change, err := client.changeByID(changeID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query Gerrit for %s: %v", changeID, err)
+	}
+	if change == nil {
+		return nil, fmt.Errorf("no CL found on Gerrit for %s", changeID)
 	}
 
-	return nil
+	p.clNumber = strconv.Itoa(change.Number)
+	p.clURL = client.endpoint.changeURL(p.clNumber)
+	return change, nil
 }
 
-// runTrybots runs trybots on the submitted CL.
-func (p *Publisher) runTrybots() error {
+// runTrybots runs trybots on the submitted commit and waits for their
+// result. It returns an error if any trybot job failed.
+func (p *Publisher) runTrybots(ctx context.Context) error {
 	p.logger.Info("Step 5: Running trybots...")
 
+	backend := p.reviewBackend()
 	if p.dryRun {
-		p.logger.Info("[DRY RUN] Would run trybots with: cueckoo runtrybot <new-commit-hash>")
+		p.logger.Info("[DRY RUN] Would run trybots on the %s and wait for the result", backend.kind())
 		p.logger.Info("[DRY RUN] (commit hash will change after file rename and amendments)")
 		return nil
 	}
 
 	if p.clNumber == "" {
-		p.logger.Warn("No CL number available, skipping trybot run")
+		p.logger.Warn("No %s available, skipping trybot run", backend.kind())
 		return nil
 	}
 
-	// Run trybots using cueckoo
-	// Use the full commit hash for cueckoo (not the abbreviated one)
-	fullCommitHash, _, err := p.runCommand("git", "rev-parse", p.commitRef)
-	if err != nil {
-		return fmt.Errorf("failed to get full commit hash: %v", err)
+	source, err := backend.startTrybots()
+	if err != nil || source == nil {
+		return err
 	}
-	fullCommitHash = strings.TrimSpace(fullCommitHash)
-
-	stdout, stderr, err := p.runCommand("cueckoo", "runtrybot", fullCommitHash)
+	run, jobs, err := p.waitForTrybots(ctx, waitOptions{interval: trybotPollInterval, timeout: trybotTimeout}, source)
 	if err != nil {
-		// Check if cueckoo is not installed
-		if strings.Contains(stderr, "command not found") || strings.Contains(stderr, "not found") {
-			p.logger.Warn("cueckoo not installed, skipping trybot run")
-			p.logger.Info("To install cueckoo: go install github.com/cue-lang/cueckoo/cmd/cueckoo@latest")
-			return nil
-		}
-		return fmt.Errorf("failed to run trybots: %v (stderr: %s)", err, stderr)
+		return err
 	}
-
-	p.logger.Success("Started trybots for commit %s", fullCommitHash[:8])
-	if stdout != "" {
-		p.logger.Info("Trybot output: %s", strings.TrimSpace(stdout))
+	if err := p.reportTrybotJobs(run, jobs); err != nil {
+		return err
 	}
 
-	p.logger.Info("Monitor trybot status at: %s", p.clURL)
+	p.logger.Success("Trybots passed for %s", backend.ref(p.clNumber))
 	return nil
 }
 
@@ -1135,10 +1035,25 @@ func (p *Publisher) extractProposalSummary(content string) string {
 	return "See the full proposal document for details."
 }
 
-// updateDiscussionContent updates the GitHub discussion with the proposal summary.
-func (p *Publisher) updateDiscussionContent(clNumber string) error {
-	p.logger.Info("Updating GitHub discussion with proposal content...")
+// Markers delimiting the part of the discussion body that is generated by
+// this tool. Text outside the markers is left alone when the discussion is
+// updated, so maintainers can add notes above or below.
+const (
+	managedBegin = "<!-- proposal-publish:begin -->"
+	managedEnd   = "<!-- proposal-publish:end -->"
+)
+
+// discussionContent is the generated content of a proposal discussion.
+type discussionContent struct {
+	title string // discussion title
+	body  string // managed region of the body, without the markers
+}
 
+// generateDiscussionContent generates the discussion title and body for the
+// proposal. If publishComments is set and full-text mode is enabled, the
+// continuation comments are posted to the discussion with the given node ID;
+// otherwise the existing comments are linked to.
+func (p *Publisher) generateDiscussionContent(clNumber, discussionID string, publishComments bool) (*discussionContent, error) {
 	// Read proposal content from commit
 	// In dry-run mode for drafts, use original filename since rename didn't happen
 	filename := p.newProposalFile
@@ -1148,111 +1063,287 @@ func (p *Publisher) updateDiscussionContent(clNumber string) error {
 
 	stdout, _, err := p.runCommand("git", "show", fmt.Sprintf("%s:%s", p.commitRef, filename))
 	if err != nil {
-		return fmt.Errorf("failed to read proposal file from commit: %v", err)
+		return nil, fmt.Errorf("failed to read proposal file from commit: %v", err)
 	}
 	content := stdout
+	backend := p.reviewBackend()
 
-	// Extract title
-	titlePattern := regexp.MustCompile(`^# (.+)$`)
-	lines := strings.Split(content, "\n")
-	var title string
-	for _, line := range lines {
-		if matches := titlePattern.FindStringSubmatch(line); matches != nil {
-			title = strings.TrimSpace(matches[1])
-			break
-		}
-	}
-
+	title := extractTitle(content)
 	if title == "" {
 		title = "CUE Proposal"
 	}
 
-	// Extract summary - try AI first, fallback to extraction
+	// The complete text is posted instead of a summary in full-text mode.
 	var summary string
-	if p.useAI {
-		aiSummary, err := p.generateProposalSummary(content)
-		if err != nil {
-			p.logger.Warning("AI summary generation failed: %v, falling back to text extraction", err)
-			summary = p.extractProposalSummary(content)
+	if !p.fullText {
+		if p.approvedSummary != "" {
+			summary = p.approvedSummary
+		} else if approved, ok := approvedSummary(content); ok {
+			p.logger.Info("Using the approved summary stored in the proposal")
+			summary = approved
 		} else {
-			summary = aiSummary
-			p.logger.Success("Generated AI summary for proposal")
+			summary = p.summarize(content, false)
 		}
-	} else {
-		summary = p.extractProposalSummary(content)
+	}
+
+	// Once the CL is merged, the commit that landed is the one published;
+	// Gerrit may have rebased it.
+	publishedCommit := p.mergedCommit
+	if publishedCommit == "" {
+		out, _, err := p.runCommand("git", "rev-parse", p.commitRef)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve published commit: %v", err)
+		}
+		publishedCommit = strings.TrimSpace(out)
+	}
+	// A merged commit is on the mirror, or will be shortly.
+	onMirror := p.mergedCommit != "" || p.commitOnMirror(publishedCommit)
+
+	// Relative links and images in the summary would be broken in the
+	// discussion, so make them absolute, pinned to the published commit
+	// once it is on the mirror and to main until then.
+	linkedCommit := "main"
+	if onMirror {
+		linkedCommit = publishedCommit
+	}
+	rewriter := &linkRewriter{
+		repoURL: proposalRepoURL,
+		commit:  linkedCommit,
+		file:    filename,
+	}
+	summary = rewriter.rewrite(summary)
+	p.summary = summary
+
+	mainContent := fmt.Sprintf("# %s\n\n%s", title, summary)
+	if p.fullText {
+		// Filled in below, once the size of the rest of the body is known.
+		mainContent = fullTextPlaceholder
+	}
+
+	// Link to both the latest version and the exact revision published,
+	// which is only in the review until it is on the mirror.
+	var reviewFileURL string
+	if clNumber != "" && !onMirror {
+		reviewFileURL = backend.fileURL(clNumber, p.reviewRevision(), p.newProposalFile)
+	}
+	fileLinks := documentLinks(p.newProposalFile, publishedCommit, onMirror, reviewFileURL)
+	// The document is not on main until the review is merged, so until
+	// then the full proposal is the one in the review.
+	fullProposalURL := fmt.Sprintf("%s/blob/%s/%s", proposalRepoURL, linkedCommit, escapePath(p.newProposalFile))
+	if reviewFileURL != "" {
+		fullProposalURL = reviewFileURL
 	}
 
 	// Create updated discussion body
-	status := "Under Review ✅"
-	if clNumber != "" {
-		status = "Under Review ✅"
-	} else {
+	var status string
+	switch {
+	case clNumber == "":
 		status = "Draft"
+	case p.clStatus == reviewMerged:
+		status = "Merged ✅"
+	case p.clStatus == reviewAbandoned:
+		status = capitalize(backend.kind()) + " abandoned"
+	default:
+		status = "Under Review ✅"
 	}
 
 	updatedBody := fmt.Sprintf(`**📋 Proposal Details:**
-- **File**: [%s](https://github.com/cue-lang/proposal/blob/main/%s)
+- **File**: %s
 - **Status**: %s
 
 ---
 
-# %s
-
 %s
 
 ---
 
 ## Full Proposal
 
-The complete proposal with all technical details, examples, and implementation notes can be found in the [proposal document](https://github.com/cue-lang/proposal/blob/main/%s).
+The complete proposal with all technical details, examples, and implementation notes can be found in the [proposal document](%s).
 
 ## How to Comment
 
 Please provide feedback on this proposal:
 - **For general discussion**: Comment in this GitHub discussion
-- **For detailed code review**: Comment on the Gerrit CL (link will be added when available)
+- **For detailed code review**: Comment on the %s (link will be added when available)
 
 *Last updated: %s*`,
-		p.newProposalFile,
-		p.newProposalFile,
+		fileLinks,
 		status,
-		title,
-		summary,
-		p.newProposalFile,
+		mainContent,
+		fullProposalURL,
+		backend.kind(),
 		time.Now().UTC().Format("2006-01-02 15:04:05 UTC"))
 
 	if clNumber != "" {
-		// Add CL link if available
-		clLink := fmt.Sprintf("- **Gerrit CL**: [CL %s](https://cue-review.googlesource.com/c/cue-lang/proposal/+/%s)", clNumber, clNumber)
+		// Add the review link if available
+		clURL := backend.reviewURL(clNumber)
+		kind := backend.kind()
+		clLink := fmt.Sprintf("- **%s**: [%s](%s)", capitalize(kind), backend.ref(clNumber), clURL)
 		updatedBody = strings.Replace(updatedBody,
 			"- **Status**: "+status,
 			clLink+"\n- **Status**: "+status, 1)
 
 		updatedBody = strings.Replace(updatedBody,
-			"Comment on the Gerrit CL (link will be added when available)",
-			fmt.Sprintf("Comment on the [Gerrit CL](https://cue-review.googlesource.com/c/cue-lang/proposal/+/%s)", clNumber), 1)
+			"Comment on the "+kind+" (link will be added when available)",
+			fmt.Sprintf("Comment on the [%s](%s)", kind, clURL), 1)
+	}
+
+	if p.fullText {
+		headerSize := len(updatedBody) - len(fullTextPlaceholder) + len(managedBegin) + len(managedEnd) + 2
+		text, err := p.fullTextBody(discussionID, rewriter.rewrite(content), headerSize, publishComments)
+		if err != nil {
+			return nil, err
+		}
+		updatedBody = strings.Replace(updatedBody, fullTextPlaceholder, text, 1)
+	}
+
+	return &discussionContent{
+		title: p.discussionTitle(content),
+		body:  updatedBody,
+	}, nil
+}
+
+// replaceManagedRegion returns the discussion body with its managed region
+// replaced by managed. Bodies without markers, such as those posted by
+// earlier versions of this tool, are replaced entirely.
+func replaceManagedRegion(body, managed string) string {
+	region := managedBegin + "\n" + managed + "\n" + managedEnd
+	begin := strings.Index(body, managedBegin)
+	end := strings.Index(body, managedEnd)
+	if begin < 0 || end < begin {
+		return region
+	}
+	return body[:begin] + region + body[end+len(managedEnd):]
+}
+
+// managedRegion returns the managed region of a discussion body, or the
+// whole body if it has no markers.
+func managedRegion(body string) string {
+	begin := strings.Index(body, managedBegin)
+	end := strings.Index(body, managedEnd)
+	if begin < 0 || end < begin {
+		return body
 	}
+	return strings.TrimSuffix(strings.TrimPrefix(body[begin+len(managedBegin):end], "\n"), "\n")
+}
+
+// updateDiscussionContent updates the GitHub discussion with the proposal summary.
+func (p *Publisher) updateDiscussionContent(clNumber string) error {
+	p.logger.Info("Updating GitHub discussion with proposal content...")
+
+	var discussion *liveDiscussion
+	if !p.dryRun {
+		var err error
+		discussion, err = p.fetchDiscussion()
+		if err != nil {
+			return err
+		}
+	} else {
+		discussion = &liveDiscussion{}
+	}
+
+	generated, err := p.generateDiscussionContent(clNumber, discussion.ID, true)
+	if err != nil {
+		return err
+	}
+	updatedBody := replaceManagedRegion(discussion.Body, generated.body)
 
 	if p.dryRun {
 		p.logger.Info("[DRY RUN] Would update discussion #%s with:", p.discussionNumber)
-		fmt.Fprintf(os.Stderr, "Title: %s\n", title)
+		fmt.Fprintf(os.Stderr, "Title: %s\n", generated.title)
 		fmt.Fprintf(os.Stderr, "Body preview:\n%s\n", updatedBody[:min(500, len(updatedBody))]+"...")
+		if p.postChangeSummary && p.isNumbered {
+			p.postChanges(discussion)
+		}
 		return nil
 	}
 
-	// Get discussion node ID for GraphQL update
+	// Update discussion using GraphQL
+	mutation := `
+	mutation($discussionId: ID!, $body: String!) {
+		updateDiscussion(input: {discussionId: $discussionId, body: $body}) {
+			discussion {
+				url
+			}
+		}
+	}`
+
+	variables := map[string]interface{}{
+		"discussionId": discussion.ID,
+		"body":         updatedBody,
+	}
+
+	// Keep the discussion title in sync with the document heading, which
+	// commonly changes during review.
+	if discussion.Title != generated.title {
+		p.logger.Info("Updating discussion title from %q to %q", discussion.Title, generated.title)
+		mutation = `
+	mutation($discussionId: ID!, $body: String!, $title: String!) {
+		updateDiscussion(input: {discussionId: $discussionId, body: $body, title: $title}) {
+			discussion {
+				url
+			}
+		}
+	}`
+		variables["title"] = generated.title
+	}
+
+	reqData := map[string]interface{}{
+		"query":     mutation,
+		"variables": variables,
+	}
+
+	_, err = p.callGitHubAPI("POST", "graphql", reqData)
+	if err != nil {
+		p.logger.Warning("Could not update discussion automatically: %v", err)
+		p.logger.Info("Please update manually at: %s", p.discussionURL)
+		return nil // Don't fail the whole workflow
+	}
+
+	p.logger.Success("Updated discussion #%s with proposal content", p.discussionNumber)
+
+	if p.postChangeSummary && p.isNumbered {
+		if err := p.postChanges(discussion); err != nil {
+			p.logger.Warning("Could not post the changes to the proposal: %v", err)
+		}
+	}
+	return nil
+}
+
+// liveDiscussion is the current state of a discussion on GitHub.
+type liveDiscussion struct {
+	ID     string
+	URL    string
+	Title  string
+	Body   string
+	Closed bool
+	Labels []string
+}
+
+// fetchDiscussion fetches the current state of the discussion.
+func (p *Publisher) fetchDiscussion() (*liveDiscussion, error) {
 	query := `
 	query($number: Int!) {
 		repository(owner: "cue-lang", name: "cue") {
 			discussion(number: $number) {
 				id
+				url
+				title
+				body
+				closed
+				labels(first: 20) {
+					nodes {
+						name
+					}
+				}
 			}
 		}
 	}`
 
 	numberInt, err := strconv.Atoi(p.discussionNumber)
 	if err != nil {
-		return fmt.Errorf("invalid discussion number: %v", err)
+		return nil, fmt.Errorf("invalid discussion number: %v", err)
 	}
 
 	variables := map[string]interface{}{
@@ -1266,14 +1357,23 @@ Please provide feedback on this proposal:
 
 	data, err := p.callGitHubAPI("POST", "graphql", reqData)
 	if err != nil {
-		return fmt.Errorf("failed to get discussion: %v", err)
+		return nil, fmt.Errorf("failed to get discussion: %v", err)
 	}
 
 	var discussion struct {
 		Data struct {
 			Repository struct {
 				Discussion struct {
-					ID string `json:"id"`
+					ID     string `json:"id"`
+					URL    string `json:"url"`
+					Title  string `json:"title"`
+					Body   string `json:"body"`
+					Closed bool   `json:"closed"`
+					Labels struct {
+						Nodes []struct {
+							Name string `json:"name"`
+						} `json:"nodes"`
+					} `json:"labels"`
 				} `json:"discussion"`
 			} `json:"repository"`
 		} `json:"data"`
@@ -1281,60 +1381,68 @@ Please provide feedback on this proposal:
 	}
 
 	if err := json.Unmarshal(data, &discussion); err != nil {
-		return fmt.Errorf("failed to parse discussion: %v", err)
+		return nil, fmt.Errorf("failed to parse discussion: %v", err)
 	}
 
 	if len(discussion.Errors) > 0 {
-		return fmt.Errorf("GraphQL errors: %v", discussion.Errors)
+		return nil, fmt.Errorf("GraphQL errors: %v", discussion.Errors)
 	}
 
-	// Update discussion using GraphQL
-	mutation := `
-	mutation($discussionId: ID!, $body: String!) {
-		updateDiscussion(input: {discussionId: $discussionId, body: $body}) {
-			discussion {
-				url
-			}
-		}
-	}`
-
-	variables = map[string]interface{}{
-		"discussionId": discussion.Data.Repository.Discussion.ID,
-		"body":         updatedBody,
+	d := discussion.Data.Repository.Discussion
+	if d.ID == "" {
+		return nil, fmt.Errorf("discussion #%s not found", p.discussionNumber)
+	}
+	live := &liveDiscussion{
+		ID:     d.ID,
+		URL:    d.URL,
+		Title:  d.Title,
+		Body:   d.Body,
+		Closed: d.Closed,
 	}
+	for _, l := range d.Labels.Nodes {
+		live.Labels = append(live.Labels, l.Name)
+	}
+	return live, nil
+}
 
-	reqData = map[string]interface{}{
-		"query":     mutation,
-		"variables": variables,
+// commitOnMirror reports whether commit is available on the public GitHub
+// mirror of the proposal repository, which is only the case once the change
+// has been merged.
+func (p *Publisher) commitOnMirror(commit string) bool {
+	if p.dryRun {
+		return false
 	}
 
-	_, err = p.callGitHubAPI("POST", "graphql", reqData)
+	_, err := p.callGitHubAPI("GET", "repos/cue-lang/proposal/commits/"+commit, nil)
 	if err != nil {
-		p.logger.Warning("Could not update discussion automatically: %v", err)
-		p.logger.Info("Please update manually at: %s", p.discussionURL)
-		return nil // Don't fail the whole workflow
+		// GitHub reports an unknown commit as 404 or 422; anything else
+		// is unexpected but still means we cannot link to it.
+		if !strings.Contains(err.Error(), "404") && !strings.Contains(err.Error(), "422") {
+			p.logger.Warning("Could not check for commit %s on GitHub: %v", shortHash(commit), err)
+		}
+		return false
 	}
-
-	p.logger.Success("Updated discussion #%s with proposal content", p.discussionNumber)
-	return nil
+	return true
 }
 
-// updateDocumentReferences updates internal references to the discussion number in the document.
+// updateDocumentReferences plans updating references to the discussion number
+// in the document of a draft, for commitDocumentEdits.
 func (p *Publisher) updateDocumentReferences() error {
-	if !p.isDraft || p.dryRun {
-		return nil // Skip for numbered proposals or dry run
+	if !p.isDraft {
+		return nil // Skip for numbered proposals
 	}
 
-	p.logger.Info("Updating document references to discussion #%s...", p.discussionNumber)
-
-	// Read current file content from working directory (after rename)
-	content, err := os.ReadFile(p.newProposalFile)
-	if err != nil {
-		return fmt.Errorf("failed to read renamed proposal file: %v", err)
-	}
+	p.queueEdit(fmt.Sprintf("update references to discussion #%s", p.discussionNumber), func(content string) (string, error) {
+		return updateReferences(content, p.discussionNumber), nil
+	})
+	return nil
+}
 
-	originalContent := string(content)
-	updatedContent := originalContent
+// updateReferences replaces placeholders for the discussion in a proposal,
+// such as "Discussion: TBD" or a stray xxxx, with references to the
+// discussion with the given number.
+func updateReferences(content, number string) string {
+	updated := content
 
 	// Look for common patterns where discussion numbers might be referenced
 	// Pattern 1: "GitHub discussion: TBD" or similar
@@ -1344,57 +1452,205 @@ func (p *Publisher) updateDocumentReferences() error {
 		`(?i)(discussion|github discussion|gh discussion):\s*#?\s*xxxx`,
 	}
 
-	discussionReplacement := fmt.Sprintf("Discussion: https://github.com/cue-lang/cue/discussions/%s", p.discussionNumber)
+	discussionReplacement := fmt.Sprintf("Discussion: https://github.com/cue-lang/cue/discussions/%s", number)
 
 	for _, pattern := range discussionPatterns {
 		re := regexp.MustCompile(pattern)
-		updatedContent = re.ReplaceAllString(updatedContent, discussionReplacement)
+		updated = re.ReplaceAllString(updated, discussionReplacement)
 	}
 
 	// Pattern 2: Any "xxxx" that might refer to the proposal number
 	// Be careful not to replace xxxx in filename examples
-	if !strings.Contains(originalContent, "xxxx-") { // Only if no filename examples
+	if !strings.Contains(content, "xxxx-") { // Only if no filename examples
 		re := regexp.MustCompile(`(?i)\bxxxx\b`)
-		updatedContent = re.ReplaceAllString(updatedContent, p.discussionNumber)
+		updated = re.ReplaceAllString(updated, number)
 	}
 
-	// If content changed, write it back
-	if updatedContent != originalContent {
-		if err := os.WriteFile(p.newProposalFile, []byte(updatedContent), 0644); err != nil {
-			return fmt.Errorf("failed to update document references: %v", err)
+	return updated
+}
+
+// publish runs the publication workflow. The steps up to submitting the
+// commit for review run in a temporary worktree, which is closed, moving
+// the current branch to any rewritten commits, once the commit is
+// submitted or a step fails. A dry run changes nothing, so it runs in the
+// current checkout.
+func (p *Publisher) publish(ctx context.Context, keepWorktree, wait bool, opts waitOptions) (err error) {
+	p.ctx = ctx
+	if !p.dryRun {
+		if err := p.openWorktree(keepWorktree); err != nil {
+			return err
 		}
+	}
+	defer func() {
+		if closeErr := p.closeWorktree(); closeErr != nil {
+			if err == nil {
+				err = closeErr
+			} else {
+				p.logger.Error("%v", closeErr)
+			}
+		}
+	}()
 
-		// Stage the changes
-		_, _, err := p.runCommand("git", "add", p.newProposalFile)
-		if err != nil {
-			return fmt.Errorf("failed to stage document updates: %v", err)
+	// Execute workflow steps, each limited in time
+	if err := p.findProposalFile(); err != nil {
+		return err
+	}
+
+	// Make sure the commit can be submitted before creating anything on
+	// GitHub
+	if err := p.step(stepPreflight, p.preflight); err != nil {
+		return err
+	}
+
+	if err := p.step(stepTests, p.runTests); err != nil {
+		return err
+	}
+
+	if p.isDraft {
+		if err := p.step(stepDiscussion, p.createDiscussion); err != nil {
+			return err
+		}
+	} else {
+		if err := p.step(stepDiscussion, p.verifyDiscussion); err != nil {
+			return err
 		}
+	}
 
-		// Amend the commit
-		_, _, err = p.runCommand("git", "commit", "--amend", "--no-edit")
-		if err != nil {
-			return fmt.Errorf("failed to amend commit with document updates: %v", err)
+	// Let the author approve the summary, to be stored in the document.
+	// Only the summarizer is limited in time here, not the author.
+	if p.reviewSummaries {
+		if err := p.reviewSummary(); err != nil {
+			return err
+		}
+	}
+
+	err = p.step(stepEdits, func() error {
+		if err := p.renameProposal(); err != nil {
+			return err
 		}
 
-		p.logger.Success("Updated document references to discussion #%s", p.discussionNumber)
-	} else {
-		p.logger.Info("No document references needed updating")
+		// Update document references to discussion number
+		if err := p.updateDocumentReferences(); err != nil {
+			return err
+		}
+
+		// Number the commit subject and link the discussion in a trailer
+		if err := p.updateCommitMessage(); err != nil {
+			return err
+		}
+
+		// Make all the changes to the document in one rewrite of its commit
+		return p.commitDocumentEdits()
+	})
+	if err != nil {
+		return err
 	}
 
+	// Step 4: Submit the commit for review
+	if err := p.step(stepSubmit, p.reviewBackend().submit); err != nil {
+		return err
+	}
+
+	// Nothing needs the worktree any more; bring the current branch up to
+	// date now rather than after waiting for the review.
+	if err := p.closeWorktree(); err != nil {
+		return err
+	}
+
+	// Update the GitHub discussion with proposal content, now that the
+	// review it links to exists
+	err = p.step(stepUpdate, func() error {
+		return p.updateDiscussionContent(p.clNumber)
+	})
+	if err != nil {
+		return err
+	}
+
+	// Point reviewers at the discussion
+	if err := p.step(stepReview, p.postReviewMessage); err != nil {
+		p.logger.Warning("Could not post review message: %v", err)
+	}
+
+	// Step 5: Run trybots; a failure stops the workflow before finalizing
+	err = p.step(stepTrybots, func() error {
+		return p.runTrybots(p.context())
+	})
+	if err != nil {
+		return err
+	}
+
+	// Step 6: Wait for the review to be submitted and finalize the discussion
+	if wait {
+		if p.clNumber == "" {
+			return fmt.Errorf("no CL or pull request number available; cannot wait for submission")
+		}
+		if err := p.finalize(ctx, opts); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
 func main() {
+	// Subcommands come first; anything else is the publish workflow.
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "status":
+			drifted, err := runStatus(os.Args[2:])
+			if err != nil {
+				log.Fatal(err)
+			}
+			if drifted > 0 {
+				os.Exit(1)
+			}
+			return
+		case "finalize":
+			if err := runFinalize(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		case "sync-review":
+			if err := runSyncReview(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		case "undo":
+			if err := runUndo(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		case "backups":
+			if err := runBackups(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+	}
+
 	// Parse command line flags
 	var (
-		dryRun = flag.Bool("dry-run", false, "Show what would be done without making changes")
-		useAI  = flag.Bool("use-ai", true, "Use Claude AI for summary generation (default: true)")
-		help   = flag.Bool("help", false, "Show help message")
+		dryRun   = flag.Bool("dry-run", false, "Show what would be done without making changes")
+		useAI    = flag.Bool("use-ai", true, "Generate the summary with the summary-command, Claude by default (default: true)")
+		full     = flag.Bool("full-text", false, "Post the complete proposal text to the discussion instead of a summary")
+		wait     = flag.Bool("wait", false, "Wait for the CL to be merged or abandoned, then finalize the discussion")
+		interval = flag.Duration("poll-interval", defaultPollInterval, "Time between checks of the CL status with --wait")
+		timeout  = flag.Duration("timeout", 0, "Give up waiting after this long with --wait (default: wait until interrupted)")
+		review   = flag.String("review", "", "Review backend to submit to: gerrit or github (default from publish.cfg, else gerrit)")
+		force    = flag.Bool("force-rewrite", false, "Rewrite commits even if they are on a remote branch or were already merged")
+		keep     = flag.Bool("keep-worktree", false, "Keep the temporary worktree the workflow runs in, for debugging")
+		approve  = flag.Bool("review-summary", false, "Review the summary before it is posted and store the approved one in the proposal")
+		changes  = flag.Bool("changes", false, "Post the changes since the last published revision of a numbered proposal to its discussion")
+		help     = flag.Bool("help", false, "Show help message")
 	)
 
 	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage: %s [--dry-run] [commit-ref]\n\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "Publish a CUE proposal from a git commit through the Gerrit workflow.\n\n")
+		fmt.Fprintf(os.Stderr, "Usage: %s [--dry-run] [--wait] [commit-ref]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s status [--all] [NNNN|file]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s finalize [--poll-interval d] [--timeout d] [commit-ref]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s sync-review [--dry-run] [commit-ref]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s undo [--dry-run] [backup]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s backups [--prune [--keep n] [--older-than d]]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Publish a CUE proposal from a git commit through Gerrit or a GitHub pull request.\n\n")
 		fmt.Fprintf(os.Stderr, "Arguments:\n")
 		fmt.Fprintf(os.Stderr, "  commit-ref   Git commit reference containing the proposal (default: HEAD)\n")
 		fmt.Fprintf(os.Stderr, "               Can be a commit hash, branch name, or any git reference\n\n")
@@ -1405,6 +1661,8 @@ func main() {
 		fmt.Fprintf(os.Stderr, "  %s abc123             # Publish proposal in specific commit\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "  %s HEAD~2             # Publish proposal from 2 commits ago\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "  %s --dry-run HEAD     # Preview what would happen\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s --wait             # Publish, then finalize once the CL is merged\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s --review=github    # Publish through a pull request instead of Gerrit\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "\nThe commit should contain exactly one proposal file (designs/*.md).\n")
 		fmt.Fprintf(os.Stderr, "Draft proposals (xxxx-*.md) will get a discussion number assigned.\n")
 		fmt.Fprintf(os.Stderr, "Numbered proposals (NNNN-*.md) will update existing discussion #NNNN.\n")
@@ -1424,59 +1682,38 @@ func main() {
 	}
 
 	publisher := NewPublisher(commitRef, *dryRun, *useAI)
+	publisher.fullText = *full
+	publisher.forceRewrite = *force
+	publisher.reviewSummaries = *approve
+	publisher.postChangeSummary = *changes
 
-	if *dryRun {
-		publisher.logger.Info("🔍 DRY RUN MODE - No changes will be made")
-	}
-
-	publisher.logger.Info("Working with commit: %s", commitRef)
-	publisher.logger.Info("Starting publication workflow...")
-
-	// Execute workflow steps
-	if err := publisher.findProposalFile(); err != nil {
-		log.Fatal(err)
-	}
-
-	if err := publisher.runTests(); err != nil {
+	if err := publisher.loadConfig(); err != nil {
 		log.Fatal(err)
 	}
-
-	if publisher.isDraft {
-		if err := publisher.createDiscussion(); err != nil {
-			log.Fatal(err)
-		}
-	} else {
-		if err := publisher.verifyDiscussion(); err != nil {
-			log.Fatal(err)
-		}
+	if *review == "" {
+		*review = publisher.config.Review
 	}
-
-	if err := publisher.renameProposal(); err != nil {
+	if err := publisher.setReviewBackend(*review); err != nil {
 		log.Fatal(err)
 	}
 
-	// Update document references to discussion number
-	if err := publisher.updateDocumentReferences(); err != nil {
-		log.Fatal(err)
+	if *dryRun {
+		publisher.logger.Info("🔍 DRY RUN MODE - No changes will be made")
 	}
 
-	// Update the GitHub discussion with proposal content
-	if err := publisher.updateDiscussionContent(""); err != nil {
-		log.Fatal(err)
-	}
+	publisher.logger.Info("Working with commit: %s", commitRef)
+	publisher.logger.Info("Starting publication workflow...")
 
-	// Step 4: Submit CL via git codereview mail
-	if err := publisher.submitCL(); err != nil {
-		log.Fatal(err)
-	}
+	ctx, stop := interruptContext()
+	defer stop()
 
-	// Step 5: Run trybots
-	if err := publisher.runTrybots(); err != nil {
+	opts := waitOptions{interval: *interval, timeout: *timeout}
+	if err := publisher.publish(ctx, *keep, *wait, opts); err != nil {
 		log.Fatal(err)
 	}
 
 	publisher.logger.Success("🎉 Proposal setup completed successfully!")
 	publisher.logger.Info("")
 	publisher.logger.Info("Discussion: %s", publisher.discussionURL)
-	publisher.logger.Info("CL: %s", publisher.clURL)
+	publisher.logger.Info("Review: %s", publisher.clURL)
 }
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"os"
 	"os/exec"
@@ -473,21 +475,10 @@ func TestUpdateDiscussionLink(t *testing.T) {
 
 Test content.`
 
-		repo.writeFile("test1.md", content)
-
-		publisher := &Publisher{
-			logger:          NewLogger(),
-			newProposalFile: filepath.Join(repo.dir, "test1.md"),
-			discussionURL:   "https://github.com/cue-lang/cue/discussions/9999",
-			dryRun:          false,
-			isDraft:         true,
-		}
-
-		if err := publisher.updateDiscussionLink(); err != nil {
-			t.Errorf("Failed to update discussion link: %v", err)
+		updated, found := setDiscussionLink(content, "https://github.com/cue-lang/cue/discussions/9999")
+		if !found {
+			t.Error("Discussion Channel field not found")
 		}
-
-		updated := repo.readFile("test1.md")
 		if !strings.Contains(updated, "discussions/9999") {
 			t.Error("Discussion link not updated")
 		}
@@ -507,26 +498,22 @@ Test content.`
 
 Test content.`
 
-		repo.writeFile("test2.md", content)
-
-		publisher := &Publisher{
-			logger:          NewLogger(),
-			newProposalFile: filepath.Join(repo.dir, "test2.md"),
-			discussionURL:   "https://github.com/cue-lang/cue/discussions/8888",
-			dryRun:          false,
-			isDraft:         true,
+		updated, found := setDiscussionLink(content, "https://github.com/cue-lang/cue/discussions/8888")
+		if !found {
+			t.Error("Discussion Channel field not added")
 		}
-
-		if err := publisher.updateDiscussionLink(); err != nil {
-			t.Errorf("Failed to add discussion link: %v", err)
+		if !strings.Contains(updated, "*   **Author(s)**: test@\n*   **Discussion Channel**: https://github.com/cue-lang/cue/discussions/8888\n") {
+			t.Errorf("Discussion link not added after the authors:\n%s", updated)
 		}
+	})
 
-		updated := repo.readFile("test2.md")
-		if !strings.Contains(updated, "Discussion Channel") {
-			t.Error("Discussion Channel field not added")
-		}
-		if !strings.Contains(updated, "discussions/8888") {
-			t.Error("Discussion link not added")
+	// A link that is filled in is neither replaced nor added again.
+	t.Run("KeepFilledInLink", func(t *testing.T) {
+		content := "*   **Author(s)**: test@\n*   **Discussion Channel**: https://github.com/cue-lang/cue/discussions/4014\n"
+
+		updated, found := setDiscussionLink(content, "https://github.com/cue-lang/cue/discussions/8888")
+		if !found || updated != content {
+			t.Errorf("Filled-in link changed:\n%s", updated)
 		}
 	})
 
@@ -534,36 +521,93 @@ Test content.`
 	t.Run("DryRunMode", func(t *testing.T) {
 		content := `# Test Proposal
 
-*   **Discussion Channel**: OLD_LINK
+*   **Discussion Channel**: TBD
 
 ## Summary
 
 Test.`
 
-		repo.writeFile("test3.md", content)
+		proposal := repo.createNumberedProposal("7777", "test3", content)
+
+		oldDir, _ := os.Getwd()
+		os.Chdir(repo.dir)
+		defer os.Chdir(oldDir)
 
 		publisher := &Publisher{
-			logger:          NewLogger(),
-			newProposalFile: filepath.Join(repo.dir, "test3.md"),
-			discussionURL:   "https://github.com/cue-lang/cue/discussions/7777",
-			dryRun:          true,
+			logger:        NewLogger(),
+			commitRef:     "HEAD",
+			proposalFile:  "designs/language/7777-test3.md",
+			discussionURL: "https://github.com/cue-lang/cue/discussions/7777",
+			dryRun:        true,
 		}
 
 		if err := publisher.updateDiscussionLink(); err != nil {
 			t.Errorf("Dry run failed: %v", err)
 		}
+		if err := publisher.commitDocumentEdits(); err != nil {
+			t.Errorf("Dry run failed: %v", err)
+		}
 
-		// Content should not change in dry-run mode
-		updated := repo.readFile("test3.md")
-		if !strings.Contains(updated, "OLD_LINK") {
-			t.Error("File was modified in dry-run mode")
+		// Neither the commit nor the checkout change in dry-run mode
+		if repo.getCommitHash() != proposal {
+			t.Error("Commit was rewritten in dry-run mode")
 		}
-		if strings.Contains(updated, "7777") {
+		if updated := repo.readFile("designs/language/7777-test3.md"); strings.Contains(updated, "discussions/7777") {
 			t.Error("File was modified in dry-run mode")
 		}
 	})
 }
 
+// TestDiscussionTitle tests deriving the discussion title from the document
+func TestDiscussionTitle(t *testing.T) {
+	content := `# Proposal: Postfix Aliases
+
+**Status:** Under Review<br>
+**Lifecycle:** Proposed<br>
+**Author(s):** mpvl@
+
+## Objective
+`
+
+	tests := []struct {
+		name   string
+		prefix string
+		number string
+		want   string
+	}{
+		{"NoPrefix", "", "4014", "Proposal: Postfix Aliases"},
+		{"NumberPrefix", "#{number}: ", "4014", "#4014: Proposal: Postfix Aliases"},
+		{"LifecyclePrefix", "[{lifecycle}] ", "4014", "[Proposed] Proposal: Postfix Aliases"},
+		{"StatusPrefix", "{status} - ", "", "Under Review - Proposal: Postfix Aliases"},
+		{"MissingNumber", "#{number}: ", "", "Proposal: Postfix Aliases"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			publisher := &Publisher{
+				logger:           NewLogger(),
+				discussionNumber: tt.number,
+				config:           Config{TitlePrefix: tt.prefix},
+			}
+			if got := publisher.discussionTitle(content); got != tt.want {
+				t.Errorf("discussionTitle() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("MetadataFormats", func(t *testing.T) {
+		for _, line := range []string{
+			"*   **Status**: Under Review",
+			"**Status:** Under Review",
+			"**Status:** Under Review<br>",
+		} {
+			if got := extractMetadataField("# T\n\n"+line+"\n", "Status"); got != "Under Review" {
+				t.Errorf("extractMetadataField(%q) = %q", line, got)
+			}
+		}
+	})
+}
+
 // TestIntegrationWorkflow tests a complete workflow
 func TestIntegrationWorkflow(t *testing.T) {
 	if testing.Short() {
@@ -604,13 +648,17 @@ How it will be implemented.
 	os.Chdir(repo.dir)
 	defer os.Chdir(oldDir)
 
-	// Run the complete workflow in dry-run mode
+	// Run the complete workflow in dry-run mode, with the checks passing
+	runner := newFakeRunner(t, "git")
+	runner.on("go", "test", "./...").returns("ok")
+	runner.on("sh", "-c", "cd internal/ci && go generate")
 	publisher := &Publisher{
 		logger:     NewLogger(),
 		commitRef:  "HEAD",
 		commitHash: repo.getShortCommitHash(),
 		dryRun:     true,
 		useAI:      false,
+		commands:   runner,
 	}
 
 	// Execute all steps
@@ -622,21 +670,35 @@ How it will be implemented.
 		{"runTests", publisher.runTests},
 		{"createDiscussion", publisher.createDiscussion},
 		{"renameProposal", publisher.renameProposal},
+		{"updateDocumentReferences", publisher.updateDocumentReferences},
+		{"commitDocumentEdits", publisher.commitDocumentEdits},
 		{"updateDiscussionContent", func() error {
 			return publisher.updateDiscussionContent("")
 		}},
 		{"submitCL", publisher.submitCL},
-		{"runTrybots", publisher.runTrybots},
+		{"runTrybots", func() error {
+			return publisher.runTrybots(context.Background())
+		}},
 	}
 
 	for _, step := range steps {
-		t.Run(step.name, func(t *testing.T) {
+		ok := t.Run(step.name, func(t *testing.T) {
 			if err := step.fn(); err != nil {
-				// Some steps may fail without proper setup (like cue or git-codereview)
-				// but we still want to test the flow
-				t.Logf("Step %s error (may be expected): %v", step.name, err)
+				t.Fatalf("Step %s failed: %v\n%s", step.name, err, runner.transcript())
 			}
 		})
+		if !ok {
+			return
+		}
+	}
+
+	for _, check := range publisher.checks {
+		if !check.passed {
+			t.Errorf("Check %q failed", check.name)
+		}
+	}
+	if calls := runner.ran("go", "test", "./..."); len(calls) != 1 {
+		t.Errorf("Expected the tests to run once, ran %d times", len(calls))
 	}
 
 	// Verify final state
@@ -650,3 +712,429 @@ How it will be implemented.
 		t.Error("New proposal file not set")
 	}
 }
+
+// workflowTest is a proposal commit to publish, in a repository reviewed on
+// a fake Gerrit server, with the commands other than git scripted for a
+// publish that succeeds: discussion 4014 and CL 1234, whose trybots pass.
+type workflowTest struct {
+	repo   *TestRepo
+	gerrit *fakeGerrit
+	runner *fakeRunner
+	trybot *script // cueckoo runtrybot
+	jobs   *script // the jobs of the trybot run
+}
+
+// newWorkflowTest commits the proposal file with content on top of a
+// repository reviewed on a fake Gerrit server, and changes to the
+// repository until the test ends. discussionBody is the body of the
+// discussion on GitHub.
+func newWorkflowTest(t *testing.T, file, content, discussionBody string) *workflowTest {
+	t.Helper()
+
+	w := &workflowTest{gerrit: newFakeGerrit(t), runner: newFakeRunner(t, "git")}
+	w.gerrit.addChange(testChangeID, 1234, 1, "NEW")
+	t.Setenv("NETRC", filepath.Join(t.TempDir(), "netrc"))
+
+	w.repo = NewTestRepo(t)
+	t.Cleanup(w.repo.Cleanup)
+	w.repo.writeFile("codereview.cfg", "gerrit: "+w.gerrit.URL+"/cue-lang/proposal\n")
+	w.repo.run("git", "add", "codereview.cfg")
+	w.repo.run("git", "commit", "-m", "Add codereview.cfg")
+	w.repo.writeFile(file, content)
+	w.repo.run("git", "add", file)
+	w.repo.run("git", "commit", "-m", "designs: add aliases\n\nChange-Id: "+testChangeID)
+
+	oldDir, _ := os.Getwd()
+	os.Chdir(w.repo.dir)
+	t.Cleanup(func() { os.Chdir(oldDir) })
+
+	discussion, _ := json.Marshal(map[string]interface{}{
+		"id":    "D_4014",
+		"url":   "https://github.com/cue-lang/cue/discussions/4014",
+		"title": "Aliases",
+		"body":  discussionBody,
+	})
+	r := w.runner
+	r.on("go", "test", "./...").returns("ok")
+	r.on("sh", "-c", "cd internal/ci && go generate")
+	r.on("gh", "api", "graphql", "...").withInput("discussionCategories").
+		returns(`{"data": {"repository": {"discussionCategories": {"nodes": [{"id": "C_1", "name": "General"}, {"id": "C_2", "name": "Proposals"}]}}}}`)
+	r.on("gh", "api", "graphql", "...").withInput("createDiscussion").
+		returns(`{"data": {"createDiscussion": {"discussion": {"number": 4014, "url": "https://github.com/cue-lang/cue/discussions/4014"}}}}`)
+	r.on("gh", "api", "graphql", "...").withInput("updateDiscussion").
+		returns(`{"data": {"updateDiscussion": {"discussion": {"url": "https://github.com/cue-lang/cue/discussions/4014"}}}}`)
+	r.on("gh", "api", "graphql", "...").withInput("discussion(number").
+		returns(`{"data": {"repository": {"discussion": ` + string(discussion) + `}}}`)
+	r.on("gh", "api", "graphql", "...").withInput("repository(owner").
+		returns(`{"data": {"repository": {"id": "R_1"}}}`)
+	r.on("gh", "api", "repos/cue-lang/proposal/commits/*").fails(1, "gh: No commit found for SHA (HTTP 422)")
+	r.on("git", "codereview", "mail", "*").
+		writes("remote: Processing changes: new: 1, done\nremote:   " + w.gerrit.URL + "/c/cue-lang/proposal/+/1234 designs: add aliases [NEW]\n")
+	w.trybot = r.on("cueckoo", "runtrybot", "*").returns("dispatched trybots")
+	r.on("gh", "api", "repos/cue-lang/proposal-trybot/actions/workflows/trybot.yaml/runs?event=push&per_page=50").
+		returns(`{"workflow_runs": [{"id": 7, "status": "completed", "conclusion": "success", "html_url": "https://github.com/cue-lang/proposal-trybot/actions/runs/7",
+			"head_commit": {"message": "designs: add aliases\n\nDispatch-Trailer: {\"type\":\"trybot\",\"CL\":1234,\"patchset\":1}\n"}}]}`)
+	w.jobs = r.on("gh", "api", "repos/cue-lang/proposal-trybot/actions/runs/7/jobs").
+		returns(`{"jobs": [{"name": "test", "status": "completed", "conclusion": "success"}]}`)
+	return w
+}
+
+// publish runs the publish workflow on commitRef, without waiting for the
+// review.
+func (w *workflowTest) publish(commitRef string) (*Publisher, error) {
+	p := &Publisher{logger: NewLogger(), commitRef: commitRef, commands: w.runner}
+	return p, p.publish(context.Background(), false, false, waitOptions{})
+}
+
+// inputs returns the standard input of the gh api graphql calls whose input
+// contains text.
+func (w *workflowTest) inputs(text string) []string {
+	var inputs []string
+	for _, c := range w.runner.ran("gh", "api", "graphql", "...") {
+		if strings.Contains(c.input, text) {
+			inputs = append(inputs, c.input)
+		}
+	}
+	return inputs
+}
+
+// input returns the standard input of the only gh api graphql call whose
+// input contains text.
+func (w *workflowTest) input(t *testing.T, text string) string {
+	t.Helper()
+	inputs := w.inputs(text)
+	if len(inputs) != 1 {
+		t.Fatalf("Expected one GraphQL call with %q, got %d:\n%s", text, len(inputs), w.runner.transcript())
+	}
+	return inputs[0]
+}
+
+const workflowProposal = `# Aliases
+
+*   **Status**: Draft
+*   **Author(s)**: test@
+*   **Discussion Channel**: TBD
+
+## Objective
+
+Allow fields to be referred to by another name, as [references](../references.md) are.
+
+## Detailed Design
+
+See #xxxx for the discussion.
+`
+
+// TestPublishDraft tests publishing a draft: the discussion is created, the
+// proposal renamed after it and mailed, and the discussion then updated with
+// the CL
+func TestPublishDraft(t *testing.T) {
+	w := newWorkflowTest(t, "designs/language/xxxx-aliases.md", workflowProposal, "")
+	p, err := w.publish("HEAD")
+	if err != nil {
+		t.Fatalf("publish failed: %v\n%s", err, w.runner.transcript())
+	}
+
+	if p.discussionNumber != "4014" || p.clNumber != "1234" {
+		t.Errorf("Wrong discussion #%s or CL %s", p.discussionNumber, p.clNumber)
+	}
+	if input := w.input(t, "createDiscussion"); !strings.Contains(input, `"categoryId":"C_2"`) || !strings.Contains(input, `"title":"Aliases"`) {
+		t.Errorf("Discussion not created in the Proposals category with the title: %s", input)
+	}
+
+	// The current branch has the proposal renamed and linked to the
+	// discussion, in the commit that was mailed.
+	if w.repo.fileExists("designs/language/xxxx-aliases.md") || !w.repo.fileExists("designs/language/4014-aliases.md") {
+		t.Fatal("Proposal not renamed")
+	}
+	content := w.repo.readFile("designs/language/4014-aliases.md")
+	if !strings.Contains(content, "**Discussion Channel**: https://github.com/cue-lang/cue/discussions/4014") || !strings.Contains(content, "See #4014") {
+		t.Errorf("Proposal not linked to the discussion:\n%s", content)
+	}
+	if calls := w.runner.ran("git", "codereview", "mail", "HEAD"); len(calls) != 1 {
+		t.Errorf("Expected HEAD to be mailed once:\n%s", w.runner.transcript())
+	}
+
+	update := w.input(t, "updateDiscussion")
+	for _, want := range []string{
+		w.gerrit.URL + "/c/cue-lang/proposal/+/1234",
+		"[revision under review](" + w.gerrit.URL + "/c/cue-lang/proposal/+/1234/1/designs/language/4014-aliases.md)",
+		"[proposal document](" + w.gerrit.URL + "/c/cue-lang/proposal/+/1234/1/designs/language/4014-aliases.md)",
+		// The commit is not on the mirror until it is merged.
+		"[references](https://github.com/cue-lang/proposal/blob/main/designs/references.md)",
+	} {
+		if !strings.Contains(update, want) {
+			t.Errorf("Discussion update lacks %q: %s", want, update)
+		}
+	}
+
+	if messages := w.gerrit.messages[testChangeID]; len(messages) != 1 || !strings.Contains(messages[0].Message, "discussions/4014") {
+		t.Errorf("Review message not posted: %+v", messages)
+	}
+	if calls := w.runner.ran("cueckoo", "runtrybot", w.repo.getCommitHash()); len(calls) != 1 {
+		t.Errorf("Trybots not run on the published commit:\n%s", w.runner.transcript())
+	}
+}
+
+// TestPublishNumbered tests that a numbered proposal is only published to a
+// discussion that was created for it
+func TestPublishNumbered(t *testing.T) {
+	const file = "designs/language/4014-aliases.md"
+
+	t.Run("Verified", func(t *testing.T) {
+		w := newWorkflowTest(t, file, workflowProposal, "This proposal is currently under review.\n\n**Status**: Draft under review")
+		if _, err := w.publish("HEAD"); err != nil {
+			t.Fatalf("publish failed: %v\n%s", err, w.runner.transcript())
+		}
+		if calls := w.inputs("createDiscussion"); len(calls) != 0 {
+			t.Error("Discussion created for a numbered proposal")
+		}
+		if content := w.repo.readFile(file); !strings.Contains(content, "**Discussion Channel**: https://github.com/cue-lang/cue/discussions/4014") {
+			t.Errorf("Discussion link not filled in:\n%s", content)
+		}
+		w.input(t, "updateDiscussion")
+	})
+
+	t.Run("Merged", func(t *testing.T) {
+		// The proposal is complete and its commit already on main, so
+		// there is nothing to rewrite, not even to add the trailer.
+		content := strings.NewReplacer("TBD", "https://github.com/cue-lang/cue/discussions/4014", "#xxxx", "#4014").Replace(workflowProposal)
+		w := newWorkflowTest(t, file, content, "This proposal is currently under review.\n\n**Status**: Draft under review")
+		w.gerrit.addChange(testChangeID, 1234, 1, reviewMerged)
+		w.repo.run("git", "update-ref", "refs/remotes/origin/main", "HEAD")
+		head := w.repo.getCommitHash()
+
+		if _, err := w.publish("HEAD"); err != nil {
+			t.Fatalf("publish failed: %v\n%s", err, w.runner.transcript())
+		}
+		if w.repo.getCommitHash() != head {
+			t.Error("Published commit rewritten")
+		}
+		if message := w.repo.run("git", "log", "-1", "--format=%B"); strings.Contains(message, discussionTrailer+":") {
+			t.Errorf("Trailer added to a published commit:\n%s", message)
+		}
+		w.input(t, "updateDiscussion")
+	})
+
+	t.Run("OtherDiscussion", func(t *testing.T) {
+		w := newWorkflowTest(t, file, workflowProposal, "How do I write a for loop in CUE?")
+		head := w.repo.getCommitHash()
+		_, err := w.publish("HEAD")
+		if err == nil || !strings.Contains(err.Error(), "discussion verification failed") {
+			t.Fatalf("Expected verification to fail, got: %v", err)
+		}
+		if calls := w.runner.ran("git", "codereview", "..."); len(calls) != 0 {
+			t.Errorf("Mailed a proposal for another discussion:\n%s", w.runner.transcript())
+		}
+		if calls := w.inputs("updateDiscussion"); len(calls) != 0 {
+			t.Error("Updated another discussion")
+		}
+		if w.repo.getCommitHash() != head {
+			t.Error("Branch rewritten although verification failed")
+		}
+	})
+}
+
+// TestPublishHistoricalCommit tests publishing a draft that is not the
+// latest commit: the commit is rewritten under the one after it, and the
+// rewritten commit is what gets mailed
+func TestPublishHistoricalCommit(t *testing.T) {
+	w := newWorkflowTest(t, "designs/language/xxxx-aliases.md", workflowProposal, "")
+	original := w.repo.getCommitHash()
+	w.repo.writeFile("NOTES.md", "Later work.\n")
+	w.repo.run("git", "add", "NOTES.md")
+	w.repo.run("git", "commit", "-m", "Add notes")
+
+	if _, err := w.publish("HEAD~1"); err != nil {
+		t.Fatalf("publish failed: %v\n%s", err, w.runner.transcript())
+	}
+
+	rewritten := strings.TrimSpace(w.repo.run("git", "rev-parse", "HEAD~1"))
+	if rewritten == original {
+		t.Fatal("Proposal commit not rewritten")
+	}
+	if files := w.repo.run("git", "diff-tree", "--no-commit-id", "--name-only", "-r", "HEAD~1"); strings.TrimSpace(files) != "designs/language/4014-aliases.md" {
+		t.Errorf("Rewritten commit changes %q", files)
+	}
+	if subject := w.repo.run("git", "log", "-1", "--format=%s"); strings.TrimSpace(subject) != "Add notes" || !w.repo.fileExists("NOTES.md") {
+		t.Error("Later commit not kept on top of the rewritten one")
+	}
+
+	mailed := w.runner.ran("git", "codereview", "mail", "*")
+	if len(mailed) != 1 || mailed[0].argv[3] != rewritten {
+		t.Errorf("Expected the rewritten commit %s to be mailed:\n%s", rewritten, w.runner.transcript())
+	}
+	if calls := w.runner.ran("cueckoo", "runtrybot", rewritten); len(calls) != 1 {
+		t.Errorf("Trybots not run on the rewritten commit:\n%s", w.runner.transcript())
+	}
+}
+
+// TestPublishTrybots tests that failing trybots stop the workflow, and that
+// missing cueckoo only skips them
+func TestPublishTrybots(t *testing.T) {
+	const file = "designs/language/4014-aliases.md"
+	const body = "**Status**: Draft under review"
+
+	t.Run("Failed", func(t *testing.T) {
+		w := newWorkflowTest(t, file, workflowProposal, body)
+		w.jobs.returns(`{"jobs": [
+			{"name": "test", "status": "completed", "conclusion": "failure", "html_url": "https://github.com/cue-lang/proposal-trybot/actions/runs/7/job/1"},
+			{"name": "lint", "status": "completed", "conclusion": "success"}]}`)
+		_, err := w.publish("HEAD")
+		want := "trybots failed: test (https://github.com/cue-lang/proposal-trybot/actions/runs/7)"
+		if err == nil || err.Error() != want {
+			t.Fatalf("Expected %q, got: %v", want, err)
+		}
+		// The review exists and the discussion links it, ready for a fix
+		// to be mailed.
+		w.input(t, "updateDiscussion")
+	})
+
+	t.Run("NoCueckoo", func(t *testing.T) {
+		w := newWorkflowTest(t, file, workflowProposal, body)
+		w.trybot.returns("").fails(127, "sh: cueckoo: command not found")
+		if _, err := w.publish("HEAD"); err != nil {
+			t.Fatalf("publish failed: %v\n%s", err, w.runner.transcript())
+		}
+		if w.jobs.used != 0 {
+			t.Errorf("Waited for trybots that were not started:\n%s", w.runner.transcript())
+		}
+	})
+}
+
+// TestSubmitCLNumber tests finding the number of the CL git codereview mail
+// created or updated, from its output or else from Gerrit
+func TestSubmitCLNumber(t *testing.T) {
+	gerrit := newFakeGerrit(t)
+	gerrit.addChange(testChangeID, 4321, 2, "NEW")
+	t.Setenv("NETRC", filepath.Join(t.TempDir(), "netrc"))
+
+	repo := newGerritTestRepo(t, gerrit)
+	defer repo.Cleanup()
+
+	oldDir, _ := os.Getwd()
+	os.Chdir(repo.dir)
+	defer os.Chdir(oldDir)
+
+	changeURL := func(number string) string { return gerrit.URL + "/c/cue-lang/proposal/+/" + number }
+	tests := []struct {
+		name           string
+		stdout, stderr string
+		exit           int
+		want           string // CL number
+		err            string
+	}{
+		{name: "Stderr", stderr: "remote: Processing changes: refs: 1, new: 1, done\nremote:   " + changeURL("1234") + " designs: add aliases [NEW]\n", want: "1234"},
+		{name: "Stdout", stdout: changeURL("1235") + " [NEW]\n", want: "1235"},
+		{name: "OtherServer", stderr: "remote:   https://review.example.com/c/cue-lang/proposal/+/99 [NEW]\n", want: "4321"},
+		{name: "NoURL", stderr: "remote: done\n", want: "4321"},
+		{name: "NoNewChanges", stderr: " ! [remote rejected] HEAD -> refs/for/master (no new changes)\n", exit: 1, want: "4321"},
+		{name: "Rejected", stderr: " ! [remote rejected] HEAD -> refs/for/master (prohibited by Gerrit)\n", exit: 1, err: "prohibited by Gerrit"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runner := newFakeRunner(t, "git")
+			runner.on("git", "codereview", "mail", "HEAD").returns(tt.stdout).fails(tt.exit, tt.stderr)
+			p := &Publisher{logger: NewLogger(), commitRef: "HEAD", commands: runner}
+
+			err := p.submitCL()
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("Expected error with %q, got: %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("submitCL failed: %v", err)
+			}
+			if p.clNumber != tt.want || p.clURL != changeURL(tt.want) {
+				t.Errorf("Got CL %s (%s), want %s", p.clNumber, p.clURL, tt.want)
+			}
+		})
+	}
+}
+
+// TestManagedRegion tests preserving text around the generated body
+func TestManagedRegion(t *testing.T) {
+	t.Run("NoMarkers", func(t *testing.T) {
+		got := replaceManagedRegion("old body from an earlier publish", "new")
+		want := managedBegin + "\nnew\n" + managedEnd
+		if got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+		if managedRegion(got) != "new" {
+			t.Errorf("managedRegion(%q) = %q", got, managedRegion(got))
+		}
+	})
+
+	t.Run("KeepsSurroundingText", func(t *testing.T) {
+		body := "Note from maintainers.\n\n" + managedBegin + "\nold\n" + managedEnd + "\n\nFooter."
+		got := replaceManagedRegion(body, "new")
+		want := "Note from maintainers.\n\n" + managedBegin + "\nnew\n" + managedEnd + "\n\nFooter."
+		if got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	})
+}
+
+// TestProposalStatus tests resolving proposals and their expected state
+func TestProposalStatus(t *testing.T) {
+	repo := NewTestRepo(t)
+	defer repo.Cleanup()
+
+	repo.createNumberedProposal("4014", "aliases", "# Aliases\n")
+	repo.createNumberedProposal("4019", "try", "# Try\n")
+	repo.createDraftProposal("draft", "# Draft\n")
+
+	oldDir, _ := os.Getwd()
+	os.Chdir(repo.dir)
+	defer os.Chdir(oldDir)
+
+	publisher := &Publisher{logger: NewLogger(), commitRef: "HEAD"}
+
+	t.Run("NumberedProposals", func(t *testing.T) {
+		files, err := publisher.numberedProposals()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(files, " ") != "designs/language/4014-aliases.md designs/language/4019-try.md" {
+			t.Errorf("Wrong proposals: %v", files)
+		}
+	})
+
+	t.Run("ResolveByNumber", func(t *testing.T) {
+		file, err := publisher.resolveProposal("4019")
+		if err != nil || file != "designs/language/4019-try.md" {
+			t.Errorf("resolveProposal(4019) = %q, %v", file, err)
+		}
+	})
+
+	t.Run("ResolveByPath", func(t *testing.T) {
+		file, err := publisher.resolveProposal("./designs/language/4014-aliases.md")
+		if err != nil || file != "designs/language/4014-aliases.md" {
+			t.Errorf("resolveProposal(path) = %q, %v", file, err)
+		}
+	})
+
+	t.Run("ResolveUnknown", func(t *testing.T) {
+		if _, err := publisher.resolveProposal("9999"); err == nil {
+			t.Error("Expected error for unknown discussion number")
+		}
+		if _, err := publisher.resolveProposal("designs/language/xxxx-draft.md"); err == nil {
+			t.Error("Expected error for draft proposal")
+		}
+	})
+
+	t.Run("ExpectClosed", func(t *testing.T) {
+		tests := map[string]bool{
+			"**Lifecycle:** Proposed / Under Review<br>": false,
+			"**Lifecycle:** Ideation / Implemented":      true,
+			"*   **Status**: Declined":                   true,
+			"**Status:** Draft":                          false,
+		}
+		for line, want := range tests {
+			if got := expectClosed("# T\n\n" + line + "\n"); got != want {
+				t.Errorf("expectClosed(%q) = %v, want %v", line, got, want)
+			}
+		}
+	})
+}
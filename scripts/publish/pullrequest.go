@@ -0,0 +1,371 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Where pull requests for proposals are opened.
+const (
+	pullRequestRepo = "cue-lang/proposal"
+	pullRequestBase = "main"
+)
+
+// pullRequestMarker marks the comment the tool posts on a pull request, so
+// that it is updated rather than posted again.
+const pullRequestMarker = "<!-- proposal-publish:review-message -->"
+
+// githubRemotePattern extracts the owner from the URL of a remote on
+// github.com, in either its https or its scp-like ssh form.
+var githubRemotePattern = regexp.MustCompile(`github\.com[:/]([^/]+)/[^/]+?(?:\.git)?/?$`)
+
+// pullRequest is a GitHub pull request.
+type pullRequest struct {
+	Number         int        `json:"number"`
+	HTMLURL        string     `json:"html_url"`
+	State          string     `json:"state"` // open or closed
+	Title          string     `json:"title"`
+	Body           string     `json:"body"`
+	MergedAt       *time.Time `json:"merged_at"`
+	MergeCommitSHA string     `json:"merge_commit_sha"`
+	Head           struct {
+		Ref string `json:"ref"`
+		SHA string `json:"sha"`
+	} `json:"head"`
+}
+
+// issueComment is a comment on the conversation of a pull request.
+type issueComment struct {
+	ID   int64  `json:"id"`
+	Body string `json:"body"`
+}
+
+// pullRequestBackend submits proposals as GitHub pull requests: the commit
+// is pushed to a branch named after the proposal, and a pull request from
+// that branch is opened or updated.
+type pullRequestBackend struct {
+	p     *Publisher
+	owner string // owner of the pushed branch, once known
+}
+
+func (b *pullRequestBackend) kind() string {
+	return "pull request"
+}
+
+func (b *pullRequestBackend) ref(number string) string {
+	return "PR #" + number
+}
+
+func (b *pullRequestBackend) reviewURL(number string) string {
+	if number == b.p.clNumber && b.p.clURL != "" {
+		return b.p.clURL
+	}
+	return fmt.Sprintf("%s/pull/%s", proposalRepoURL, number)
+}
+
+func (b *pullRequestBackend) fileURL(number string, revision int, file string) string {
+	// Pull requests show the changes of their latest commit only.
+	return strings.TrimSuffix(b.reviewURL(number), "/") + "/files"
+}
+
+// api calls the GitHub REST API through gh api, like the rest of the tool,
+// and decodes the JSON response into v, if v is not nil.
+func (b *pullRequestBackend) api(method, endpoint string, body, v interface{}) error {
+	data, err := b.p.callGitHubAPI(method, endpoint, body)
+	if err != nil || v == nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("failed to parse GitHub response: %v", err)
+	}
+	return nil
+}
+
+// remote returns the git remote the branch is pushed to.
+func (b *pullRequestBackend) remote() string {
+	if b.p.config.PushRemote != "" {
+		return b.p.config.PushRemote
+	}
+	return "origin"
+}
+
+// branch returns the name of the branch for the proposal, which stays the
+// same across updates.
+func (b *pullRequestBackend) branch() string {
+	file := b.p.newProposalFile
+	if file == "" {
+		file = b.p.proposalFile
+	}
+	return "proposal/" + strings.TrimSuffix(path.Base(file), ".md")
+}
+
+// head returns the head of the pull request as owner:branch.
+func (b *pullRequestBackend) head() (string, error) {
+	if b.owner == "" {
+		p := b.p
+		if remoteURL, _, err := p.runCommand("git", "remote", "get-url", b.remote()); err == nil {
+			if m := githubRemotePattern.FindStringSubmatch(strings.TrimSpace(remoteURL)); m != nil {
+				b.owner = m[1]
+			}
+		}
+		if b.owner == "" {
+			// Not a github.com remote; assume the branch is the user's.
+			var user struct {
+				Login string `json:"login"`
+			}
+			if err := b.api("GET", "user", nil, &user); err != nil {
+				return "", fmt.Errorf("failed to get GitHub user: %v", err)
+			}
+			b.owner = user.Login
+		}
+	}
+	return b.owner + ":" + b.branch(), nil
+}
+
+func (b *pullRequestBackend) preflight() error {
+	p := b.p
+	if _, _, err := p.runCommand("git", "remote", "get-url", b.remote()); err != nil {
+		return fmt.Errorf("git remote %q to push the pull request branch to does not exist; set push-remote in %s", b.remote(), configFile)
+	}
+	if _, stderr, err := p.runCommand("gh", "auth", "status"); err != nil {
+		return fmt.Errorf("gh is not logged in to GitHub; run gh auth login (stderr: %s)", strings.TrimSpace(stderr))
+	}
+	p.logger.Success("The commit can be pushed to %s for a pull request", b.remote())
+	return nil
+}
+
+// findPullRequest returns the most recent pull request from the proposal's
+// branch in the given state (open, closed or all), or nil if there is none.
+func (b *pullRequestBackend) findPullRequest(state string) (*pullRequest, error) {
+	head, err := b.head()
+	if err != nil {
+		return nil, err
+	}
+	query := url.Values{}
+	query.Set("head", head)
+	query.Set("base", pullRequestBase)
+	query.Set("state", state)
+
+	var prs []pullRequest
+	if err := b.api("GET", "repos/"+pullRequestRepo+"/pulls?"+query.Encode(), nil, &prs); err != nil {
+		return nil, fmt.Errorf("failed to list pull requests: %v", err)
+	}
+	if len(prs) == 0 {
+		return nil, nil
+	}
+	// Pull requests are listed newest first.
+	return &prs[0], nil
+}
+
+// record records the number and URL of a pull request as those of the
+// review.
+func (b *pullRequestBackend) record(pr *pullRequest) {
+	b.p.clNumber = strconv.Itoa(pr.Number)
+	b.p.clURL = pr.HTMLURL
+}
+
+func (b *pullRequestBackend) submit() error {
+	p := b.p
+	p.logger.Info("Step 4: Submitting pull request...")
+
+	if p.dryRun {
+		p.logger.Info("[DRY RUN] Would push %s to branch %s on %s and open or update a pull request", p.commitRef, b.branch(), b.remote())
+		p.clNumber = "12345"
+		p.clURL = b.reviewURL(p.clNumber)
+		return nil
+	}
+
+	// The commit is amended on every run, so the branch is force-pushed.
+	commit := p.commitHashFull()
+	refspec := commit + ":refs/heads/" + b.branch()
+	if _, stderr, err := p.runCommand("git", "push", "--force", b.remote(), refspec); err != nil {
+		return fmt.Errorf("failed to push branch %s: %v (stderr: %s)", b.branch(), err, stderr)
+	}
+	p.logger.Success("Pushed %s to %s on %s", shortHash(commit), b.branch(), b.remote())
+
+	message, _, err := p.runCommand("git", "log", "-1", "--format=%B", p.commitRef)
+	if err != nil {
+		return fmt.Errorf("failed to get commit message: %v", err)
+	}
+	title, body, _ := strings.Cut(strings.TrimSpace(message), "\n")
+	body = strings.TrimSpace(body)
+
+	pr, err := b.findPullRequest("open")
+	if err != nil {
+		return err
+	}
+	if pr != nil {
+		update := map[string]string{"title": title, "body": body}
+		if err := b.api("PATCH", fmt.Sprintf("repos/%s/pulls/%d", pullRequestRepo, pr.Number), update, pr); err != nil {
+			return fmt.Errorf("failed to update pull request #%d: %v", pr.Number, err)
+		}
+		b.record(pr)
+		p.logger.Success("Updated PR #%s: %s", p.clNumber, p.clURL)
+		return nil
+	}
+
+	head, err := b.head()
+	if err != nil {
+		return err
+	}
+	create := map[string]string{
+		"title": title,
+		"body":  body,
+		"head":  head,
+		"base":  pullRequestBase,
+	}
+	pr = &pullRequest{}
+	if err := b.api("POST", "repos/"+pullRequestRepo+"/pulls", create, pr); err != nil {
+		return fmt.Errorf("failed to open pull request: %v", err)
+	}
+	b.record(pr)
+	p.logger.Success("Opened PR #%s: %s", p.clNumber, p.clURL)
+	return nil
+}
+
+func (b *pullRequestBackend) lookup() (*reviewState, error) {
+	pr, err := b.findPullRequest("all")
+	if err != nil {
+		return nil, err
+	}
+	if pr == nil {
+		return nil, fmt.Errorf("no pull request found from branch %s", b.branch())
+	}
+	b.record(pr)
+
+	state := &reviewState{
+		number: b.p.clNumber,
+		url:    b.p.clURL,
+		status: reviewOpen,
+	}
+	switch {
+	case pr.MergedAt != nil:
+		state.status = reviewMerged
+		state.mergedCommit = pr.MergeCommitSHA
+	case pr.State == "closed":
+		state.status = reviewAbandoned
+	}
+	return state, nil
+}
+
+func (b *pullRequestBackend) postMessage(message string) (bool, error) {
+	p := b.p
+	var comments []issueComment
+	commentsPath := fmt.Sprintf("repos/%s/issues/%s/comments?per_page=100", pullRequestRepo, p.clNumber)
+	if err := b.api("GET", commentsPath, nil, &comments); err != nil {
+		return false, fmt.Errorf("failed to get comments of PR #%s: %v", p.clNumber, err)
+	}
+
+	body := pullRequestMarker + "\n" + message
+	for i := len(comments) - 1; i >= 0; i-- {
+		comment := comments[i]
+		if !strings.HasPrefix(comment.Body, pullRequestMarker) {
+			continue
+		}
+		if comment.Body == body {
+			return false, nil
+		}
+		update := map[string]string{"body": body}
+		if err := b.api("PATCH", fmt.Sprintf("repos/%s/issues/comments/%d", pullRequestRepo, comment.ID), update, nil); err != nil {
+			return false, fmt.Errorf("failed to update comment on PR #%s: %v", p.clNumber, err)
+		}
+		return true, nil
+	}
+
+	create := map[string]string{"body": body}
+	if err := b.api("POST", fmt.Sprintf("repos/%s/issues/%s/comments", pullRequestRepo, p.clNumber), create, nil); err != nil {
+		return false, fmt.Errorf("failed to comment on PR #%s: %v", p.clNumber, err)
+	}
+	return true, nil
+}
+
+func (b *pullRequestBackend) pushedRef() string {
+	return "refs/remotes/" + b.remote() + "/" + b.branch()
+}
+
+// mergedAs finds the pull request with commit at its head and reports
+// whether it was merged.
+func (b *pullRequestBackend) mergedAs(commit string) (string, error) {
+	var prs []pullRequest
+	err := b.api("GET", fmt.Sprintf("repos/%s/commits/%s/pulls", pullRequestRepo, commit), nil, &prs)
+	if err != nil && githubNotFound(err) {
+		// GitHub has never seen the commit, as before it is first pushed.
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to find pull requests for %s: %v", shortHash(commit), err)
+	}
+	for _, pr := range prs {
+		if pr.Head.SHA == commit && pr.MergedAt != nil {
+			return fmt.Sprintf("merged on GitHub as PR #%d in %s", pr.Number, shortHash(pr.MergeCommitSHA)), nil
+		}
+	}
+	return "", nil
+}
+
+// githubNotFound reports whether a gh api call failed because GitHub does
+// not know what it was asked about. GitHub answers 422 rather than 404 for
+// some unknown commits.
+func githubNotFound(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "(HTTP 404)") || strings.Contains(msg, "(HTTP 422)")
+}
+
+// startTrybots returns the trybot runs for the pushed commit. The trybot
+// workflow runs on pull requests by itself.
+func (b *pullRequestBackend) startTrybots() (trybotSource, error) {
+	return &pullRequestTrybots{b: b, commit: b.p.commitHashFull()}, nil
+}
+
+// pullRequestTrybots are the trybot workflow runs GitHub starts for a pull
+// request, identified by the commit at its head.
+type pullRequestTrybots struct {
+	b      *pullRequestBackend
+	commit string
+}
+
+func (t *pullRequestTrybots) find() (*workflowRun, error) {
+	query := url.Values{}
+	query.Set("event", "pull_request")
+	query.Set("head_sha", t.commit)
+
+	var result struct {
+		WorkflowRuns []workflowRun `json:"workflow_runs"`
+	}
+	runsPath := "repos/" + pullRequestRepo + "/actions/workflows/trybot.yaml/runs?" + query.Encode()
+	if err := t.b.api("GET", runsPath, nil, &result); err != nil {
+		return nil, err
+	}
+	var found *workflowRun
+	for i := range result.WorkflowRuns {
+		run := &result.WorkflowRuns[i]
+		if found == nil || run.CreatedAt.After(found.CreatedAt) {
+			found = run
+		}
+	}
+	return found, nil
+}
+
+func (t *pullRequestTrybots) run(id int64) (*workflowRun, error) {
+	var run workflowRun
+	if err := t.b.api("GET", fmt.Sprintf("repos/%s/actions/runs/%d", pullRequestRepo, id), nil, &run); err != nil {
+		return nil, err
+	}
+	return &run, nil
+}
+
+func (t *pullRequestTrybots) jobs(id int64) ([]workflowJob, error) {
+	var result struct {
+		Jobs []workflowJob `json:"jobs"`
+	}
+	if err := t.b.api("GET", fmt.Sprintf("repos/%s/actions/runs/%d/jobs", pullRequestRepo, id), nil, &result); err != nil {
+		return nil, err
+	}
+	return result.Jobs, nil
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeGitHub is a minimal stand-in for the parts of the GitHub REST API the
+// pull request backend uses. It is a Runner that answers gh api commands
+// and runs others, such as git, for real.
+type fakeGitHub struct {
+	mux *http.ServeMux
+
+	mu       sync.Mutex
+	pulls    []*pullRequest
+	heads    map[int]string // pull request number to owner:branch
+	comments map[int][]issueComment
+	runs     []workflowRun
+	jobs     map[int64][]workflowJob
+}
+
+func newFakeGitHub(t *testing.T) *fakeGitHub {
+	t.Helper()
+
+	g := &fakeGitHub{
+		heads:    make(map[int]string),
+		comments: make(map[int][]issueComment),
+		jobs:     make(map[int64][]workflowJob),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /user", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"login": "gopher"}`)
+	})
+	mux.HandleFunc("GET /repos/cue-lang/proposal/pulls", g.listPulls)
+	mux.HandleFunc("GET /repos/cue-lang/proposal/commits/{sha}/pulls", g.commitPulls)
+	mux.HandleFunc("POST /repos/cue-lang/proposal/pulls", g.createPull)
+	mux.HandleFunc("PATCH /repos/cue-lang/proposal/pulls/{number}", g.updatePull)
+	mux.HandleFunc("GET /repos/cue-lang/proposal/issues/{number}/comments", g.listComments)
+	mux.HandleFunc("POST /repos/cue-lang/proposal/issues/{number}/comments", g.createComment)
+	mux.HandleFunc("PATCH /repos/cue-lang/proposal/issues/comments/{id}", g.updateComment)
+	mux.HandleFunc("GET /repos/cue-lang/proposal/actions/workflows/trybot.yaml/runs", g.listRuns)
+	mux.HandleFunc("GET /repos/cue-lang/proposal/actions/runs/{id}", g.getRun)
+	mux.HandleFunc("GET /repos/cue-lang/proposal/actions/runs/{id}/jobs", g.listJobs)
+
+	g.mux = mux
+	return g
+}
+
+func (g *fakeGitHub) Run(ctx context.Context, dir, input, name string, args ...string) (string, string, error) {
+	if name != "gh" {
+		return execRunner{}.Run(ctx, dir, input, name, args...)
+	}
+	if len(args) == 2 && args[0] == "auth" && args[1] == "status" {
+		return "", "Logged in to github.com account gopher\n", nil
+	}
+	if len(args) < 2 || args[0] != "api" {
+		return "", "unknown command\n", exitError(1)
+	}
+
+	method := "GET"
+	var body io.Reader
+	for i := 2; i < len(args); i++ {
+		switch args[i] {
+		case "--method":
+			i++
+			method = args[i]
+		case "--input":
+			i++
+			body = strings.NewReader(input)
+		}
+	}
+	r := httptest.NewRequestWithContext(ctx, method, "/"+args[1], body)
+	w := httptest.NewRecorder()
+	g.mu.Lock()
+	g.mux.ServeHTTP(w, r)
+	g.mu.Unlock()
+
+	if w.Code < 200 || w.Code >= 300 {
+		return w.Body.String(), fmt.Sprintf("gh: %s (HTTP %d)\n", http.StatusText(w.Code), w.Code), exitError(1)
+	}
+	return w.Body.String(), "", nil
+}
+
+func (g *fakeGitHub) listPulls(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	prs := []*pullRequest{}
+	for i := len(g.pulls) - 1; i >= 0; i-- {
+		pr := g.pulls[i]
+		if g.heads[pr.Number] != query.Get("head") {
+			continue
+		}
+		if state := query.Get("state"); state != "all" && state != pr.State {
+			continue
+		}
+		prs = append(prs, pr)
+	}
+	json.NewEncoder(w).Encode(prs)
+}
+
+func (g *fakeGitHub) commitPulls(w http.ResponseWriter, r *http.Request) {
+	prs := []*pullRequest{}
+	for _, pr := range g.pulls {
+		if pr.Head.SHA == r.PathValue("sha") {
+			prs = append(prs, pr)
+		}
+	}
+	if len(prs) == 0 {
+		// The fake only knows the commits at the head of pull requests.
+		http.Error(w, `{"message": "No commit found for SHA"}`, http.StatusUnprocessableEntity)
+		return
+	}
+	json.NewEncoder(w).Encode(prs)
+}
+
+func (g *fakeGitHub) createPull(w http.ResponseWriter, r *http.Request) {
+	var input map[string]string
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	pr := &pullRequest{
+		Number: len(g.pulls) + 1,
+		State:  "open",
+		Title:  input["title"],
+		Body:   input["body"],
+	}
+	pr.HTMLURL = fmt.Sprintf("https://github.com/cue-lang/proposal/pull/%d", pr.Number)
+	g.pulls = append(g.pulls, pr)
+	g.heads[pr.Number] = input["head"]
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(pr)
+}
+
+func (g *fakeGitHub) updatePull(w http.ResponseWriter, r *http.Request) {
+	number, _ := strconv.Atoi(r.PathValue("number"))
+	if number < 1 || number > len(g.pulls) {
+		http.NotFound(w, r)
+		return
+	}
+	pr := g.pulls[number-1]
+	if err := json.NewDecoder(r.Body).Decode(pr); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(pr)
+}
+
+func (g *fakeGitHub) listComments(w http.ResponseWriter, r *http.Request) {
+	number, _ := strconv.Atoi(r.PathValue("number"))
+	comments := g.comments[number]
+	if comments == nil {
+		comments = []issueComment{}
+	}
+	json.NewEncoder(w).Encode(comments)
+}
+
+func (g *fakeGitHub) createComment(w http.ResponseWriter, r *http.Request) {
+	number, _ := strconv.Atoi(r.PathValue("number"))
+	var comment issueComment
+	if err := json.NewDecoder(r.Body).Decode(&comment); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	comment.ID = int64(1000*number + len(g.comments[number]))
+	g.comments[number] = append(g.comments[number], comment)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(comment)
+}
+
+func (g *fakeGitHub) updateComment(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	for _, comments := range g.comments {
+		for i := range comments {
+			if comments[i].ID != id {
+				continue
+			}
+			if err := json.NewDecoder(r.Body).Decode(&comments[i]); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			json.NewEncoder(w).Encode(comments[i])
+			return
+		}
+	}
+	http.NotFound(w, r)
+}
+
+func (g *fakeGitHub) listRuns(w http.ResponseWriter, r *http.Request) {
+	var result struct {
+		WorkflowRuns []workflowRun `json:"workflow_runs"`
+	}
+	result.WorkflowRuns = []workflowRun{}
+	for _, run := range g.runs {
+		if r.URL.Query().Get("head_sha") == run.HeadSHA && r.URL.Query().Get("event") == "pull_request" {
+			result.WorkflowRuns = append(result.WorkflowRuns, run)
+		}
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+func (g *fakeGitHub) getRun(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	for _, run := range g.runs {
+		if run.ID == id {
+			json.NewEncoder(w).Encode(run)
+			return
+		}
+	}
+	http.NotFound(w, r)
+}
+
+func (g *fakeGitHub) listJobs(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	json.NewEncoder(w).Encode(map[string][]workflowJob{"jobs": g.jobs[id]})
+}
+
+// TestPullRequestBackend tests submitting a proposal as a pull request to a
+// local remote and a fake GitHub
+func TestPullRequestBackend(t *testing.T) {
+	github := newFakeGitHub(t)
+
+	repo := NewTestRepo(t)
+	defer repo.Cleanup()
+	remote := filepath.Join(t.TempDir(), "proposal.git")
+	repo.run("git", "init", "--bare", remote)
+	repo.run("git", "remote", "add", "origin", remote)
+	repo.createNumberedProposal("4014", "aliases", "# Aliases\n\nAliases for everything.\n")
+
+	oldDir, _ := os.Getwd()
+	os.Chdir(repo.dir)
+	defer os.Chdir(oldDir)
+
+	publisher := &Publisher{
+		logger:           NewLogger(),
+		commitRef:        "HEAD",
+		discussionNumber: "4014",
+		discussionURL:    "https://github.com/cue-lang/cue/discussions/4014",
+		newProposalFile:  "designs/language/4014-aliases.md",
+		summary:          "Aliases for everything.",
+		commands:         github,
+	}
+	if err := publisher.setReviewBackend(backendGitHub); err != nil {
+		t.Fatal(err)
+	}
+	backend := publisher.reviewBackend()
+	branch := "refs/heads/proposal/4014-aliases"
+
+	if err := publisher.preflight(); err != nil {
+		t.Fatalf("preflight failed: %v", err)
+	}
+
+	t.Run("Open", func(t *testing.T) {
+		if err := backend.submit(); err != nil {
+			t.Fatalf("submit failed: %v", err)
+		}
+		if pushed := strings.TrimSpace(repo.run("git", "--git-dir", remote, "rev-parse", branch)); pushed != repo.getCommitHash() {
+			t.Errorf("Remote branch at %s, want %s", pushed, repo.getCommitHash())
+		}
+		if len(github.pulls) != 1 || github.heads[1] != "gopher:proposal/4014-aliases" {
+			t.Fatalf("Wrong pull requests: %v %v", github.pulls, github.heads)
+		}
+		if publisher.clNumber != "1" || publisher.clURL != "https://github.com/cue-lang/proposal/pull/1" {
+			t.Errorf("Wrong review recorded: %s %s", publisher.clNumber, publisher.clURL)
+		}
+	})
+
+	t.Run("Update", func(t *testing.T) {
+		repo.writeFile("designs/language/4014-aliases.md", "# Aliases\n\nAliases for most things.\n")
+		repo.run("git", "commit", "-a", "--amend", "-m", "designs: add aliases v2")
+
+		if err := backend.submit(); err != nil {
+			t.Fatalf("submit failed: %v", err)
+		}
+		if pushed := strings.TrimSpace(repo.run("git", "--git-dir", remote, "rev-parse", branch)); pushed != repo.getCommitHash() {
+			t.Errorf("Amended commit not force-pushed: remote at %s", pushed)
+		}
+		if len(github.pulls) != 1 || github.pulls[0].Title != "designs: add aliases v2" {
+			t.Errorf("Expected the pull request to be updated: %+v", github.pulls[0])
+		}
+	})
+
+	t.Run("Message", func(t *testing.T) {
+		for range 2 {
+			if err := publisher.postReviewMessage(); err != nil {
+				t.Fatalf("postReviewMessage failed: %v", err)
+			}
+		}
+		publisher.summary = "Aliases for most things."
+		if err := publisher.postReviewMessage(); err != nil {
+			t.Fatalf("postReviewMessage failed: %v", err)
+		}
+		comments := github.comments[1]
+		if len(comments) != 1 {
+			t.Fatalf("Expected 1 comment, got %d", len(comments))
+		}
+		if body := comments[0].Body; !strings.HasPrefix(body, pullRequestMarker) || !strings.Contains(body, "most things") {
+			t.Errorf("Wrong comment:\n%s", body)
+		}
+	})
+
+	t.Run("Trybots", func(t *testing.T) {
+		github.runs = append(github.runs, workflowRun{ID: 7, Status: "completed", Conclusion: "success", HeadSHA: repo.getCommitHash()})
+		github.jobs[7] = []workflowJob{{Name: "test", Status: "completed", Conclusion: "success"}}
+
+		source, err := backend.startTrybots()
+		if err != nil {
+			t.Fatalf("startTrybots failed: %v", err)
+		}
+		opts := waitOptions{interval: 10 * time.Millisecond, timeout: 5 * time.Second}
+		run, jobs, err := publisher.waitForTrybots(context.Background(), opts, source)
+		if err != nil {
+			t.Fatalf("waitForTrybots failed: %v", err)
+		}
+		if run.ID != 7 || len(jobs) != 1 {
+			t.Errorf("Wrong run: %+v %+v", run, jobs)
+		}
+	})
+
+	t.Run("Lookup", func(t *testing.T) {
+		state, err := backend.lookup()
+		if err != nil {
+			t.Fatalf("lookup failed: %v", err)
+		}
+		if state.status != reviewOpen {
+			t.Errorf("Wrong status: %s", state.status)
+		}
+		if merged, err := backend.mergedAs(repo.getCommitHash()); err != nil || merged != "" {
+			t.Errorf("Commit GitHub has not seen reported as merged: %q, %v", merged, err)
+		}
+		github.pulls[0].Head.SHA = repo.getCommitHash()
+		if merged, err := backend.mergedAs(repo.getCommitHash()); err != nil || merged != "" {
+			t.Errorf("Open pull request reported as merged: %q, %v", merged, err)
+		}
+
+		merged := time.Now()
+		github.pulls[0].State = "closed"
+		github.pulls[0].MergedAt = &merged
+		github.pulls[0].MergeCommitSHA = strings.Repeat("f", 40)
+		state, err = backend.lookup()
+		if err != nil {
+			t.Fatalf("lookup failed: %v", err)
+		}
+		if state.status != reviewMerged || state.mergedCommit != strings.Repeat("f", 40) {
+			t.Errorf("Wrong merged state: %+v", state)
+		}
+		if merged, err := backend.mergedAs(repo.getCommitHash()); err != nil || merged != "merged on GitHub as PR #1 in ffffffffffff" {
+			t.Errorf("Wrong merge reported: %q, %v", merged, err)
+		}
+	})
+
+	t.Run("DiscussionLink", func(t *testing.T) {
+		publisher.dryRun = true
+		defer func() { publisher.dryRun = false }()
+		generated, err := publisher.generateDiscussionContent(publisher.clNumber, "", false)
+		if err != nil {
+			t.Fatalf("generateDiscussionContent failed: %v", err)
+		}
+		for _, want := range []string{
+			"- **Pull request**: [PR #1](https://github.com/cue-lang/proposal/pull/1)",
+			"Comment on the [pull request](https://github.com/cue-lang/proposal/pull/1)",
+			"[revision under review](https://github.com/cue-lang/proposal/pull/1/files)",
+		} {
+			if !strings.Contains(generated.body, want) {
+				t.Errorf("Discussion body does not contain %q:\n%s", want, generated.body)
+			}
+		}
+		if m := clLinkPattern.FindStringSubmatch(generated.body); m == nil || m[2] != "1" {
+			t.Errorf("Link not recognized by status: %v", m)
+		}
+	})
+}
+
+// TestGitHubRemotePattern tests finding the owner of a branch from the URL
+// of the remote it is pushed to
+func TestGitHubRemotePattern(t *testing.T) {
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"https://github.com/gopher/proposal", "gopher"},
+		{"https://github.com/gopher/proposal.git", "gopher"},
+		{"git@github.com:gopher/proposal.git", "gopher"},
+		{"ssh://git@github.com/cue-lang/proposal", "cue-lang"},
+		{"https://review.gerrithub.io/cue-lang/proposal", ""},
+		{"/tmp/proposal.git", ""},
+	}
+	for _, tt := range tests {
+		got := ""
+		if m := githubRemotePattern.FindStringSubmatch(tt.url); m != nil {
+			got = m[1]
+		}
+		if got != tt.want {
+			t.Errorf("Owner of %s: got %q, want %q", tt.url, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// reviewMessageTag tags the review message posted by this tool. Gerrit
+// treats "autogenerated:" tags as bot messages and only shows the latest
+// message with a given tag by default, so a new message supersedes the
+// previous one.
+const reviewMessageTag = "autogenerated:proposal-publish"
+
+// reviewDetailLines is the number of lines of output shown for a failed
+// check; the end of the output usually says what went wrong.
+const reviewDetailLines = 10
+
+// patchSetPrefixPattern matches the "Patch Set N:" line Gerrit prepends to
+// review messages.
+var patchSetPrefixPattern = regexp.MustCompile(`^Patch Set \d+:(?: [^\n]*)?\n+`)
+
+// checkResult is the outcome of one of the checks run before publishing.
+type checkResult struct {
+	name   string
+	passed bool
+	detail string // output explaining a failure
+}
+
+// reviewMessage returns the text of the review message pointing reviewers
+// at the discussion.
+func reviewMessage(discussionURL, summary string, checks []checkResult) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Proposal discussion: %s\n", discussionURL)
+	b.WriteString("General feedback on the proposal belongs in the discussion; use the code review for comments on the text.\n")
+
+	if summary = strings.TrimSpace(summary); summary != "" {
+		fmt.Fprintf(&b, "\nSummary:\n\n%s\n", summary)
+	}
+
+	if len(checks) > 0 {
+		b.WriteString("\nChecks:\n")
+		for _, check := range checks {
+			result := "passed"
+			if !check.passed {
+				result = "failed"
+			}
+			fmt.Fprintf(&b, "  %s: %s\n", check.name, result)
+			if !check.passed && check.detail != "" {
+				lines := strings.Split(strings.TrimSpace(check.detail), "\n")
+				if len(lines) > reviewDetailLines {
+					lines = append([]string{"..."}, lines[len(lines)-reviewDetailLines:]...)
+				}
+				for _, line := range lines {
+					fmt.Fprintf(&b, "    %s\n", line)
+				}
+			}
+		}
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// lastReviewMessage returns the text of the most recent message posted by
+// this tool, without the patch set prefix Gerrit adds, or "" if there is
+// none.
+func lastReviewMessage(messages []gerritMessage) string {
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].Tag == reviewMessageTag {
+			return patchSetPrefixPattern.ReplaceAllString(messages[i].Message, "")
+		}
+	}
+	return ""
+}
+
+// postReviewMessage posts a message on the review linking the discussion,
+// with the proposal summary and the results of the checks. If the latest
+// message posted by the tool already says the same, nothing is posted, so
+// that re-mailing a patchset does not add noise to the review.
+func (p *Publisher) postReviewMessage() error {
+	backend := p.reviewBackend()
+	if p.clNumber == "" {
+		p.logger.Warn("No %s available, skipping review message", backend.kind())
+		return nil
+	}
+
+	message := reviewMessage(p.discussionURL, p.summary, p.checks)
+
+	if p.dryRun {
+		p.logger.Info("[DRY RUN] Would post review message on %s:", backend.ref(p.clNumber))
+		fmt.Fprintf(os.Stderr, "%s\n", message)
+		return nil
+	}
+
+	posted, err := backend.postMessage(message)
+	if err != nil {
+		return err
+	}
+	if !posted {
+		p.logger.Info("Review message on %s is up to date", backend.ref(p.clNumber))
+		return nil
+	}
+	p.logger.Success("Posted review message on %s linking the discussion", backend.ref(p.clNumber))
+	return nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestReviewMessage tests the text of the message posted on the CL
+func TestReviewMessage(t *testing.T) {
+	checks := []checkResult{
+		{name: "go test ./...", passed: true, detail: "ok"},
+		{name: "CUE workflow generation", passed: false, detail: strings.Repeat("noise\n", 20) + "cue: field not allowed"},
+	}
+	got := reviewMessage("https://github.com/cue-lang/cue/discussions/4014", "Aliases for everything.", checks)
+
+	for _, want := range []string{
+		"Proposal discussion: https://github.com/cue-lang/cue/discussions/4014\n",
+		"Summary:\n\nAliases for everything.\n",
+		"  go test ./...: passed\n",
+		"  CUE workflow generation: failed\n    ...\n",
+		"    cue: field not allowed",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("Message does not contain %q:\n%s", want, got)
+		}
+	}
+	if strings.Count(got, "noise") != reviewDetailLines-1 {
+		t.Errorf("Failure output not truncated:\n%s", got)
+	}
+
+	if got := reviewMessage("https://example.com/d/1", "", nil); strings.Contains(got, "Summary") || strings.Contains(got, "Checks") {
+		t.Errorf("Empty sections should be left out:\n%s", got)
+	}
+}
+
+// TestPostReviewMessage tests that the message is posted once and only
+// reposted when it changes
+func TestPostReviewMessage(t *testing.T) {
+	gerrit := newFakeGerrit(t)
+	gerrit.addChange(testChangeID, 4321, 1, "NEW")
+	t.Setenv("NETRC", filepath.Join(t.TempDir(), "netrc"))
+
+	repo := newGerritTestRepo(t, gerrit)
+	defer repo.Cleanup()
+
+	oldDir, _ := os.Getwd()
+	os.Chdir(repo.dir)
+	defer os.Chdir(oldDir)
+
+	publisher := &Publisher{
+		logger:        NewLogger(),
+		commitRef:     "HEAD",
+		clNumber:      "4321",
+		discussionURL: "https://github.com/cue-lang/cue/discussions/4014",
+		summary:       "Aliases for everything.",
+	}
+	post := func() {
+		t.Helper()
+		if err := publisher.postReviewMessage(); err != nil {
+			t.Fatalf("postReviewMessage failed: %v", err)
+		}
+	}
+
+	post()
+	post() // re-mail without changes
+	if n := len(gerrit.messages[testChangeID]); n != 1 {
+		t.Fatalf("Expected 1 message, got %d", n)
+	}
+	msg := gerrit.messages[testChangeID][0]
+	if msg.Tag != reviewMessageTag || !strings.Contains(msg.Message, publisher.discussionURL) {
+		t.Errorf("Wrong message: %+v", msg)
+	}
+
+	// Other reviewers' messages do not hide the tool's message.
+	gerrit.messages[testChangeID] = append(gerrit.messages[testChangeID],
+		gerritMessage{ID: "x", Message: "Patch Set 1: Code-Review+1\n\nLGTM"})
+	post()
+	if n := len(gerrit.messages[testChangeID]); n != 2 {
+		t.Fatalf("Expected no new message, got %d messages", n)
+	}
+
+	publisher.summary = "Aliases for most things."
+	post()
+	if n := len(gerrit.messages[testChangeID]); n != 3 {
+		t.Fatalf("Expected changed message to be posted, got %d messages", n)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// A Runner runs the external commands of the publish workflow: git, gh,
+// git codereview, cueckoo and the summarizer. Tests replace it with a fake
+// that replays scripted results.
+type Runner interface {
+	// Run runs the command name with args in dir, the current directory if
+	// dir is "", with input on its standard input. It returns what the
+	// command wrote to its standard output and standard error, and an error
+	// if it could not be run or did not exit successfully. The command is
+	// stopped when ctx is done.
+	Run(ctx context.Context, dir, input, name string, args ...string) (stdout, stderr string, err error)
+}
+
+// commandWaitDelay is how long a command that is stopped, because the
+// workflow was interrupted or its step timed out, has to exit after it is
+// sent an interrupt, before it is killed.
+const commandWaitDelay = 5 * time.Second
+
+// execRunner runs commands as subprocesses.
+type execRunner struct{}
+
+func (execRunner) Run(ctx context.Context, dir, input, name string, args ...string) (string, string, error) {
+	cmd := newCommand(ctx, dir, name, args...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if input != "" {
+		cmd.Stdin = strings.NewReader(input)
+	}
+	err := cmd.Run()
+	return stdout.String(), stderr.String(), err
+}
+
+// newCommand returns the command to run name with args in dir. It is
+// stopped when ctx is done, with an interrupt first so that commands such as
+// git can clean up after themselves.
+func newCommand(ctx context.Context, dir, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Dir = dir
+	cmd.Cancel = func() error { return cmd.Process.Signal(os.Interrupt) }
+	cmd.WaitDelay = commandWaitDelay
+	return cmd
+}
+
+// runner returns the Runner that runs the publisher's commands.
+func (p *Publisher) runner() Runner {
+	if p.commands == nil {
+		return execRunner{}
+	}
+	return p.commands
+}
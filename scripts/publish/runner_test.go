@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeRunner is a Runner for tests. It replays the scripted result of the
+// first script matching a command, and records every command it is asked
+// to run. Commands no script matches are run for real if their name is in
+// passthrough, such as git on a test repository, and fail the test
+// otherwise.
+type fakeRunner struct {
+	t           *testing.T
+	passthrough map[string]bool
+
+	mu      sync.Mutex
+	scripts []*script
+	calls   []runnerCall
+}
+
+// runnerCall is a command run through a fakeRunner.
+type runnerCall struct {
+	argv           []string
+	input          string
+	stdout, stderr string
+	err            error
+	scripted       bool
+}
+
+// script is the scripted result of the commands it matches.
+type script struct {
+	argv   []string // path.Match patterns, with a final "..." matching any others
+	input  string   // text standard input must contain
+	stdout string
+	stderr string
+	exit   int  // exit code; non-zero fails the command
+	once   bool // match only once
+	used   int
+}
+
+// exitError is the error of a scripted command with a non-zero exit code.
+type exitError int
+
+func (e exitError) Error() string { return fmt.Sprintf("exit status %d", int(e)) }
+
+func newFakeRunner(t *testing.T, passthrough ...string) *fakeRunner {
+	r := &fakeRunner{t: t, passthrough: map[string]bool{}}
+	for _, name := range passthrough {
+		r.passthrough[name] = true
+	}
+	return r
+}
+
+// on adds a script for the commands matching argv, which succeed without
+// output until told otherwise.
+func (r *fakeRunner) on(argv ...string) *script {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := &script{argv: argv}
+	r.scripts = append(r.scripts, s)
+	return s
+}
+
+// withInput restricts the script to commands whose standard input contains
+// text, such as the GraphQL query passed to gh api.
+func (s *script) withInput(text string) *script {
+	s.input = text
+	return s
+}
+
+func (s *script) returns(stdout string) *script {
+	s.stdout = stdout
+	return s
+}
+
+func (s *script) fails(exit int, stderr string) *script {
+	s.exit, s.stderr = exit, stderr
+	return s
+}
+
+// writes sets what the command writes to standard error.
+func (s *script) writes(stderr string) *script {
+	s.stderr = stderr
+	return s
+}
+
+// onlyOnce makes the script match only the first command it matches, so
+// that later scripts can give later results.
+func (s *script) onlyOnce() *script {
+	s.once = true
+	return s
+}
+
+func (s *script) matches(argv []string, input string) bool {
+	if s.once && s.used > 0 {
+		return false
+	}
+	if !strings.Contains(input, s.input) {
+		return false
+	}
+	for i, want := range s.argv {
+		if want == "..." && i == len(s.argv)-1 {
+			return true
+		}
+		if i >= len(argv) {
+			return false
+		}
+		if ok, _ := path.Match(want, argv[i]); !ok {
+			return false
+		}
+	}
+	return len(argv) == len(s.argv)
+}
+
+func (r *fakeRunner) Run(ctx context.Context, dir, input, name string, args ...string) (string, string, error) {
+	argv := append([]string{name}, args...)
+	call := runnerCall{argv: argv, input: input}
+
+	r.mu.Lock()
+	var found *script
+	for _, s := range r.scripts {
+		if s.matches(argv, input) {
+			found = s
+			s.used++
+			break
+		}
+	}
+	r.mu.Unlock()
+
+	switch {
+	case found != nil:
+		call.scripted = true
+		call.stdout, call.stderr = found.stdout, found.stderr
+		if found.exit != 0 {
+			call.err = exitError(found.exit)
+		}
+	case r.passthrough[name]:
+		call.stdout, call.stderr, call.err = execRunner{}.Run(ctx, dir, input, name, args...)
+	default:
+		r.t.Errorf("unexpected command: %s", strings.Join(argv, " "))
+		call.err = fmt.Errorf("%s: %w", name, exec.ErrNotFound)
+	}
+
+	r.mu.Lock()
+	r.calls = append(r.calls, call)
+	r.mu.Unlock()
+	return call.stdout, call.stderr, call.err
+}
+
+// ran returns the scripted commands that were run and match argv, as a
+// script would.
+func (r *fakeRunner) ran(argv ...string) []runnerCall {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	pattern := &script{argv: argv}
+	var calls []runnerCall
+	for _, c := range r.calls {
+		if c.scripted && pattern.matches(c.argv, c.input) {
+			calls = append(calls, c)
+		}
+	}
+	return calls
+}
+
+// transcript returns the commands that were run and their results, for
+// failure messages.
+func (r *fakeRunner) transcript() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var b strings.Builder
+	for _, c := range r.calls {
+		fmt.Fprintf(&b, "$ %s\n", strings.Join(c.argv, " "))
+		if c.err != nil {
+			fmt.Fprintf(&b, "  (%v) %s\n", c.err, strings.TrimSpace(c.stderr))
+		}
+	}
+	return b.String()
+}
+
+// TestFakeRunner tests matching and replaying scripts
+func TestFakeRunner(t *testing.T) {
+	r := newFakeRunner(t, "echo")
+	r.on("gh", "api", "graphql", "...").withInput("createDiscussion").returns("created")
+	r.on("gh", "api", "graphql", "...").returns("other")
+	r.on("cueckoo", "runtrybot", "*").fails(1, "no CL").onlyOnce()
+	r.on("cueckoo", "runtrybot", "*").returns("started")
+	r.on("gh", "api", "repos/cue-lang/proposal/commits/*").fails(1, "HTTP 404")
+
+	p := &Publisher{logger: NewLogger(), commands: r}
+	tests := []struct {
+		input  string
+		argv   []string
+		stdout string
+		err    bool
+	}{
+		{`{"query": "mutation { createDiscussion }"}`, []string{"gh", "api", "graphql", "--input", "-"}, "created", false},
+		{`{"query": "query { repository }"}`, []string{"gh", "api", "graphql", "--input", "-"}, "other", false},
+		{"", []string{"cueckoo", "runtrybot", "abc"}, "", true},
+		{"", []string{"cueckoo", "runtrybot", "abc"}, "started", false},
+		{"", []string{"gh", "api", "repos/cue-lang/proposal/commits/abc"}, "", true},
+		{"", []string{"echo", "real"}, "real\n", false},
+	}
+	for _, tt := range tests {
+		stdout, _, err := p.runCommandInput(tt.input, tt.argv[0], tt.argv[1:]...)
+		if stdout != tt.stdout || (err != nil) != tt.err {
+			t.Errorf("%v: got %q, %v", tt.argv, stdout, err)
+		}
+	}
+
+	if calls := r.ran("cueckoo", "..."); len(calls) != 2 {
+		t.Errorf("Expected 2 cueckoo runs, got %d:\n%s", len(calls), r.transcript())
+	}
+	if calls := r.ran("echo", "real"); len(calls) != 0 {
+		t.Error("Commands run for real recorded as scripted")
+	}
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+var (
+	// lastUpdatedPattern matches the timestamp line of the discussion body,
+	// which changes on every publish and is ignored when comparing.
+	lastUpdatedPattern = regexp.MustCompile(`(?m)^\*Last updated: .*\*$`)
+
+	// clLinkPattern matches the link to the CL or pull request in the
+	// discussion body.
+	clLinkPattern = regexp.MustCompile(`\*\*(Gerrit CL|Pull request)\*\*: \[(?:CL |PR #)(\d+)\]\(([^)]+)\)`)
+
+	// numberedFilePattern matches the file names of numbered proposals.
+	numberedFilePattern = regexp.MustCompile(`^(\d+)-.*\.md$`)
+
+	// proposalNumberPattern matches a proposal given by its number.
+	proposalNumberPattern = regexp.MustCompile(`^\d+$`)
+)
+
+// closedLifecycles are the lifecycle states (see designs/TEMPLATE.md) in
+// which a proposal's discussion is expected to be closed.
+var closedLifecycles = []string{"implemented", "obsolete", "abandoned", "declined"}
+
+// statusReport describes how a proposal discussion differs from what the
+// tool would post for the proposal in the repository.
+type statusReport struct {
+	file       string
+	number     string
+	url        string
+	bodyDiff   string   // unified diff of the managed region, live to generated
+	mismatches []string // metadata that differs
+}
+
+func (r *statusReport) upToDate() bool {
+	return r.bodyDiff == "" && len(r.mismatches) == 0
+}
+
+// runStatus implements "publish status": it regenerates the discussion
+// content for one or all numbered proposals and reports where the live
+// discussion has drifted from it. It returns the number of drifted
+// discussions.
+func runStatus(args []string) (int, error) {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	all := fs.Bool("all", false, "Report on every numbered proposal in designs/")
+	useAI := fs.Bool("use-ai", true, "Compare with the summary by the summary-command, Claude by default, as publish posts")
+	fullText := fs.Bool("full-text", false, "Compare against the full-text layout instead of a summary")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s status [--all] [NNNN|file]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Report differences between proposals in the repository and their GitHub discussions.\n\n")
+		fmt.Fprintf(os.Stderr, "Arguments:\n")
+		fmt.Fprintf(os.Stderr, "  NNNN|file    Discussion number or path of a numbered proposal\n")
+		fmt.Fprintf(os.Stderr, "               (default: the proposal in the HEAD commit)\n\n")
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		fs.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nExits with status 1 if any discussion is out of date.\n")
+	}
+	fs.Parse(args)
+
+	logger := NewLogger()
+	base := NewPublisher("HEAD", false, *useAI)
+	base.fullText = *fullText
+	if err := base.loadConfig(); err != nil {
+		return 0, err
+	}
+
+	var files []string
+	switch {
+	case *all:
+		if fs.NArg() > 0 {
+			return 0, fmt.Errorf("--all does not take arguments")
+		}
+		numbered, err := base.numberedProposals()
+		if err != nil {
+			return 0, err
+		}
+		files = numbered
+	case fs.NArg() > 1:
+		fs.Usage()
+		os.Exit(2)
+	case fs.NArg() == 1:
+		file, err := base.resolveProposal(fs.Arg(0))
+		if err != nil {
+			return 0, err
+		}
+		files = []string{file}
+	default:
+		if err := base.findProposalFile(); err != nil {
+			return 0, err
+		}
+		files = []string{base.proposalFile}
+	}
+
+	drifted := 0
+	for _, file := range files {
+		p := NewPublisher("HEAD", false, *useAI)
+		p.fullText = *fullText
+		p.config = base.config
+
+		report, err := p.proposalStatus(file)
+		if err != nil {
+			logger.Error("%s: %v", file, err)
+			drifted++
+			continue
+		}
+		printStatusReport(report)
+		if !report.upToDate() {
+			drifted++
+		}
+	}
+
+	if len(files) > 1 {
+		fmt.Printf("\n%d of %d discussions out of date\n", drifted, len(files))
+	}
+	return drifted, nil
+}
+
+// numberedProposals returns the paths of all numbered proposals in HEAD.
+func (p *Publisher) numberedProposals() ([]string, error) {
+	stdout, _, err := p.runCommand("git", "ls-tree", "-r", "--name-only", "HEAD", "designs")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list proposals: %v", err)
+	}
+
+	var files []string
+	for _, file := range strings.Fields(stdout) {
+		if strings.HasSuffix(file, ".md") && numberedFilePattern.MatchString(path.Base(file)) {
+			files = append(files, file)
+		}
+	}
+	return files, nil
+}
+
+// resolveProposal resolves a discussion number or file path given on the
+// command line to the path of a numbered proposal in HEAD.
+func (p *Publisher) resolveProposal(arg string) (string, error) {
+	files, err := p.numberedProposals()
+	if err != nil {
+		return "", err
+	}
+
+	if proposalNumberPattern.MatchString(arg) {
+		for _, file := range files {
+			if strings.HasPrefix(path.Base(file), arg+"-") {
+				return file, nil
+			}
+		}
+		return "", fmt.Errorf("no numbered proposal for discussion #%s in designs/", arg)
+	}
+
+	arg = path.Clean(strings.TrimPrefix(arg, "./"))
+	for _, file := range files {
+		if file == arg {
+			return file, nil
+		}
+	}
+	return "", fmt.Errorf("%s is not a numbered proposal in HEAD", arg)
+}
+
+// proposalStatus compares the discussion of the proposal in file with the
+// content the tool would generate for it.
+func (p *Publisher) proposalStatus(file string) (*statusReport, error) {
+	matches := numberedFilePattern.FindStringSubmatch(path.Base(file))
+	if matches == nil {
+		return nil, fmt.Errorf("not a numbered proposal")
+	}
+
+	// Compare against the revision of the document that was last changed,
+	// which is the one a publish would have linked to.
+	commit, _, err := p.runCommand("git", "log", "-1", "--format=%H", "HEAD", "--", file)
+	if err != nil || strings.TrimSpace(commit) == "" {
+		return nil, fmt.Errorf("failed to find last commit of %s: %v", file, err)
+	}
+	p.commitRef = strings.TrimSpace(commit)
+	p.commitHash = p.commitRef
+	p.proposalFile = file
+	p.newProposalFile = file
+	p.basename = path.Base(file)
+	p.isNumbered = true
+	p.discussionNumber = matches[1]
+
+	live, err := p.fetchDiscussion()
+	if err != nil {
+		return nil, err
+	}
+	report := &statusReport{file: file, number: p.discussionNumber, url: live.URL}
+
+	// The expected CL is the one Gerrit knows for the Change-Id of the
+	// commit. If it cannot be determined, a link that is present in the
+	// discussion is carried over and not reported.
+	liveCL := clLinkPattern.FindStringSubmatch(live.Body)
+	message, _, _ := p.runCommand("git", "log", "-1", "--format=%B", p.commitRef)
+	changeID := changeIDPattern.FindStringSubmatch(message)
+	var state *reviewState
+	switch {
+	case liveCL != nil && liveCL[1] == "Pull request":
+		// Published through a pull request, whose link is not checked.
+		if err := p.setReviewBackend(backendGitHub); err != nil {
+			return nil, err
+		}
+		if state, err = p.reviewBackend().lookup(); err != nil {
+			p.logger.Warn("Could not look up the pull request: %v", err)
+		}
+	case changeID == nil:
+		// Never mailed, as far as we can tell.
+	default:
+		if state, err = p.reviewBackend().lookup(); err != nil {
+			if liveCL == nil {
+				report.mismatches = append(report.mismatches,
+					fmt.Sprintf("CL link: missing, although %s was mailed as %s", shortHash(p.commitRef), changeID[1]))
+			}
+			break
+		}
+		switch {
+		case liveCL == nil:
+			report.mismatches = append(report.mismatches,
+				fmt.Sprintf("CL link: missing, expected CL %s", p.clNumber))
+		case liveCL[2] != p.clNumber:
+			report.mismatches = append(report.mismatches,
+				fmt.Sprintf("CL link: CL %s, expected CL %s", liveCL[2], p.clNumber))
+		}
+	}
+	if p.clNumber == "" && liveCL != nil {
+		p.clNumber, p.clURL = liveCL[2], liveCL[3]
+	}
+
+	// A finalized discussion has the final state of the review, and links
+	// pinned to the commit that was merged, as finalize posts them.
+	if state != nil {
+		p.clStatus = state.status
+		p.clRevision = state.revision
+		if state.status == reviewMerged {
+			p.mergedCommit = state.mergedCommit
+		}
+	}
+
+	// Summarizers that are worth caching are too slow, and too variable,
+	// to run for a comparison.
+	if s, err := p.newSummarizer(); err == nil && s.Key() != "" {
+		p.summarizer = &cachedSummarizer{p: p, s: s, posted: postedSummary(live.Body)}
+	}
+
+	generated, err := p.generateDiscussionContent(p.clNumber, live.ID, false)
+	if err != nil {
+		return nil, err
+	}
+
+	normalize := func(body string) string {
+		return lastUpdatedPattern.ReplaceAllString(strings.TrimSpace(body), "*Last updated: -*")
+	}
+	report.bodyDiff = unifiedDiff(
+		fmt.Sprintf("discussion #%s", p.discussionNumber),
+		fmt.Sprintf("%s@%s", file, shortHash(p.commitRef)),
+		normalize(managedRegion(live.Body)),
+		normalize(generated.body))
+
+	if live.Title != generated.title {
+		report.mismatches = append(report.mismatches,
+			fmt.Sprintf("title: %q, expected %q", live.Title, generated.title))
+	}
+
+	for _, label := range p.config.Labels {
+		found := false
+		for _, l := range live.Labels {
+			if strings.EqualFold(l, label) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			report.mismatches = append(report.mismatches, fmt.Sprintf("labels: missing %q", label))
+		}
+	}
+
+	content, _, err := p.runCommand("git", "show", fmt.Sprintf("%s:%s", p.commitRef, file))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read proposal file from commit: %v", err)
+	}
+	if wantClosed := expectClosed(content); live.Closed != wantClosed {
+		state := func(closed bool) string {
+			if closed {
+				return "closed"
+			}
+			return "open"
+		}
+		report.mismatches = append(report.mismatches,
+			fmt.Sprintf("state: %s, expected %s", state(live.Closed), state(wantClosed)))
+	}
+
+	return report, nil
+}
+
+// cachedSummarizer gives the summary publish would post without running the
+// summarizer s: the summary it made of the proposal, from the summary cache,
+// or else the summary posted to the discussion.
+type cachedSummarizer struct {
+	p      *Publisher
+	s      Summarizer
+	posted string
+}
+
+func (c *cachedSummarizer) Name() string { return c.s.Name() }
+
+// Key is empty, as the summaries are cached under the key of s.
+func (c *cachedSummarizer) Key() string { return "" }
+
+func (c *cachedSummarizer) Summarize(content string) (string, error) {
+	cache, err := c.p.summaryCachePath(c.s, content)
+	if err != nil {
+		return "", err
+	}
+	if summary, err := os.ReadFile(cache); err == nil {
+		return string(summary), nil
+	}
+	if c.posted == "" {
+		return "", fmt.Errorf("no cached summary, and none in the discussion")
+	}
+	c.p.logger.Info("No cached summary by %s; comparing with the summary in the discussion", c.s.Name())
+	return c.posted, nil
+}
+
+// postedSummary returns the summary in a discussion body generated by
+// generateDiscussionContent, or "" if it has none, as in full-text mode.
+func postedSummary(body string) string {
+	_, rest, ok := strings.Cut(managedRegion(body), "\n\n---\n\n# ")
+	if !ok {
+		return ""
+	}
+	// Skip the title.
+	if _, rest, ok = strings.Cut(rest, "\n\n"); !ok {
+		return ""
+	}
+	summary, _, ok := strings.Cut(rest, "\n\n---\n\n## Full Proposal")
+	if !ok {
+		return ""
+	}
+	return summary
+}
+
+// expectClosed reports whether the discussion of a proposal with the given
+// content should be closed, based on its lifecycle or status metadata.
+func expectClosed(content string) bool {
+	value := extractMetadataField(content, "Lifecycle")
+	if value == "" {
+		value = extractMetadataField(content, "Status")
+	}
+	// Lifecycles are often written as a progression, such as
+	// "Proposed / Under Review"; the last step is the current one.
+	if i := strings.LastIndex(value, "/"); i >= 0 {
+		value = value[i+1:]
+	}
+	value = strings.ToLower(strings.TrimSpace(value))
+	for _, closed := range closedLifecycles {
+		if value == closed {
+			return true
+		}
+	}
+	return false
+}
+
+// printStatusReport prints a status report to stdout.
+func printStatusReport(r *statusReport) {
+	if r.upToDate() {
+		fmt.Printf("%s: discussion #%s is up to date\n", r.file, r.number)
+		return
+	}
+
+	fmt.Printf("%s: discussion #%s is out of date (%s)\n", r.file, r.number, r.url)
+	for _, m := range r.mismatches {
+		fmt.Printf("  %s\n", m)
+	}
+	if r.bodyDiff != "" {
+		fmt.Println()
+		fmt.Print(r.bodyDiff)
+	}
+}
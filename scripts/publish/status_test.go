@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// discussionResponse returns the response of gh api graphql to a query
+// for discussion #4014, whose body is body.
+func discussionResponse(body string) string {
+	discussion, _ := json.Marshal(map[string]interface{}{
+		"id":    "D_4014",
+		"url":   "https://github.com/cue-lang/cue/discussions/4014",
+		"title": "Aliases",
+		"body":  body,
+	})
+	return `{"data": {"repository": {"discussion": ` + string(discussion) + `}}}`
+}
+
+// TestStatusSummary tests that status compares with the summary publish
+// posted by default, without running the summarizer
+func TestStatusSummary(t *testing.T) {
+	const file = "designs/language/4014-aliases.md"
+
+	gerrit := newFakeGerrit(t)
+	gerrit.addChange(testChangeID, 1234, 2, "NEW")
+	t.Setenv("NETRC", filepath.Join(t.TempDir(), "netrc"))
+
+	repo := newGerritTestRepo(t, gerrit)
+	defer repo.Cleanup()
+
+	oldDir, _ := os.Getwd()
+	os.Chdir(repo.dir)
+	defer os.Chdir(oldDir)
+
+	runner := newFakeRunner(t, "git")
+	runner.on("gh", "api", "repos/cue-lang/proposal/commits/*").fails(1, "gh: No commit found for SHA (HTTP 422)")
+	discussion := runner.on("gh", "api", "graphql", "...").withInput("discussion(number")
+	// Publishing runs the summary-command once; status must not.
+	runner.on("summarize").returns("Aliases, summarized.").onlyOnce()
+	config := Config{SummaryCommand: []string{"summarize"}}
+
+	published := &Publisher{
+		logger:           NewLogger(),
+		commitRef:        "HEAD",
+		newProposalFile:  file,
+		discussionNumber: "4014",
+		clNumber:         "1234",
+		useAI:            true,
+		config:           config,
+		commands:         runner,
+	}
+	generated, err := published.generateDiscussionContent(published.clNumber, "D_4014", false)
+	if err != nil {
+		t.Fatalf("generateDiscussionContent failed: %v", err)
+	}
+	discussion.returns(discussionResponse("Notes.\n\n" + replaceManagedRegion("", generated.body)))
+
+	status := func(useAI bool) *statusReport {
+		t.Helper()
+		p := &Publisher{logger: NewLogger(), useAI: useAI, config: config, commands: runner}
+		report, err := p.proposalStatus(file)
+		if err != nil {
+			t.Fatalf("proposalStatus failed: %v", err)
+		}
+		return report
+	}
+
+	if report := status(true); !report.upToDate() {
+		t.Errorf("Cached summary reported as drifted: %v\n%s", report.mismatches, report.bodyDiff)
+	}
+
+	// Without the cache, as on another machine, the summary in the
+	// discussion is the one publish posted.
+	if err := os.RemoveAll(filepath.Join(repo.dir, ".git", summaryCacheDir)); err != nil {
+		t.Fatal(err)
+	}
+	if report := status(true); !report.upToDate() {
+		t.Errorf("Posted summary reported as drifted: %v\n%s", report.mismatches, report.bodyDiff)
+	}
+
+	// Compared with the summary section instead, the summary differs.
+	if report := status(false); report.bodyDiff == "" {
+		t.Error("Summary by text extraction not reported as drifted")
+	}
+}
+
+// TestPostedSummary tests finding the summary in a generated discussion body
+func TestPostedSummary(t *testing.T) {
+	body := "- **Status**: Draft\n\n---\n\n# Aliases\n\nFirst paragraph.\n\n---\n\nSecond.\n\n---\n\n## Full Proposal\n\nSee the document."
+	if got := postedSummary(replaceManagedRegion("Notes.", body)); got != "First paragraph.\n\n---\n\nSecond." {
+		t.Errorf("postedSummary = %q", got)
+	}
+	if got := postedSummary("A discussion started by hand."); got != "" {
+		t.Errorf("Found a summary in a hand-written body: %q", got)
+	}
+}
+
+// TestStatusFinalized tests that the discussion of a proposal whose CL was
+// merged is compared with what finalize posted
+func TestStatusFinalized(t *testing.T) {
+	const file = "designs/language/4014-aliases.md"
+	const mergedCommit = "abc123" // current revision of changes on the fake Gerrit
+
+	gerrit := newFakeGerrit(t)
+	gerrit.addChange(testChangeID, 1234, 2, reviewMerged)
+	t.Setenv("NETRC", filepath.Join(t.TempDir(), "netrc"))
+
+	repo := newGerritTestRepo(t, gerrit)
+	defer repo.Cleanup()
+
+	oldDir, _ := os.Getwd()
+	os.Chdir(repo.dir)
+	defer os.Chdir(oldDir)
+
+	runner := newFakeRunner(t, "git")
+	discussion := runner.on("gh", "api", "graphql", "...").withInput("discussion(number")
+
+	finalized := &Publisher{
+		logger:           NewLogger(),
+		commitRef:        "HEAD",
+		newProposalFile:  file,
+		discussionNumber: "4014",
+		clNumber:         "1234",
+		clStatus:         reviewMerged,
+		mergedCommit:     mergedCommit,
+		commands:         runner,
+	}
+	generated, err := finalized.generateDiscussionContent(finalized.clNumber, "D_4014", false)
+	if err != nil {
+		t.Fatalf("generateDiscussionContent failed: %v", err)
+	}
+	if !strings.Contains(generated.body, "Merged ✅") || !strings.Contains(generated.body, "blob/"+mergedCommit+"/") {
+		t.Fatalf("Not a finalized body:\n%s", generated.body)
+	}
+	discussion.returns(discussionResponse(replaceManagedRegion("", generated.body)))
+
+	p := &Publisher{logger: NewLogger(), commands: runner}
+	report, err := p.proposalStatus(file)
+	if err != nil {
+		t.Fatalf("proposalStatus failed: %v", err)
+	}
+	if !report.upToDate() {
+		t.Errorf("Finalized discussion reported as drifted: %v\n%s", report.mismatches, report.bodyDiff)
+	}
+}
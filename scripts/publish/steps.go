@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Steps of the publish workflow that the commands they run are limited in
+// time for, so that a command that hangs, such as git codereview mail
+// waiting for credentials, does not block the workflow forever.
+const (
+	stepPreflight  = "preflight"  // checks before anything is created
+	stepTests      = "tests"      // go test and CUE workflow generation
+	stepDiscussion = "discussion" // creating or verifying the discussion
+	stepEdits      = "edits"      // renaming and editing the proposal commit
+	stepSubmit     = "submit"     // mailing the CL or pushing the branch
+	stepUpdate     = "update"     // updating the discussion
+	stepSummary    = "summary"    // each run of the summarizer
+	stepReview     = "review"     // posting the review message
+	stepTrybots    = "trybots"    // starting the trybots and waiting for them
+)
+
+// defaultStepTimeouts are the timeouts of the steps unless publish.cfg sets
+// them with timeouts.
+var defaultStepTimeouts = map[string]time.Duration{
+	stepPreflight:  2 * time.Minute,
+	stepTests:      10 * time.Minute,
+	stepDiscussion: 2 * time.Minute,
+	stepEdits:      2 * time.Minute,
+	stepSubmit:     5 * time.Minute,
+	stepUpdate:     10 * time.Minute,
+	stepSummary:    5 * time.Minute,
+	stepReview:     2 * time.Minute,
+	stepTrybots:    trybotTimeout + 5*time.Minute,
+}
+
+// cleanupTimeout limits the commands that clean up after the workflow,
+// which run even if it was interrupted.
+const cleanupTimeout = time.Minute
+
+// parseTimeouts parses the timeouts setting: a comma-separated list of
+// step=duration pairs, where a duration of 0 removes the limit.
+func parseTimeouts(value string) (map[string]time.Duration, error) {
+	timeouts := map[string]time.Duration{}
+	for _, pair := range strings.Split(value, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		step, duration, ok := strings.Cut(pair, "=")
+		step = strings.TrimSpace(step)
+		if !ok {
+			return nil, fmt.Errorf("expected step=duration, got %q", pair)
+		}
+		if _, ok := defaultStepTimeouts[step]; !ok {
+			var steps []string
+			for step := range defaultStepTimeouts {
+				steps = append(steps, step)
+			}
+			sort.Strings(steps)
+			return nil, fmt.Errorf("unknown step %q, expected one of %s", step, strings.Join(steps, ", "))
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(duration))
+		if err != nil {
+			return nil, fmt.Errorf("invalid timeout for %s: %v", step, err)
+		}
+		timeouts[step] = d
+	}
+	return timeouts, nil
+}
+
+// context returns the context commands run in.
+func (p *Publisher) context() context.Context {
+	if p.ctx == nil {
+		return context.Background()
+	}
+	return p.ctx
+}
+
+// ask prompts the user with Logger.Prompt and returns the answer, or the
+// error of the context commands run in once that is done, as on Ctrl-C,
+// without waiting for the answer.
+func (p *Publisher) ask(format string, args ...interface{}) (string, error) {
+	ctx := p.context()
+	type result struct {
+		answer string
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		answer, err := p.logger.Prompt(format, args...)
+		done <- result{answer, err}
+	}()
+	select {
+	case r := <-done:
+		return r.answer, r.err
+	case <-ctx.Done():
+		fmt.Fprintln(os.Stderr)
+		return "", ctx.Err()
+	}
+}
+
+// stepTimeout returns the timeout of the named step, or 0 if it has none.
+func (p *Publisher) stepTimeout(name string) time.Duration {
+	if d, ok := p.config.Timeouts[name]; ok {
+		return d
+	}
+	return defaultStepTimeouts[name]
+}
+
+// step runs f with the commands it runs stopped once the timeout of the
+// named step expires. Steps can be nested, and the shortest limit applies.
+func (p *Publisher) step(name string, f func() error) error {
+	d := p.stepTimeout(name)
+	if d <= 0 {
+		return f()
+	}
+	ctx, cancel := context.WithTimeoutCause(p.context(), d, fmt.Errorf("%s step timed out after %v", name, d))
+	defer cancel()
+	return p.withContext(ctx, f)
+}
+
+// cleanup runs f with commands that run even if the workflow has been
+// interrupted, within cleanupTimeout.
+func (p *Publisher) cleanup(f func() error) error {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(p.context()), cleanupTimeout)
+	defer cancel()
+	return p.withContext(ctx, f)
+}
+
+// withContext runs f with commands run in ctx.
+func (p *Publisher) withContext(ctx context.Context, f func() error) error {
+	old := p.ctx
+	p.ctx = ctx
+	defer func() { p.ctx = old }()
+	return f()
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestParseTimeouts tests the timeouts setting
+func TestParseTimeouts(t *testing.T) {
+	timeouts, err := parseTimeouts("tests=15m, summary=0")
+	if err != nil {
+		t.Fatalf("parseTimeouts failed: %v", err)
+	}
+	p := &Publisher{config: Config{Timeouts: timeouts}}
+	if d := p.stepTimeout(stepTests); d != 15*time.Minute {
+		t.Errorf("tests timeout = %v", d)
+	}
+	if d := p.stepTimeout(stepSummary); d != 0 {
+		t.Errorf("summary timeout = %v", d)
+	}
+	if d := p.stepTimeout(stepSubmit); d != defaultStepTimeouts[stepSubmit] {
+		t.Errorf("submit timeout = %v", d)
+	}
+
+	for _, value := range []string{"test=1m", "tests", "tests=soon"} {
+		if _, err := parseTimeouts(value); err == nil {
+			t.Errorf("parseTimeouts(%q) succeeded", value)
+		}
+	}
+}
+
+// TestStepTimeout tests that a command that hangs is stopped once its step
+// times out
+func TestStepTimeout(t *testing.T) {
+	p := &Publisher{
+		logger: NewLogger(),
+		config: Config{Timeouts: map[string]time.Duration{stepTests: 100 * time.Millisecond}},
+	}
+
+	start := time.Now()
+	var stderr string
+	err := p.step(stepTests, func() error {
+		var err error
+		_, stderr, err = p.runCommand("sleep", "10")
+		return err
+	})
+	if elapsed := time.Since(start); elapsed > commandWaitDelay {
+		t.Errorf("Command stopped only after %v", elapsed)
+	}
+	if err == nil || !strings.Contains(err.Error(), "tests step timed out after 100ms") {
+		t.Errorf("Expected a timeout error, got: %v", err)
+	}
+	if !strings.Contains(stderr, "timed out") {
+		t.Errorf("Timeout not reported on stderr: %q", stderr)
+	}
+
+	// Once the step is over, commands run without its limit again.
+	if _, _, err := p.runCommand("true"); err != nil {
+		t.Errorf("Command failed after the step: %v", err)
+	}
+}
+
+// TestCleanupAfterInterrupt tests that the worktree is still removed, and
+// the branch moved, when the workflow has been interrupted
+func TestCleanupAfterInterrupt(t *testing.T) {
+	repo := NewTestRepo(t)
+	defer repo.Cleanup()
+
+	proposal := repo.createDraftProposal("aliases", "# Aliases\n\n*   **Discussion Channel**: TBD\n")
+
+	oldDir, _ := os.Getwd()
+	os.Chdir(repo.dir)
+	defer os.Chdir(oldDir)
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	p := &Publisher{
+		logger:           NewLogger(),
+		ctx:              ctx,
+		commitRef:        "HEAD",
+		proposalFile:     "designs/language/xxxx-aliases.md",
+		basename:         "xxxx-aliases.md",
+		isDraft:          true,
+		discussionNumber: "4014",
+		discussionURL:    "https://github.com/cue-lang/cue/discussions/4014",
+	}
+	if err := p.openWorktree(false); err != nil {
+		t.Fatalf("openWorktree failed: %v", err)
+	}
+	dir := p.worktree.dir
+	if err := p.renameProposal(); err != nil {
+		t.Fatalf("renameProposal failed: %v", err)
+	}
+	if err := p.commitDocumentEdits(); err != nil {
+		t.Fatalf("commitDocumentEdits failed: %v", err)
+	}
+
+	interrupted := errors.New("received interrupt")
+	cancel(interrupted)
+	if _, _, err := p.runCommand("git", "status"); !errors.Is(err, interrupted) {
+		t.Errorf("Command run after the interrupt: %v", err)
+	}
+
+	if err := p.closeWorktree(); err != nil {
+		t.Fatalf("closeWorktree failed: %v", err)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("Worktree %s not removed: %v", dir, err)
+	}
+	if repo.getCommitHash() == proposal {
+		t.Error("Current branch not moved to the rewritten commit")
+	}
+}
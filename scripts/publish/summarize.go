@@ -0,0 +1,224 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// A Summarizer writes the summary of a proposal that is posted to its
+// discussion.
+type Summarizer interface {
+	// Name describes the summarizer in log messages.
+	Name() string
+
+	// Key identifies the summarizer and its settings in the summary cache:
+	// summarizers with the same key give interchangeable summaries of the
+	// same text. An empty key means summaries are not cached, for
+	// summarizers that are cheap to run anyway.
+	Key() string
+
+	// Summarize returns the summary of the proposal with the given text.
+	Summarize(content string) (string, error)
+}
+
+// sectionSummarizer summarizes a proposal by extracting its summary
+// section, or failing that its introduction.
+type sectionSummarizer struct {
+	p *Publisher
+}
+
+func (s sectionSummarizer) Name() string { return "text extraction" }
+func (s sectionSummarizer) Key() string  { return "" }
+
+func (s sectionSummarizer) Summarize(content string) (string, error) {
+	return s.p.extractProposalSummary(content), nil
+}
+
+// defaultSummaryCommand is the command summaries are generated with unless
+// publish.cfg sets summary-command.
+var defaultSummaryCommand = []string{"claude"}
+
+// defaultSummaryPrompt is the prompt summaries are generated with unless
+// publish.cfg sets summary-prompt.
+const defaultSummaryPrompt = `{proposal}
+You are summarizing a CUE language proposal for a GitHub discussion. Create a clear, concise summary that captures the essence of the proposal.
+
+Focus on:
+1. The problem being addressed
+2. The proposed solution
+3. Some key examples or use cases
+4. Key benefits and impact
+5. Any important technical details or considerations
+
+Guidelines:
+- Write 3-5 paragraphs
+- Use clear, accessible language
+- Highlight the most important aspects
+- Format in markdown
+- Don't include metadata lines (Status:, Author:, etc.)
+- Focus on the actual proposal content
+
+Please summarize this proposal:`
+
+// commandSummarizer summarizes a proposal with an external command, such as
+// an LLM command-line tool. The command is given the prompt on its standard
+// input and prints the summary.
+type commandSummarizer struct {
+	argv []string
+
+	// prompt is the prompt template. {proposal} is replaced by the text of
+	// the proposal and {title} by its "# " heading; without {proposal}, the
+	// text is put before the prompt.
+	prompt string
+
+	// note is appended to the summary to say how it was generated.
+	note string
+
+	run func(input string, name string, args ...string) (string, string, error)
+}
+
+func (s *commandSummarizer) Name() string { return s.argv[0] }
+
+func (s *commandSummarizer) Key() string {
+	return "command\x00" + strings.Join(s.argv, "\x00") + "\x00" + s.prompt + "\x00" + s.note
+}
+
+func (s *commandSummarizer) Summarize(content string) (string, error) {
+	stdout, stderr, err := s.run(s.input(content), s.argv[0], s.argv[1:]...)
+	if errors.Is(err, exec.ErrNotFound) {
+		return "", fmt.Errorf("%s not available", s.argv[0])
+	}
+	if err != nil {
+		return "", fmt.Errorf("%s failed: %v (stderr: %s)", s.argv[0], err, strings.TrimSpace(stderr))
+	}
+
+	summary := strings.TrimSpace(stdout)
+	if summary == "" {
+		return "", fmt.Errorf("%s returned an empty summary", s.argv[0])
+	}
+	if s.note != "" {
+		summary += "\n\n" + s.note
+	}
+	return summary, nil
+}
+
+// input returns the prompt for the proposal with the given text.
+func (s *commandSummarizer) input(content string) string {
+	prompt := s.prompt
+	if !strings.Contains(prompt, "{proposal}") {
+		prompt = "{proposal}\n" + prompt
+	}
+	// The title goes first so that a "{proposal}" in it is left alone.
+	prompt = strings.ReplaceAll(prompt, "{title}", extractTitle(content))
+	return strings.Replace(prompt, "{proposal}", content, 1)
+}
+
+// newSummarizer returns the summarizer set up by publish.cfg: the
+// summary-command with the summary-prompt if useAI is set, else
+// extraction of the summary section.
+func (p *Publisher) newSummarizer() (Summarizer, error) {
+	if !p.useAI {
+		return sectionSummarizer{p}, nil
+	}
+
+	s := &commandSummarizer{
+		argv:   p.config.SummaryCommand,
+		prompt: defaultSummaryPrompt,
+		run:    p.runCommandInput,
+	}
+	if len(s.argv) == 0 {
+		s.argv = defaultSummaryCommand
+		s.note = "_[Summary generated by Claude AI]_"
+	} else {
+		s.note = fmt.Sprintf("_[Summary generated by `%s`]_", filepath.Base(s.argv[0]))
+	}
+	if file := p.config.SummaryPrompt; file != "" {
+		prompt, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read summary prompt: %v", err)
+		}
+		s.prompt = string(prompt)
+	}
+	return s, nil
+}
+
+// summaryCacheDir is where summaries are cached, under the git directory
+// shared by all worktrees of the repository.
+const summaryCacheDir = "proposal-publish/summaries"
+
+// summaryCachePath returns the file the summary of content by s is cached
+// in, or "" if s is not cached.
+func (p *Publisher) summaryCachePath(s Summarizer, content string) (string, error) {
+	key := s.Key()
+	if key == "" {
+		return "", nil
+	}
+	gitDir, _, err := p.runCommand("git", "rev-parse", "--path-format=absolute", "--git-common-dir")
+	if err != nil {
+		return "", fmt.Errorf("failed to find git directory: %v", err)
+	}
+	sum := sha256.Sum256([]byte(key + "\x00" + content))
+	return filepath.Join(strings.TrimSpace(gitDir), summaryCacheDir, hex.EncodeToString(sum[:])+".md"), nil
+}
+
+// summarize returns the summary of the proposal with the given text. The
+// summary is taken from the cache if the same summarizer has summarized the
+// same text before, so republishing an unchanged proposal does not generate
+// it again, unless regenerate is set. If the summarizer fails, the summary
+// section is extracted instead.
+func (p *Publisher) summarize(content string, regenerate bool) string {
+	s := p.summarizer
+	if s == nil {
+		var err error
+		if s, err = p.newSummarizer(); err != nil {
+			p.logger.Warning("%v, falling back to text extraction", err)
+			s = sectionSummarizer{p}
+		}
+	}
+
+	summary, err := p.summarizeWith(s, content, regenerate)
+	if err != nil {
+		p.logger.Warning("Summary generation with %s failed: %v, falling back to text extraction", s.Name(), err)
+		return p.extractProposalSummary(content)
+	}
+	return summary
+}
+
+// summarizeWith returns the summary of content by s, through the cache
+// unless regenerate is set.
+func (p *Publisher) summarizeWith(s Summarizer, content string, regenerate bool) (string, error) {
+	cache, err := p.summaryCachePath(s, content)
+	if err != nil {
+		p.logger.Warn("Not caching the summary: %v", err)
+	}
+	if cache != "" && !regenerate {
+		if summary, err := os.ReadFile(cache); err == nil {
+			p.logger.Info("Using the cached summary by %s", s.Name())
+			return string(summary), nil
+		}
+	}
+
+	var summary string
+	err = p.step(stepSummary, func() error {
+		summary, err = s.Summarize(content)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	if cache != "" {
+		p.logger.Success("Generated summary with %s", s.Name())
+		if err := os.MkdirAll(filepath.Dir(cache), 0o777); err != nil {
+			p.logger.Warn("Could not cache the summary: %v", err)
+		} else if err := os.WriteFile(cache, []byte(summary), 0o666); err != nil {
+			p.logger.Warn("Could not cache the summary: %v", err)
+		}
+	}
+	return summary, nil
+}
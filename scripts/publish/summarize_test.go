@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeSummarizer is a Summarizer for tests that counts its calls.
+type fakeSummarizer struct {
+	key   string
+	err   error
+	calls int
+}
+
+func (s *fakeSummarizer) Name() string { return "fake" }
+func (s *fakeSummarizer) Key() string  { return s.key }
+
+func (s *fakeSummarizer) Summarize(content string) (string, error) {
+	s.calls++
+	if s.err != nil {
+		return "", s.err
+	}
+	return fmt.Sprintf("Summary %d of %s", s.calls, extractTitle(content)), nil
+}
+
+// TestSummaryCache tests that unchanged proposals are not summarized again
+func TestSummaryCache(t *testing.T) {
+	repo := NewTestRepo(t)
+	defer repo.Cleanup()
+
+	oldDir, _ := os.Getwd()
+	os.Chdir(repo.dir)
+	defer os.Chdir(oldDir)
+
+	fake := &fakeSummarizer{key: "fake"}
+	p := &Publisher{logger: NewLogger(), summarizer: fake}
+
+	if got := p.summarize("# Aliases\n", false); got != "Summary 1 of Aliases" {
+		t.Errorf("Wrong summary: %q", got)
+	}
+	if got := p.summarize("# Aliases\n", false); got != "Summary 1 of Aliases" || fake.calls != 1 {
+		t.Errorf("Summary not cached: %q after %d calls", got, fake.calls)
+	}
+	if got := p.summarize("# Aliases for all\n", false); got != "Summary 2 of Aliases for all" {
+		t.Errorf("Changed proposal not summarized again: %q", got)
+	}
+
+	// The cache is shared with the worktrees of the repository, and keyed
+	// by the summarizer settings too.
+	if err := p.openWorktree(false); err != nil {
+		t.Fatalf("openWorktree failed: %v", err)
+	}
+	got := p.summarize("# Aliases\n", false)
+	if err := p.closeWorktree(); err != nil {
+		t.Fatalf("closeWorktree failed: %v", err)
+	}
+	if got != "Summary 1 of Aliases" || fake.calls != 2 {
+		t.Errorf("Cache not used in worktree: %q after %d calls", got, fake.calls)
+	}
+	fake.key = "other"
+	if got := p.summarize("# Aliases\n", false); got != "Summary 3 of Aliases" {
+		t.Errorf("Cached summary of another summarizer used: %q", got)
+	}
+
+	entries, _ := os.ReadDir(filepath.Join(repo.dir, ".git", summaryCacheDir))
+	if len(entries) != 3 {
+		t.Errorf("Expected 3 cached summaries, got %d", len(entries))
+	}
+
+	// Summarizers without a key, and failures, are not cached.
+	fake.key = ""
+	p.summarize("# Aliases\n", false)
+	p.summarize("# Aliases\n", false)
+	if fake.calls != 5 {
+		t.Errorf("Expected 5 calls, got %d", fake.calls)
+	}
+	fake.key, fake.err = "failing", fmt.Errorf("no quota")
+	if got := p.summarize("# Aliases\n\nAliases for everything.\n", false); !strings.Contains(got, "Aliases for everything.") {
+		t.Errorf("No fallback to text extraction: %q", got)
+	}
+	if entries, _ := os.ReadDir(filepath.Join(repo.dir, ".git", summaryCacheDir)); len(entries) != 3 {
+		t.Errorf("Failed summary cached")
+	}
+}
+
+// TestCommandSummarizer tests generating summaries with a configured
+// command and prompt template
+func TestCommandSummarizer(t *testing.T) {
+	dir := t.TempDir()
+	promptFile := filepath.Join(dir, "prompt.txt")
+	if err := os.WriteFile(promptFile, []byte("Summarize {title}:\n{proposal}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Publisher{
+		logger: NewLogger(),
+		useAI:  true,
+		config: Config{SummaryCommand: []string{"sed", "s/^/> /"}, SummaryPrompt: promptFile},
+	}
+	s, err := p.newSummarizer()
+	if err != nil {
+		t.Fatalf("newSummarizer failed: %v", err)
+	}
+	got, err := s.Summarize("# Aliases\n\nText.\n")
+	if err != nil {
+		t.Fatalf("Summarize failed: %v", err)
+	}
+	want := "> Summarize Aliases:\n> # Aliases\n> \n> Text.\n\n_[Summary generated by `sed`]_"
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	// The default prompt comes after the proposal.
+	p.config = Config{SummaryCommand: []string{"cat"}}
+	s, _ = p.newSummarizer()
+	if got, _ := s.Summarize("# Aliases\n"); !strings.HasPrefix(got, "# Aliases\n\nYou are summarizing") {
+		t.Errorf("Wrong default prompt:\n%s", got)
+	}
+	if s.Key() == (&commandSummarizer{argv: []string{"cat"}, prompt: "other"}).Key() {
+		t.Error("Prompt not part of the cache key")
+	}
+
+	p.config = Config{SummaryCommand: []string{"no-such-summarizer"}}
+	s, _ = p.newSummarizer()
+	if _, err := s.Summarize("# Aliases\n"); err == nil || !strings.Contains(err.Error(), "not available") {
+		t.Errorf("Expected a missing command error, got: %v", err)
+	}
+
+	p.useAI = false
+	if s, _ := p.newSummarizer(); s.Key() != "" {
+		t.Errorf("Expected text extraction without useAI, got %s", s.Name())
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// The summary approved by the author is kept in the proposal document, in
+// an HTML comment so that it does not show in the rendered document:
+//
+//	<!-- summary
+//	The approved summary.
+//	-->
+const (
+	summaryBlockBegin = "<!-- summary\n"
+	summaryBlockEnd   = "\n-->"
+)
+
+// approvedSummary returns the approved summary stored in the proposal with
+// the given text, and whether there is one.
+func approvedSummary(content string) (string, bool) {
+	begin := strings.Index(content, summaryBlockBegin)
+	if begin < 0 {
+		return "", false
+	}
+	rest := content[begin+len(summaryBlockBegin):]
+	end := strings.Index(rest, summaryBlockEnd)
+	if end < 0 {
+		return "", false
+	}
+	return strings.TrimSpace(rest[:end]), true
+}
+
+// withoutApprovedSummary returns the text of the proposal without its
+// approved summary, which is what gets summarized.
+func withoutApprovedSummary(content string) string {
+	begin := strings.Index(content, summaryBlockBegin)
+	if begin < 0 {
+		return content
+	}
+	end := strings.Index(content[begin:], summaryBlockEnd)
+	if end < 0 {
+		return content
+	}
+	end += begin + len(summaryBlockEnd)
+	return strings.TrimRight(content[:begin], "\n") + "\n" + strings.TrimLeft(content[end:], "\n")
+}
+
+// setApprovedSummary stores summary as the approved summary of the proposal
+// with the given text, replacing the one there is or adding it at the end.
+func setApprovedSummary(content, summary string) (string, error) {
+	summary = strings.TrimSpace(summary)
+	if strings.Contains(summary, "-->") {
+		return "", fmt.Errorf("the summary cannot contain \"-->\"")
+	}
+	block := summaryBlockBegin + summary + summaryBlockEnd
+
+	if _, ok := approvedSummary(content); ok {
+		begin := strings.Index(content, summaryBlockBegin)
+		end := begin + strings.Index(content[begin:], summaryBlockEnd) + len(summaryBlockEnd)
+		return content[:begin] + block + content[end:], nil
+	}
+	return strings.TrimRight(content, "\n") + "\n\n" + block + "\n", nil
+}
+
+// reviewSummary shows the summary to be posted to the discussion and asks
+// the author to accept it, have it generated again, or edit it in $EDITOR.
+// The approved summary is stored in the proposal, with the other document
+// edits, and used instead of a generated one from then on. The summary
+// shown first is the one approved before, if there is one.
+func (p *Publisher) reviewSummary() error {
+	if p.fullText {
+		return nil
+	}
+	content, err := p.readProposal()
+	if err != nil {
+		return err
+	}
+	approved, ok := approvedSummary(content)
+	summary := approved
+	if !ok {
+		summary = p.summarize(withoutApprovedSummary(content), false)
+	}
+
+	for {
+		p.logger.Info("Summary for the discussion:\n\n%s\n", summary)
+		answer, err := p.ask("Accept, regenerate or edit the summary? [a/r/e] ")
+		if err != nil {
+			return err
+		}
+		switch strings.ToLower(answer) {
+		case "a", "accept":
+			if ok && summary == approved {
+				p.logger.Info("Keeping the approved summary")
+			} else {
+				p.queueEdit("store the approved summary", func(content string) (string, error) {
+					return setApprovedSummary(content, summary)
+				})
+			}
+			p.approvedSummary = summary
+			return nil
+		case "r", "regenerate":
+			summary = p.summarize(withoutApprovedSummary(content), true)
+		case "e", "edit":
+			edited, err := p.editText(summary)
+			if err != nil {
+				p.logger.Error("%v", err)
+				continue
+			}
+			if edited == "" {
+				p.logger.Error("The summary is empty")
+				continue
+			}
+			if strings.Contains(edited, "-->") {
+				p.logger.Error("The summary cannot contain \"-->\"")
+				continue
+			}
+			summary = edited
+		default:
+			p.logger.Warn("Answer a to accept, r to regenerate or e to edit")
+		}
+	}
+}
+
+// editText lets the user edit text in $EDITOR, vi if that is not set, and
+// returns the result.
+func (p *Publisher) editText(text string) (string, error) {
+	f, err := os.CreateTemp("", "proposal-summary-*.md")
+	if err != nil {
+		return "", fmt.Errorf("failed to create file to edit: %v", err)
+	}
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(text + "\n")
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to write file to edit: %v", err)
+	}
+
+	editor := os.Getenv("EDITOR")
+	if editor == "" {
+		editor = "vi"
+	}
+	// Like git, allow arguments in $EDITOR.
+	cmd := p.command("sh", "-c", editor+` "$@"`, editor, f.Name())
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("editor %s failed: %v", editor, err)
+	}
+
+	edited, err := os.ReadFile(f.Name())
+	if err != nil {
+		return "", fmt.Errorf("failed to read edited summary: %v", err)
+	}
+	return strings.TrimSpace(string(edited)), nil
+}
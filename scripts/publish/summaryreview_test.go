@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestApprovedSummary tests storing the approved summary in the proposal
+func TestApprovedSummary(t *testing.T) {
+	content := "# Aliases\n\nText.\n"
+	if _, ok := approvedSummary(content); ok {
+		t.Error("Found an approved summary in a proposal without one")
+	}
+
+	stored, err := setApprovedSummary(content, "First.\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "# Aliases\n\nText.\n\n<!-- summary\nFirst.\n-->\n"; stored != want {
+		t.Errorf("got %q, want %q", stored, want)
+	}
+	if got, ok := approvedSummary(stored); !ok || got != "First." {
+		t.Errorf("approvedSummary = %q, %v", got, ok)
+	}
+	if got := withoutApprovedSummary(stored); got != content {
+		t.Errorf("withoutApprovedSummary = %q", got)
+	}
+
+	replaced, err := setApprovedSummary(stored, "Second.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := approvedSummary(replaced); got != "Second." || strings.Count(replaced, "<!--") != 1 {
+		t.Errorf("Summary not replaced:\n%s", replaced)
+	}
+
+	if _, err := setApprovedSummary(content, "A --> B"); err == nil {
+		t.Error("Expected an error for a summary that ends the comment")
+	}
+}
+
+// TestReviewSummary tests regenerating and editing the summary, and that
+// the approved one is stored and used for the discussion
+func TestReviewSummary(t *testing.T) {
+	repo := NewTestRepo(t)
+	defer repo.Cleanup()
+
+	repo.createNumberedProposal("4014", "aliases", "# Aliases\n\nAliases for everything.\n")
+
+	oldDir, _ := os.Getwd()
+	os.Chdir(repo.dir)
+	defer os.Chdir(oldDir)
+	t.Setenv("EDITOR", "sed -i s/Summary/Edited/")
+
+	fake := &fakeSummarizer{key: "fake"}
+	logger := NewLogger()
+	logger.input = bufio.NewReader(strings.NewReader("what\nr\ne\na\n"))
+	p := &Publisher{
+		logger:          logger,
+		commitRef:       "HEAD",
+		proposalFile:    "designs/language/4014-aliases.md",
+		newProposalFile: "designs/language/4014-aliases.md",
+		summarizer:      fake,
+		reviewSummaries: true,
+	}
+	if err := p.reviewSummary(); err != nil {
+		t.Fatalf("reviewSummary failed: %v", err)
+	}
+	if fake.calls != 2 {
+		t.Errorf("Summary not regenerated: %d calls", fake.calls)
+	}
+	if p.approvedSummary != "Edited 2 of Aliases" {
+		t.Errorf("Wrong approved summary: %q", p.approvedSummary)
+	}
+	if err := p.commitDocumentEdits(); err != nil {
+		t.Fatalf("commitDocumentEdits failed: %v", err)
+	}
+	stored := repo.readFile("designs/language/4014-aliases.md")
+	if got, _ := approvedSummary(stored); got != "Edited 2 of Aliases" {
+		t.Errorf("Approved summary not stored:\n%s", stored)
+	}
+
+	// A later publish uses the stored summary without generating one, and
+	// accepting it again leaves the proposal alone.
+	generated, err := (&Publisher{
+		logger:          NewLogger(),
+		commitRef:       "HEAD",
+		newProposalFile: "designs/language/4014-aliases.md",
+		summarizer:      fake,
+	}).generateDiscussionContent("", "", false)
+	if err != nil {
+		t.Fatalf("generateDiscussionContent failed: %v", err)
+	}
+	if !strings.Contains(generated.body, "Edited 2 of Aliases") || fake.calls != 2 {
+		t.Errorf("Stored summary not used (%d calls):\n%s", fake.calls, generated.body)
+	}
+
+	head := repo.getCommitHash()
+	logger.input = bufio.NewReader(strings.NewReader("a\n"))
+	p.approvedSummary = ""
+	if err := p.reviewSummary(); err != nil {
+		t.Fatalf("reviewSummary failed: %v", err)
+	}
+	if err := p.commitDocumentEdits(); err != nil {
+		t.Fatalf("commitDocumentEdits failed: %v", err)
+	}
+	if repo.getCommitHash() != head || fake.calls != 2 {
+		t.Errorf("Approved summary not kept as it was")
+	}
+}
+
+// TestReviewSummaryInterrupted tests that an interrupt or the end of input
+// stops waiting for an answer
+func TestReviewSummaryInterrupted(t *testing.T) {
+	repo := NewTestRepo(t)
+	defer repo.Cleanup()
+
+	repo.createNumberedProposal("4014", "aliases", "# Aliases\n\nAliases for everything.\n")
+
+	oldDir, _ := os.Getwd()
+	os.Chdir(repo.dir)
+	defer os.Chdir(oldDir)
+
+	// No answer comes until the test is over.
+	stdin, answers := io.Pipe()
+	defer answers.Close()
+	logger := NewLogger()
+	logger.input = bufio.NewReader(stdin)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &Publisher{
+		logger:          logger,
+		commitRef:       "HEAD",
+		proposalFile:    "designs/language/4014-aliases.md",
+		newProposalFile: "designs/language/4014-aliases.md",
+		summarizer:      &fakeSummarizer{key: "fake"},
+		reviewSummaries: true,
+		ctx:             ctx,
+	}
+	time.AfterFunc(10*time.Millisecond, cancel)
+	if err := p.reviewSummary(); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected the review to be cancelled, got: %v", err)
+	}
+
+	// Without any more input, as after Ctrl-D, the review fails rather
+	// than asking again.
+	p.ctx = context.Background()
+	p.logger = NewLogger()
+	p.logger.input = bufio.NewReader(strings.NewReader(""))
+	if err := p.reviewSummary(); err == nil || !strings.Contains(err.Error(), "failed to read user input") {
+		t.Errorf("Expected the review to fail at the end of input, got: %v", err)
+	}
+}
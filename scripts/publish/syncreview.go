@@ -0,0 +1,304 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// reviewDigestMarker identifies the discussion comment holding the digest of
+// the Gerrit review, so that it is updated rather than posted again.
+const reviewDigestMarker = "<!-- proposal-publish:review-digest -->"
+
+// reviewThread is a comment thread on the proposal file in Gerrit.
+type reviewThread struct {
+	comments   []gerritComment // the root comment first, then replies by time
+	unresolved bool            // state set by the last comment
+}
+
+func (t *reviewThread) root() gerritComment {
+	return t.comments[0]
+}
+
+// lines returns the range of lines of the document the thread is about,
+// or zeros for a comment on the whole file.
+func (t *reviewThread) lines() (start, end int) {
+	root := t.root()
+	if root.Range != nil {
+		return root.Range.StartLine, root.Range.EndLine
+	}
+	return root.Line, root.Line
+}
+
+// reviewThreads groups comments into threads, ordered by position in the
+// document.
+func reviewThreads(comments []gerritComment) []*reviewThread {
+	byID := make(map[string]gerritComment)
+	for _, c := range comments {
+		byID[c.ID] = c
+	}
+
+	// Replies may reply to replies; attribute each one to its root.
+	rootOf := func(c gerritComment) string {
+		for c.InReplyTo != "" {
+			parent, ok := byID[c.InReplyTo]
+			if !ok {
+				break
+			}
+			c = parent
+		}
+		return c.ID
+	}
+
+	threads := make(map[string]*reviewThread)
+	var order []*reviewThread
+	for _, c := range comments {
+		id := rootOf(c)
+		t := threads[id]
+		if t == nil {
+			t = &reviewThread{}
+			threads[id] = t
+			order = append(order, t)
+		}
+		t.comments = append(t.comments, c)
+	}
+
+	for _, t := range order {
+		sort.SliceStable(t.comments, func(i, j int) bool {
+			ci, cj := t.comments[i], t.comments[j]
+			// The root comes first even if the clock disagrees.
+			if (ci.InReplyTo == "") != (cj.InReplyTo == "") {
+				return ci.InReplyTo == ""
+			}
+			return ci.Updated < cj.Updated
+		})
+		t.unresolved = t.comments[len(t.comments)-1].Unresolved
+	}
+
+	sort.SliceStable(order, func(i, j int) bool {
+		si, _ := order[i].lines()
+		sj, _ := order[j].lines()
+		if si != sj {
+			return si < sj
+		}
+		return order[i].root().Updated < order[j].root().Updated
+	})
+	return order
+}
+
+// headingAt returns the title of the innermost heading that line (1-based)
+// of the Markdown content falls under, or "" if it precedes all headings.
+func headingAt(content string, line int) string {
+	title := ""
+	inFence := false
+	for i, l := range strings.Split(content, "\n") {
+		if i+1 > line {
+			break
+		}
+		trimmed := strings.TrimSpace(l)
+		if strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~") {
+			inFence = !inFence
+			continue
+		}
+		if !inFence && strings.HasPrefix(l, "#") {
+			if heading := strings.TrimLeft(l, "#"); strings.HasPrefix(heading, " ") {
+				title = strings.TrimSpace(heading)
+			}
+		}
+	}
+	return title
+}
+
+// reviewDigest renders the digest of the review threads on the proposal
+// file for the discussion. Line numbers refer to the patchset each thread
+// was started on, so headings are looked up in the content of the file in
+// that patchset, from contents, and linked in the review.
+func reviewDigest(endpoint *gerritEndpoint, clNumber, file string, contents map[int]string, threads []*reviewThread) string {
+	var b strings.Builder
+	b.WriteString(reviewDigestMarker + "\n")
+	fmt.Fprintf(&b, "### Code review on [CL %s](%s)\n\n", clNumber, endpoint.changeURL(clNumber))
+
+	if len(threads) == 0 {
+		fmt.Fprintf(&b, "There are no comments on `%s` in the code review yet.\n", file)
+		return b.String()
+	}
+
+	var unresolved, resolved []*reviewThread
+	for _, t := range threads {
+		if t.unresolved {
+			unresolved = append(unresolved, t)
+		} else {
+			resolved = append(resolved, t)
+		}
+	}
+	fmt.Fprintf(&b, "%d unresolved and %d resolved comment threads on `%s`. Reply in the code review to take part in a thread.\n",
+		len(unresolved), len(resolved), file)
+
+	writeThreads := func(heading string, threads []*reviewThread) {
+		if len(threads) == 0 {
+			return
+		}
+		fmt.Fprintf(&b, "\n#### %s\n\n", heading)
+		for _, t := range threads {
+			root := t.root()
+
+			where := "Whole document"
+			if start, end := t.lines(); start > 0 {
+				where = fmt.Sprintf("line %d", start)
+				if end > start {
+					where = fmt.Sprintf("lines %d–%d", start, end)
+				}
+				// The document on main has no anchors for the headings
+				// until the change is merged, so link the lines in the
+				// patchset instead.
+				if title := headingAt(contents[root.PatchSet], start); title != "" {
+					url := fmt.Sprintf("%s/%d/%s#%d", endpoint.changeURL(clNumber), root.PatchSet, escapePath(file), start)
+					where = fmt.Sprintf("[%s](%s), %s", title, url, where)
+				}
+			}
+
+			author := root.Author.Name
+			if author == "" {
+				author = root.Author.Username
+			}
+			link := fmt.Sprintf("%s/comment/%s/", endpoint.changeURL(clNumber), root.ID)
+			fmt.Fprintf(&b, "- %s: [%s](%s): %s", where, author, link, commentSnippet(root.Message))
+			if replies := len(t.comments) - 1; replies == 1 {
+				b.WriteString(" (1 reply)")
+			} else if replies > 1 {
+				fmt.Fprintf(&b, " (%d replies)", replies)
+			}
+			b.WriteString("\n")
+		}
+	}
+	writeThreads("Unresolved", unresolved)
+	writeThreads("Resolved", resolved)
+	return b.String()
+}
+
+// commentSnippet returns the first line of a comment, shortened for the
+// digest.
+func commentSnippet(message string) string {
+	const maxLen = 120
+	line, _, _ := strings.Cut(strings.TrimSpace(message), "\n")
+	if r := []rune(line); len(r) > maxLen {
+		line = string(r[:maxLen-1]) + "…"
+	}
+	return line
+}
+
+// syncReview posts or updates the digest of the Gerrit review threads on
+// the proposal file as a comment on the discussion.
+func (p *Publisher) syncReview() error {
+	p.logger.Info("Syncing review comments of CL %s to discussion #%s...", p.clNumber, p.discussionNumber)
+
+	change, err := p.lookupCL()
+	if err != nil {
+		return err
+	}
+	client, err := p.gerritClient()
+	if err != nil {
+		return err
+	}
+	comments, err := client.changeComments(change)
+	if err != nil {
+		return fmt.Errorf("failed to get comments of CL %s: %v", p.clNumber, err)
+	}
+
+	threads := reviewThreads(comments[p.newProposalFile])
+	contents := make(map[int]string)
+	for _, t := range threads {
+		patchset := t.root().PatchSet
+		if _, ok := contents[patchset]; ok || patchset == 0 {
+			continue
+		}
+		content, err := client.fileContent(change, patchset, p.newProposalFile)
+		if err != nil {
+			return fmt.Errorf("failed to get %s in patchset %d of CL %s: %v", p.newProposalFile, patchset, p.clNumber, err)
+		}
+		contents[patchset] = content
+	}
+	digest := reviewDigest(client.endpoint, p.clNumber, p.newProposalFile, contents, threads)
+
+	if p.dryRun {
+		p.logger.Info("[DRY RUN] Would post review digest on discussion #%s:", p.discussionNumber)
+		fmt.Fprintf(os.Stderr, "%s\n", digest)
+		return nil
+	}
+
+	existing, err := p.discussionComments()
+	if err != nil {
+		return err
+	}
+	for _, c := range existing {
+		if !c.ViewerDidAuthor || !strings.Contains(c.Body, reviewDigestMarker) {
+			continue
+		}
+		if c.Body == digest {
+			p.logger.Info("Review digest is up to date: %s", c.URL)
+			return nil
+		}
+		url, err := p.updateDiscussionComment(c.ID, digest)
+		if err != nil {
+			return fmt.Errorf("failed to update review digest: %v", err)
+		}
+		p.logger.Success("Updated review digest: %s", url)
+		return nil
+	}
+
+	if len(threads) == 0 {
+		p.logger.Info("No review comments on %s yet", p.newProposalFile)
+		return nil
+	}
+
+	live, err := p.fetchDiscussion()
+	if err != nil {
+		return err
+	}
+	url, err := p.addDiscussionComment(live.ID, digest)
+	if err != nil {
+		return fmt.Errorf("failed to post review digest: %v", err)
+	}
+	p.logger.Success("Posted review digest: %s", url)
+	return nil
+}
+
+// runSyncReview implements "publish sync-review": it posts the state of the
+// code review of a published proposal to its discussion.
+func runSyncReview(args []string) error {
+	fs := flag.NewFlagSet("sync-review", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "Show the digest without posting it")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s sync-review [--dry-run] [commit-ref]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Post a digest of the Gerrit comment threads on a published proposal\n")
+		fmt.Fprintf(os.Stderr, "to its GitHub discussion, updating the previous digest if there is one.\n\n")
+		fmt.Fprintf(os.Stderr, "Arguments:\n")
+		fmt.Fprintf(os.Stderr, "  commit-ref   Commit that was mailed for review (default: HEAD)\n\n")
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	commitRef := "HEAD"
+	switch fs.NArg() {
+	case 0:
+	case 1:
+		commitRef = fs.Arg(0)
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	p := NewPublisher(commitRef, *dryRun, false)
+	if err := p.findProposalFile(); err != nil {
+		return err
+	}
+	if !p.isNumbered {
+		return fmt.Errorf("%s is a draft; publish it before syncing its review", p.proposalFile)
+	}
+	p.newProposalFile = p.proposalFile
+
+	return p.syncReview()
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const reviewTestDocument = "# Aliases\n" + // 1
+	"\n" + // 2
+	"## Objective\n" + // 3
+	"\n" + // 4
+	"Let there be aliases.\n" + // 5
+	"\n" + // 6
+	"```\n" + // 7
+	"# not a heading\n" + // 8
+	"```\n" + // 9
+	"\n" + // 10
+	"### Syntax details\n" + // 11
+	"\n" + // 12
+	"`let X = Y`\n" // 13
+
+// TestHeadingAt tests mapping lines to the headings they fall under
+func TestHeadingAt(t *testing.T) {
+	tests := []struct {
+		line int
+		want string
+	}{
+		{1, "Aliases"},
+		{2, "Aliases"},
+		{5, "Objective"},
+		{8, "Objective"},
+		{10, "Objective"},
+		{11, "Syntax details"},
+		{13, "Syntax details"},
+	}
+	for _, tt := range tests {
+		if got := headingAt(reviewTestDocument, tt.line); got != tt.want {
+			t.Errorf("headingAt(%d) = %q, want %q", tt.line, got, tt.want)
+		}
+	}
+	if got := headingAt("Preamble\n\n# Title\n", 1); got != "" {
+		t.Errorf("Line before any heading: got %q", got)
+	}
+}
+
+// TestReviewThreads tests grouping comments into threads
+func TestReviewThreads(t *testing.T) {
+	comments := []gerritComment{
+		{ID: "c", InReplyTo: "a", Updated: "2025-01-02 10:00:00", Unresolved: false},
+		{ID: "a", Line: 5, Updated: "2025-01-01 10:00:00", Unresolved: true},
+		{ID: "b", Line: 13, Updated: "2025-01-01 09:00:00", Unresolved: true},
+		{ID: "d", InReplyTo: "c", Updated: "2025-01-03 10:00:00", Unresolved: true},
+		{ID: "e", Updated: "2025-01-01 08:00:00", Unresolved: false},
+	}
+	threads := reviewThreads(comments)
+
+	var got []string
+	for _, th := range threads {
+		var ids []string
+		for _, c := range th.comments {
+			ids = append(ids, c.ID)
+		}
+		state := "resolved"
+		if th.unresolved {
+			state = "unresolved"
+		}
+		got = append(got, strings.Join(ids, ",")+" "+state)
+	}
+	want := []string{"e resolved", "a,c,d unresolved", "b unresolved"}
+	if strings.Join(got, "; ") != strings.Join(want, "; ") {
+		t.Errorf("Got threads %q, want %q", got, want)
+	}
+}
+
+// TestReviewDigest tests the digest posted on the discussion
+func TestReviewDigest(t *testing.T) {
+	endpoint := &gerritEndpoint{scheme: "https", host: "cue.gerrithub.io", project: "cue-lang/proposal"}
+	file := "designs/language/4014-aliases.md"
+
+	comments := []gerritComment{
+		{ID: "a", PatchSet: 1, Line: 5, Message: "Why?\nMore details.", Unresolved: true, Updated: "1"},
+		{ID: "b", PatchSet: 2, InReplyTo: "a", Message: "Because.", Unresolved: true, Updated: "2"},
+		{ID: "c", PatchSet: 1, Message: "Nice document.", Updated: "1"},
+	}
+	comments[0].Author.Name = "Alice"
+	comments[1].Author.Name = "Bob"
+	comments[2].Author.Username = "carol"
+	r := &struct {
+		StartLine int `json:"start_line"`
+		EndLine   int `json:"end_line"`
+	}{11, 13}
+	comments = append(comments, gerritComment{ID: "d", PatchSet: 2, Range: r, Message: "Resolved nit.", Updated: "3"})
+	comments[3].Author.Name = "Dan"
+
+	// The heading of the lines commented on was renamed in patchset 2.
+	contents := map[int]string{
+		1: strings.Replace(reviewTestDocument, "### Syntax details", "### Syntax", 1),
+		2: reviewTestDocument,
+	}
+	got := reviewDigest(endpoint, "1234", file, contents, reviewThreads(comments))
+
+	cl := "https://cue.gerrithub.io/c/cue-lang/proposal/+/1234"
+	for _, want := range []string{
+		reviewDigestMarker + "\n### Code review on [CL 1234](" + cl + ")\n",
+		"1 unresolved and 2 resolved comment threads",
+		"#### Unresolved\n\n- [Objective](" + cl + "/1/" + file + "#5), line 5: [Alice](" + cl + "/comment/a/): Why? (1 reply)\n",
+		"#### Resolved\n\n- Whole document: [carol](" + cl + "/comment/c/): Nice document.\n" +
+			"- [Syntax details](" + cl + "/2/" + file + "#11), lines 11–13: [Dan](" + cl + "/comment/d/): Resolved nit.\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("Digest does not contain %q:\n%s", want, got)
+		}
+	}
+
+	empty := reviewDigest(endpoint, "1234", file, contents, nil)
+	if !strings.Contains(empty, "no comments") {
+		t.Errorf("Wrong digest without threads:\n%s", empty)
+	}
+}
+
+// TestSyncReviewDryRun tests collecting the threads of the proposal file
+// from Gerrit
+func TestSyncReviewDryRun(t *testing.T) {
+	gerrit := newFakeGerrit(t)
+	gerrit.addChange(testChangeID, 4321, 2, "NEW")
+	t.Setenv("NETRC", filepath.Join(t.TempDir(), "netrc"))
+
+	file := "designs/language/4014-aliases.md"
+	gerrit.comments[testChangeID] = map[string][]gerritComment{
+		file:              {{ID: "a", PatchSet: 1, Line: 1, Message: "On the proposal", Unresolved: true}},
+		"/PATCHSET_LEVEL": {{ID: "b", Message: "On the change"}},
+	}
+	gerrit.files[testChangeID] = map[string]string{"1/" + file: reviewTestDocument}
+
+	repo := newGerritTestRepo(t, gerrit)
+	defer repo.Cleanup()
+
+	oldDir, _ := os.Getwd()
+	os.Chdir(repo.dir)
+	defer os.Chdir(oldDir)
+
+	publisher := &Publisher{
+		logger:           NewLogger(),
+		commitRef:        "HEAD",
+		dryRun:           true,
+		discussionNumber: "4014",
+		newProposalFile:  file,
+	}
+	if err := publisher.syncReview(); err != nil {
+		t.Fatalf("syncReview failed: %v", err)
+	}
+
+	// The digest itself is covered by TestReviewDigest; check that the
+	// comments and the file they are on were requested for the right
+	// change and patchset.
+	var comments, content bool
+	for _, r := range gerrit.requests {
+		if !strings.Contains(r.URL.Path, testChangeID) {
+			continue
+		}
+		comments = comments || strings.HasSuffix(r.URL.Path, "/comments")
+		content = content || strings.HasSuffix(r.URL.Path, "/revisions/1/files/"+file+"/content")
+	}
+	if !comments {
+		t.Error("Comments were not fetched from Gerrit")
+	}
+	if !content {
+		t.Error("File in the commented patchset was not fetched from Gerrit")
+	}
+}
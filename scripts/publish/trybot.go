@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// trybotRepo is the GitHub repository the trybot workflow runs in. The
+// "Dispatch trybot" workflow pushes the CL's commit there with a
+// Dispatch-Trailer identifying the CL and patchset.
+const trybotRepo = "cue-lang/proposal-trybot"
+
+// Defaults for tracking a trybot run. A run of this repository's checks
+// takes a few minutes, most of it waiting for a runner.
+const (
+	trybotPollInterval = 15 * time.Second
+	trybotTimeout      = 30 * time.Minute
+)
+
+// dispatchTrailerPattern matches the Dispatch-Trailer added to commits
+// pushed to the trybot repository; see .github/workflows/trybot_dispatch.yaml.
+var dispatchTrailerPattern = regexp.MustCompile(`(?m)^Dispatch-Trailer: (\{.*\})\s*$`)
+
+// dispatchTrailer is the payload of a Dispatch-Trailer, as sent by
+// cueckoo runtrybot.
+type dispatchTrailer struct {
+	Type         string `json:"type"`
+	CL           int    `json:"CL"`
+	Patchset     int    `json:"patchset"`
+	Ref          string `json:"ref"`
+	TargetBranch string `json:"targetBranch"`
+}
+
+// parseDispatchTrailer returns the last Dispatch-Trailer of a commit
+// message, or nil if there is none.
+func parseDispatchTrailer(message string) *dispatchTrailer {
+	matches := dispatchTrailerPattern.FindAllStringSubmatch(message, -1)
+	if matches == nil {
+		return nil
+	}
+	var trailer dispatchTrailer
+	if err := json.Unmarshal([]byte(matches[len(matches)-1][1]), &trailer); err != nil {
+		return nil
+	}
+	return &trailer
+}
+
+// workflowRun is a GitHub Actions workflow run.
+type workflowRun struct {
+	ID         int64     `json:"id"`
+	Status     string    `json:"status"`     // queued, in_progress, completed, ...
+	Conclusion string    `json:"conclusion"` // success, failure, cancelled, ...
+	HTMLURL    string    `json:"html_url"`
+	HeadSHA    string    `json:"head_sha"`
+	CreatedAt  time.Time `json:"created_at"`
+	HeadCommit struct {
+		Message string `json:"message"`
+	} `json:"head_commit"`
+}
+
+// workflowJob is a job of a GitHub Actions workflow run.
+type workflowJob struct {
+	Name       string `json:"name"`
+	Status     string `json:"status"`
+	Conclusion string `json:"conclusion"`
+	HTMLURL    string `json:"html_url"`
+}
+
+// matchTrybotRun returns the most recent run that was dispatched for the
+// given CL and patchset, or nil if there is none yet.
+func matchTrybotRun(runs []workflowRun, cl, patchset int) *workflowRun {
+	var found *workflowRun
+	for i := range runs {
+		run := &runs[i]
+		trailer := parseDispatchTrailer(run.HeadCommit.Message)
+		if trailer == nil || trailer.Type != "trybot" || trailer.CL != cl || trailer.Patchset != patchset {
+			continue
+		}
+		if found == nil || run.CreatedAt.After(found.CreatedAt) {
+			found = run
+		}
+	}
+	return found
+}
+
+// trybotSource finds and follows the trybot run for a review.
+type trybotSource interface {
+	// find returns the run, or nil if it has not started yet.
+	find() (*workflowRun, error)
+
+	// run returns the current state of a run.
+	run(id int64) (*workflowRun, error)
+
+	// jobs returns the jobs of a run.
+	jobs(id int64) ([]workflowJob, error)
+}
+
+// dispatchedTrybots are the trybot runs cueckoo dispatches for a patchset
+// of a Gerrit CL.
+type dispatchedTrybots struct {
+	p        *Publisher
+	cl       int
+	patchset int
+}
+
+func (d *dispatchedTrybots) find() (*workflowRun, error) {
+	runs, err := d.p.trybotRuns()
+	if err != nil {
+		return nil, err
+	}
+	return matchTrybotRun(runs, d.cl, d.patchset), nil
+}
+
+func (d *dispatchedTrybots) run(id int64) (*workflowRun, error) {
+	return d.p.trybotRun(id)
+}
+
+func (d *dispatchedTrybots) jobs(id int64) ([]workflowJob, error) {
+	return d.p.trybotJobs(id)
+}
+
+// trybotRuns lists the recent trybot workflow runs.
+func (p *Publisher) trybotRuns() ([]workflowRun, error) {
+	resp, err := p.callGitHubAPI("GET", "repos/"+trybotRepo+"/actions/workflows/trybot.yaml/runs?event=push&per_page=50", nil)
+	if err != nil {
+		return nil, err
+	}
+	var result struct {
+		WorkflowRuns []workflowRun `json:"workflow_runs"`
+	}
+	if err := json.Unmarshal(resp, &result); err != nil {
+		return nil, fmt.Errorf("failed to parse workflow runs: %v", err)
+	}
+	return result.WorkflowRuns, nil
+}
+
+// trybotRun returns the current state of a workflow run.
+func (p *Publisher) trybotRun(id int64) (*workflowRun, error) {
+	resp, err := p.callGitHubAPI("GET", fmt.Sprintf("repos/%s/actions/runs/%d", trybotRepo, id), nil)
+	if err != nil {
+		return nil, err
+	}
+	var run workflowRun
+	if err := json.Unmarshal(resp, &run); err != nil {
+		return nil, fmt.Errorf("failed to parse workflow run: %v", err)
+	}
+	return &run, nil
+}
+
+// trybotJobs returns the jobs of a workflow run.
+func (p *Publisher) trybotJobs(id int64) ([]workflowJob, error) {
+	resp, err := p.callGitHubAPI("GET", fmt.Sprintf("repos/%s/actions/runs/%d/jobs", trybotRepo, id), nil)
+	if err != nil {
+		return nil, err
+	}
+	var result struct {
+		Jobs []workflowJob `json:"jobs"`
+	}
+	if err := json.Unmarshal(resp, &result); err != nil {
+		return nil, fmt.Errorf("failed to parse workflow jobs: %v", err)
+	}
+	return result.Jobs, nil
+}
+
+// waitForTrybots waits for the trybot run to appear and complete, and
+// returns the run and its jobs.
+func (p *Publisher) waitForTrybots(ctx context.Context, opts waitOptions, source trybotSource) (*workflowRun, []workflowJob, error) {
+	if opts.interval <= 0 {
+		opts.interval = trybotPollInterval
+	}
+	if opts.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.timeout)
+		defer cancel()
+	}
+
+	var run *workflowRun
+	lastStatus := ""
+	for {
+		var err error
+		if run == nil {
+			if run, err = source.find(); err != nil {
+				return nil, nil, fmt.Errorf("failed to list trybot runs: %v", err)
+			}
+			if run != nil {
+				p.logger.Info("Tracking trybot run: %s", run.HTMLURL)
+			}
+		} else if run, err = source.run(run.ID); err != nil {
+			return nil, nil, fmt.Errorf("failed to get trybot run: %v", err)
+		}
+
+		if run != nil {
+			if run.Status == "completed" {
+				jobs, err := source.jobs(run.ID)
+				if err != nil {
+					return nil, nil, fmt.Errorf("failed to get trybot jobs: %v", err)
+				}
+				return run, jobs, nil
+			}
+			if run.Status != lastStatus {
+				p.logger.Info("Trybot run is %s...", strings.ReplaceAll(run.Status, "_", " "))
+				lastStatus = run.Status
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			what := "waiting for the trybot run to start"
+			if run != nil {
+				what = "waiting for trybot run " + run.HTMLURL
+			}
+			if ctx.Err() == context.DeadlineExceeded {
+				return nil, nil, fmt.Errorf("timed out after %v %s", opts.timeout, what)
+			}
+			return nil, nil, fmt.Errorf("stopped %s: %v", what, ctx.Err())
+		case <-time.After(opts.interval):
+		}
+	}
+}
+
+// reportTrybotJobs logs the result of each job and returns an error naming
+// the jobs that did not succeed.
+func (p *Publisher) reportTrybotJobs(run *workflowRun, jobs []workflowJob) error {
+	var failed []string
+	for _, job := range jobs {
+		switch job.Conclusion {
+		case "success", "skipped":
+			p.logger.Success("Trybot job %s: %s", job.Name, job.Conclusion)
+		default:
+			p.logger.Error("Trybot job %s: %s (%s)", job.Name, job.Conclusion, job.HTMLURL)
+			failed = append(failed, job.Name)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("trybots failed: %s (%s)", strings.Join(failed, ", "), run.HTMLURL)
+	}
+	if run.Conclusion != "success" {
+		return fmt.Errorf("trybot run concluded with %s (%s)", run.Conclusion, run.HTMLURL)
+	}
+	return nil
+}
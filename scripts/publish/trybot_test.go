@@ -0,0 +1,88 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestParseDispatchTrailer tests reading the trailer added by the trybot
+// dispatch workflow
+func TestParseDispatchTrailer(t *testing.T) {
+	message := `designs: add aliases
+
+Change-Id: I0123456789abcdef0123456789abcdef01234567
+Dispatch-Trailer: {"type":"trybot","CL":1234,"patchset":3,"targetBranch":"master","ref":"refs/changes/34/1234/3"}
+`
+	trailer := parseDispatchTrailer(message)
+	if trailer == nil {
+		t.Fatal("Trailer not found")
+	}
+	want := dispatchTrailer{Type: "trybot", CL: 1234, Patchset: 3, TargetBranch: "master", Ref: "refs/changes/34/1234/3"}
+	if *trailer != want {
+		t.Errorf("Got %+v, want %+v", *trailer, want)
+	}
+
+	if trailer := parseDispatchTrailer("designs: add aliases\n\nChange-Id: I0123\n"); trailer != nil {
+		t.Errorf("Expected no trailer, got %+v", trailer)
+	}
+	if trailer := parseDispatchTrailer("x\n\nDispatch-Trailer: {not json}\n"); trailer != nil {
+		t.Errorf("Expected no trailer for invalid JSON, got %+v", trailer)
+	}
+}
+
+// TestMatchTrybotRun tests finding the run for a CL and patchset
+func TestMatchTrybotRun(t *testing.T) {
+	run := func(id int64, minute int, trailer string) workflowRun {
+		r := workflowRun{ID: id, CreatedAt: time.Date(2025, 1, 1, 12, minute, 0, 0, time.UTC)}
+		r.HeadCommit.Message = "designs: add aliases\n\nDispatch-Trailer: " + trailer + "\n"
+		return r
+	}
+	runs := []workflowRun{
+		run(1, 0, `{"type":"trybot","CL":1234,"patchset":2}`),
+		run(2, 5, `{"type":"trybot","CL":1234,"patchset":3}`),
+		run(3, 9, `{"type":"trybot","CL":1234,"patchset":3}`),
+		run(4, 7, `{"type":"trybot","CL":1234,"patchset":3}`),
+		run(5, 8, `{"type":"unity","CL":1234,"patchset":3}`),
+		run(6, 9, `{"type":"trybot","CL":999,"patchset":3}`),
+	}
+
+	if got := matchTrybotRun(runs, 1234, 3); got == nil || got.ID != 3 {
+		t.Errorf("Expected latest run 3, got %+v", got)
+	}
+	if got := matchTrybotRun(runs, 1234, 2); got == nil || got.ID != 1 {
+		t.Errorf("Expected run 1, got %+v", got)
+	}
+	if got := matchTrybotRun(runs, 1234, 4); got != nil {
+		t.Errorf("Expected no run, got %+v", got)
+	}
+}
+
+// TestReportTrybotJobs tests turning job results into a pass or fail
+func TestReportTrybotJobs(t *testing.T) {
+	p := &Publisher{logger: NewLogger()}
+	run := &workflowRun{Conclusion: "success", HTMLURL: "https://github.com/cue-lang/proposal-trybot/actions/runs/1"}
+
+	passed := []workflowJob{
+		{Name: "test", Conclusion: "success"},
+		{Name: "optional", Conclusion: "skipped"},
+	}
+	if err := p.reportTrybotJobs(run, passed); err != nil {
+		t.Errorf("Expected success, got: %v", err)
+	}
+
+	failed := []workflowJob{
+		{Name: "test (linux)", Conclusion: "success"},
+		{Name: "test (windows)", Conclusion: "failure"},
+	}
+	run.Conclusion = "failure"
+	err := p.reportTrybotJobs(run, failed)
+	if err == nil || !strings.Contains(err.Error(), "test (windows)") || strings.Contains(err.Error(), "linux") {
+		t.Errorf("Expected failure naming the failed job, got: %v", err)
+	}
+
+	run.Conclusion = "cancelled"
+	if err := p.reportTrybotJobs(run, passed); err == nil || !strings.Contains(err.Error(), "cancelled") {
+		t.Errorf("Expected cancelled run to fail, got: %v", err)
+	}
+}
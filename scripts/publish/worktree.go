@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// worktreeBranchPrefix is the prefix of the temporary branch checked out in
+// the worktree publish works in.
+const worktreeBranchPrefix = "proposal-publish/"
+
+// worktree is a temporary git worktree that the publish workflow runs its
+// commands in, so that tests, file edits and commits leave the user's
+// checkout, index and stash alone. It has a temporary branch of its own,
+// starting where the user's HEAD is and tracking the same upstream.
+type worktree struct {
+	dir     string
+	branch  string   // temporary branch checked out in the worktree
+	base    string   // commit the user's HEAD was at
+	reasons []string // reasons of the rewrites made in the worktree
+	keep    bool     // keep the worktree and its branch when closing it
+}
+
+// openWorktree creates the worktree and makes commands run in it, until
+// closeWorktree. With keep, the worktree is kept when closed.
+func (p *Publisher) openWorktree(keep bool) error {
+	head, _, err := p.runCommand("git", "rev-parse", "HEAD")
+	if err != nil {
+		return fmt.Errorf("failed to resolve HEAD: %v", err)
+	}
+	upstream, _, _ := p.runCommand("git", "rev-parse", "--abbrev-ref", "--symbolic-full-name", "@{upstream}")
+
+	dir, err := os.MkdirTemp("", "proposal-publish-*")
+	if err != nil {
+		return fmt.Errorf("failed to create worktree directory: %v", err)
+	}
+	w := &worktree{
+		dir:    dir,
+		branch: worktreeBranchPrefix + time.Now().UTC().Format(backupTimeFormat),
+		base:   strings.TrimSpace(head),
+		keep:   keep,
+	}
+	if _, stderr, err := p.runCommand("git", "worktree", "add", "--quiet", "-b", w.branch, dir, w.base); err != nil {
+		os.RemoveAll(dir)
+		return fmt.Errorf("failed to create worktree: %v (stderr: %s)", err, strings.TrimSpace(stderr))
+	}
+	p.worktree = w
+	p.dir = dir
+
+	// Commands such as git codereview mail see the same pending commits as
+	// on the user's branch.
+	if upstream = strings.TrimSpace(upstream); upstream != "" {
+		p.runCommand("git", "branch", "--quiet", "--set-upstream-to", upstream)
+	}
+	p.logger.Info("Working in temporary worktree %s", dir)
+	return nil
+}
+
+// closeWorktree moves the user's branch to where the worktree's branch is
+// now, if it was rewritten, and removes the worktree and its branch unless
+// they are to be kept. The user's checkout then follows the branch as git
+// checkout would: only files the rewrites changed are updated, and local
+// changes to them keep the branch where it was. The worktree is kept in
+// that case too, as its branch is the only one with the rewritten commits.
+// This happens even if the workflow was interrupted or timed out.
+func (p *Publisher) closeWorktree() error {
+	if p.worktree == nil {
+		return nil
+	}
+	return p.cleanup(p.removeWorktree)
+}
+
+// removeWorktree does the work of closeWorktree.
+func (p *Publisher) removeWorktree() error {
+	w := p.worktree
+	head, _, headErr := p.runCommand("git", "rev-parse", "HEAD")
+	head = strings.TrimSpace(head)
+	p.worktree = nil
+	p.dir = ""
+
+	var err error
+	if headErr == nil && head != w.base {
+		if err = p.updateBranch(w.base, head, strings.Join(w.reasons, "; ")); err != nil {
+			err = fmt.Errorf("failed to move the current branch to the published commit %s: %v", shortHash(head), err)
+			w.keep = true
+		}
+	}
+
+	if w.keep {
+		p.logger.Info("Kept worktree %s on branch %s; remove both with:", w.dir, w.branch)
+		p.logger.Info("  git worktree remove --force %s && git branch -D %s", w.dir, w.branch)
+		return err
+	}
+	if _, stderr, rmErr := p.runCommand("git", "worktree", "remove", "--force", w.dir); rmErr != nil {
+		p.logger.Warn("Could not remove worktree %s: %s", w.dir, strings.TrimSpace(stderr))
+		return err
+	}
+	p.runCommand("git", "branch", "--quiet", "-D", w.branch)
+	return err
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+)
+
+// TestWorktreeRename tests that a rename is made in a temporary worktree
+// and the current branch only follows when the worktree is closed
+func TestWorktreeRename(t *testing.T) {
+	repo := NewTestRepo(t)
+	defer repo.Cleanup()
+
+	proposal := repo.createDraftProposal("aliases", "# Aliases\n\n*   **Discussion Channel**: TBD\n")
+
+	// Local changes, staged changes and a stash, none of which publishing
+	// may touch.
+	repo.writeFile("stashed.txt", "stashed\n")
+	repo.run("git", "add", "stashed.txt")
+	repo.run("git", "stash")
+	repo.writeFile("README.md", "# Staged\n")
+	repo.run("git", "add", "README.md")
+	repo.writeFile("notes.txt", "untracked\n")
+
+	oldDir, _ := os.Getwd()
+	os.Chdir(repo.dir)
+	defer os.Chdir(oldDir)
+
+	publisher := &Publisher{
+		logger:           NewLogger(),
+		commitRef:        "HEAD",
+		proposalFile:     "designs/language/xxxx-aliases.md",
+		basename:         "xxxx-aliases.md",
+		isDraft:          true,
+		discussionNumber: "4014",
+		discussionURL:    "https://github.com/cue-lang/cue/discussions/4014",
+	}
+	if err := publisher.openWorktree(false); err != nil {
+		t.Fatalf("openWorktree failed: %v", err)
+	}
+	dir := publisher.worktree.dir
+	branch := publisher.worktree.branch
+
+	if err := publisher.renameProposal(); err != nil {
+		t.Fatalf("renameProposal failed: %v", err)
+	}
+	if err := publisher.commitDocumentEdits(); err != nil {
+		t.Fatalf("commitDocumentEdits failed: %v", err)
+	}
+
+	// Until the worktree is closed, only its branch has moved.
+	if repo.getCommitHash() != proposal {
+		t.Error("Current branch moved before the worktree was closed")
+	}
+	if _, err := os.Stat(dir + "/designs/language/4014-aliases.md"); err != nil {
+		t.Errorf("Rename not checked out in the worktree: %v", err)
+	}
+
+	if err := publisher.closeWorktree(); err != nil {
+		t.Fatalf("closeWorktree failed: %v", err)
+	}
+
+	if repo.getCommitHash() == proposal {
+		t.Error("Current branch not moved to the rewritten commit")
+	}
+	if !repo.fileExists("designs/language/4014-aliases.md") || repo.fileExists("designs/language/xxxx-aliases.md") {
+		t.Error("Checkout does not follow the rename")
+	}
+	if status := repo.run("git", "status", "--porcelain"); status != "M  README.md\n?? notes.txt\n" {
+		t.Errorf("Local changes not kept:\n%s", status)
+	}
+	if stashes := repo.run("git", "stash", "list"); strings.Count(stashes, "\n") != 1 {
+		t.Errorf("Stash changed:\n%s", stashes)
+	}
+	if got := repo.run("git", "reflog", "-1", "--format=%gs", "HEAD"); !strings.Contains(got, "publish: rename proposal") {
+		t.Errorf("Wrong reflog entry: %s", got)
+	}
+	if backups, _ := publisher.listBackups(); len(backups) != 1 || backups[0].commit != proposal {
+		t.Errorf("Expected a backup of %s: %v", proposal, backups)
+	}
+
+	// The worktree and its branch are gone.
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("Worktree %s not removed: %v", dir, err)
+	}
+	if out, _ := repo.runExpectError("git", "rev-parse", "--verify", "--quiet", branch); strings.TrimSpace(out) != "" {
+		t.Errorf("Branch %s not deleted", branch)
+	}
+	if list := repo.run("git", "worktree", "list"); strings.Count(list, "\n") != 1 {
+		t.Errorf("Worktree still listed:\n%s", list)
+	}
+}
+
+// TestKeepWorktree tests keeping the worktree for debugging, and that
+// closing a worktree without rewrites leaves the branch alone
+func TestKeepWorktree(t *testing.T) {
+	repo := NewTestRepo(t)
+	defer repo.Cleanup()
+	head := repo.getCommitHash()
+
+	oldDir, _ := os.Getwd()
+	os.Chdir(repo.dir)
+	defer os.Chdir(oldDir)
+
+	publisher := &Publisher{logger: NewLogger(), commitRef: "HEAD"}
+	if err := publisher.openWorktree(true); err != nil {
+		t.Fatalf("openWorktree failed: %v", err)
+	}
+	dir := publisher.worktree.dir
+	defer os.RemoveAll(dir)
+
+	if err := publisher.closeWorktree(); err != nil {
+		t.Fatalf("closeWorktree failed: %v", err)
+	}
+	if publisher.dir != "" || publisher.worktree != nil {
+		t.Error("Commands still run in the worktree")
+	}
+	if _, err := os.Stat(dir); err != nil {
+		t.Errorf("Worktree not kept: %v", err)
+	}
+	if repo.getCommitHash() != head {
+		t.Error("Branch moved without any rewrite")
+	}
+}
+
+// TestDryRunWithoutWorktree tests that a dry run creates no worktree or
+// branch
+func TestDryRunWithoutWorktree(t *testing.T) {
+	w := newWorkflowTest(t, "designs/language/xxxx-aliases.md", workflowProposal, "")
+	p := &Publisher{logger: NewLogger(), commitRef: "HEAD", dryRun: true, commands: w.runner}
+	if err := p.publish(context.Background(), false, false, waitOptions{}); err != nil {
+		t.Fatalf("publish failed: %v\n%s", err, w.runner.transcript())
+	}
+	if transcript := w.runner.transcript(); strings.Contains(transcript, "git worktree add") {
+		t.Errorf("Worktree added:\n%s", transcript)
+	}
+	if branches := w.repo.run("git", "branch", "--list", worktreeBranchPrefix+"*"); branches != "" {
+		t.Errorf("Temporary branches created: %s", branches)
+	}
+	if worktrees := w.repo.run("git", "worktree", "list", "--porcelain"); strings.Count(worktrees, "worktree ") != 1 {
+		t.Errorf("Worktrees created:\n%s", worktrees)
+	}
+}